@@ -5,21 +5,47 @@ import (
 	"time"
 
 	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/sauromates/leech/internal/handshake"
 	"github.com/sauromates/leech/internal/message"
 	"github.com/sauromates/leech/internal/peers"
 )
 
 // Client represents a TCP connection with a peer
 type Client struct {
-	Conn     net.Conn
-	IsChoked bool
-	BitField bitfield.BitField
-	Peer     peers.Peer
+	Conn net.Conn
+	// Connection state (BEP 3). Both sides start choking and not
+	// interested
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+	BitField       bitfield.BitField
+	Peer           peers.Peer
+	// Reserved holds extension bits from peer's handshake
+	Reserved handshake.Reserved
+	// Fast tells whether both sides support fast extension (BEP 6)
+	Fast bool
+	// HaveAll tells that the peer sent HaveAll instead of a bitfield, so
+	// it has every piece
+	HaveAll bool
+	// Extensions are extension protocol extensions enabled for the
+	// connection. Nil if peer doesn't support extension protocol
+	Extensions *Registry
+	// PeerExtensions is peer's extension handshake, nil until received
+	PeerExtensions *message.ExtendedHandshake
+	// pending is the message read while waiting for the bitfield, it's
+	// returned by the next Read
+	pending *message.Message
 }
 
 // Read passes client connection instance as io.Reader to message parser
 // and returns parsed struct
 func (client *Client) Read() (*message.Message, error) {
+	if msg := client.pending; msg != nil {
+		client.pending = nil
+		return msg, nil
+	}
+
 	client.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	defer client.Conn.SetReadDeadline(time.Time{})
 
@@ -36,6 +62,21 @@ func (client *Client) Write(msg *message.Message) error {
 	return err
 }
 
+// FitBitField sizes peer's bitfield for given number of pieces. Peers
+// having no pieces may skip the bitfield and seeders may send HaveAll
+// instead of it.
+func (client *Client) FitBitField(count int) {
+	if size := (count + 7) / 8; len(client.BitField) < size {
+		client.BitField = append(client.BitField, make(bitfield.BitField, size-len(client.BitField))...)
+	}
+
+	if client.HaveAll {
+		for index := range count {
+			client.BitField.SetPiece(index)
+		}
+	}
+}
+
 // ConfirmHavePiece notifies peer about receiving the piece
 func (client *Client) ConfirmHavePiece(index int) error {
 	return client.Write(message.CreateHave(index))
@@ -46,12 +87,64 @@ func (client *Client) RequestPiece(index, begin, length int) error {
 	return client.Write(message.CreateRequest(index, begin, length))
 }
 
-// Unchoke asks a peer to unchoke current client
+// Unchoke allows a peer to request pieces from current client
 func (client *Client) Unchoke() error {
-	return client.Write(message.CreateEmpty(message.Unchoke))
+	if err := client.Write(message.CreateEmpty(message.Unchoke)); err != nil {
+		return err
+	}
+
+	client.AmChoking = false
+
+	return nil
+}
+
+// SetChoking chokes or unchokes the peer. The message is sent only if the
+// state changes
+func (client *Client) SetChoking(choking bool) error {
+	if choking == client.AmChoking {
+		return nil
+	}
+
+	if !choking {
+		return client.Unchoke()
+	}
+
+	if err := client.Write(message.CreateEmpty(message.Choke)); err != nil {
+		return err
+	}
+
+	client.AmChoking = true
+
+	return nil
 }
 
 // AnnounceInterest notifies peer about client being ready to download pieces
 func (client *Client) AnnounceInterest() error {
-	return client.Write(message.CreateEmpty(message.Interested))
+	if err := client.Write(message.CreateEmpty(message.Interested)); err != nil {
+		return err
+	}
+
+	client.AmInterested = true
+
+	return nil
+}
+
+// SetInterested tells the peer whether the client wants its pieces. The
+// message is sent only if the state changes
+func (client *Client) SetInterested(interested bool) error {
+	if interested == client.AmInterested {
+		return nil
+	}
+
+	if interested {
+		return client.AnnounceInterest()
+	}
+
+	if err := client.Write(message.CreateEmpty(message.NotInterested)); err != nil {
+		return err
+	}
+
+	client.AmInterested = false
+
+	return nil
 }
@@ -1,52 +1,117 @@
 package client
 
 import (
-	"fmt"
+	"errors"
 	"net"
 	"time"
 
 	"github.com/sauromates/leech/internal/bitfield"
 	"github.com/sauromates/leech/internal/handshake"
 	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/mse"
 	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 )
 
-// Create opens a new TCP connection to a peer
-func Create(peer peers.Peer, infoHash, peerID utils.BTString) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// Create opens a new TCP connection to a peer over IPv4 or IPv6 depending
+// on the peer's address. The connection is encrypted according to given
+// policy. Extension protocol is negotiated if extensions are given and the
+// peer supports it.
+func Create(peer peers.Peer, infoHash, peerID utils.BTString, extensions *Registry, encryption mse.Policy) (*Client, error) {
+	conn, err := mse.Dial(peer.Network(), peer.String(), infoHash, encryption)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := completeHandshake(conn, infoHash, peerID); err != nil {
+	request := handshake.Create(infoHash, peerID)
+	request.Reserved.Enable(handshake.FastExtension)
+	if extensions != nil {
+		request.Reserved.Enable(handshake.ExtensionProtocol)
+	}
+
+	response, err := completeHandshake(conn, request)
+	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bitField, err := getBitField(conn)
-	if err != nil {
+	client := Client{
+		Conn:        conn,
+		AmChoking:   true,
+		PeerChoking: true,
+		Peer:        peer,
+		Reserved:    response.Reserved,
+		Fast:        response.Reserved.Supports(handshake.FastExtension),
+	}
+
+	if extensions != nil && response.Reserved.Supports(handshake.ExtensionProtocol) {
+		client.Extensions = extensions
+		if err := client.sendExtendedHandshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// Extension handshake may arrive before the bitfield
+	if err := client.getBitField(); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
+	return &client, nil
+}
+
+// Accept completes inbound connection after peer's handshake was read:
+// replies with own handshake, sends bitfield of pieces the client has and
+// negotiates extension protocol if extensions are given. Fast extension is
+// enabled if the peer offers it.
+func Accept(conn net.Conn, request *handshake.Handshake, peerID utils.BTString, extensions *Registry, have bitfield.BitField) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	response := handshake.Create(request.InfoHash, peerID)
+	if request.Reserved.Supports(handshake.FastExtension) {
+		response.Reserved.Enable(handshake.FastExtension)
+	}
+
+	if extensions != nil {
+		response.Reserved.Enable(handshake.ExtensionProtocol)
+	}
+
+	if _, err := conn.Write(response.Serialize()); err != nil {
+		return nil, err
+	}
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
 	client := Client{
-		Conn:     conn,
-		IsChoked: true,
-		BitField: bitField,
-		Peer:     peer,
+		Conn:        conn,
+		AmChoking:   true,
+		PeerChoking: true,
+		Peer:        peers.Peer{IP: addr.IP, Port: uint16(addr.Port), ID: request.PeerID},
+		Reserved:    request.Reserved,
+		Fast:        request.Reserved.Supports(handshake.FastExtension),
+	}
+
+	if err := client.Write(message.CreateBitField(have)); err != nil {
+		return nil, err
+	}
+
+	if extensions != nil && request.Reserved.Supports(handshake.ExtensionProtocol) {
+		client.Extensions = extensions
+		if err := client.sendExtendedHandshake(); err != nil {
+			return nil, err
+		}
 	}
 
 	return &client, nil
 }
 
-// completeHandshake creates and sends new handshake message and reads the
-// response into a struct
-func completeHandshake(conn net.Conn, infoHash, peerID utils.BTString) (*handshake.Handshake, error) {
+// completeHandshake sends handshake message and reads the response into
+// a struct
+func completeHandshake(conn net.Conn, request *handshake.Handshake) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disables the deadline after handshake
 
-	request := handshake.Create(infoHash, peerID)
 	if _, err := conn.Write(request.Serialize()); err != nil {
 		return nil, err
 	}
@@ -59,22 +124,44 @@ func completeHandshake(conn net.Conn, infoHash, peerID utils.BTString) (*handsha
 	return response, nil
 }
 
-func getBitField(conn net.Conn) (bitfield.BitField, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// getBitField reads peer's bitfield. Extension protocol messages preceding
+// the bitfield are handled on the way. Peers having no pieces may skip the
+// bitfield, so an empty one is set and the message which arrived instead
+// of it is returned by the next Read. HaveAll and HaveNone replace the
+// bitfield if fast extension is enabled.
+func (client *Client) getBitField() error {
+	client.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer client.Conn.SetDeadline(time.Time{})
+
+	msg, err := message.Read(client.Conn)
+	for err == nil && msg != nil && msg.ID == message.Extended {
+		if err := client.HandleExtended(msg); err != nil {
+			return err
+		}
+
+		msg, err = message.Read(client.Conn)
+	}
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		msg, err = nil, nil
 	}
 
-	if msg == nil {
-		return nil, fmt.Errorf("message is empty")
+	if err != nil {
+		return err
 	}
 
-	if msg.ID != message.BitField {
-		return nil, fmt.Errorf("received %d instead of bitfield message", msg.ID)
+	client.BitField = bitfield.BitField{}
+	switch {
+	case msg == nil:
+	case msg.ID == message.BitField:
+		client.BitField = msg.Payload
+	case client.Fast && msg.ID == message.HaveAll:
+		client.HaveAll = true
+	case client.Fast && msg.ID == message.HaveNone:
+	default:
+		client.pending = msg
 	}
 
-	return msg.Payload, nil
+	return nil
 }
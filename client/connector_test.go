@@ -1,12 +1,17 @@
 package client
 
 import (
+	"net"
 	"testing"
 
 	"github.com/sauromates/leech/internal/bitfield"
 	"github.com/sauromates/leech/internal/handshake"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/mse"
+	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCompleteHandshake(t *testing.T) {
@@ -40,7 +45,7 @@ func TestCompleteHandshake(t *testing.T) {
 		client, server := createClientAndServer(t)
 		server.Write(tc.serverHandshake)
 
-		msg, err := completeHandshake(client, infoHash, peerID)
+		msg, err := completeHandshake(client, handshake.Create(infoHash, peerID))
 
 		if tc.shouldFail {
 			assert.NotNil(t, err)
@@ -51,42 +56,152 @@ func TestCompleteHandshake(t *testing.T) {
 	}
 }
 
+func TestCreateDualStack(t *testing.T) {
+	infoHash := utils.BTString{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Logf("skipping %s: %s", address, err)
+			continue
+		}
+
+		go func() {
+			defer listener.Close()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+
+			handshake.Read(conn, infoHash)
+			conn.Write(handshake.Create(infoHash, utils.BTString{}).Serialize())
+			conn.Write([]byte{0x00, 0x00, 0x00, 0x02, 5, 0xff})
+		}()
+
+		addr := listener.Addr().(*net.TCPAddr)
+		peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+
+		client, err := Create(peer, infoHash, utils.BTString{}, nil, mse.Disable)
+		require.Nil(t, err, address)
+		assert.Equal(t, bitfield.BitField{0xff}, client.BitField)
+
+		client.Conn.Close()
+	}
+}
+
 func TestGetBitField(t *testing.T) {
 	type testCase struct {
 		msg        []byte
+		fast       bool
 		output     bitfield.BitField
+		haveAll    bool
+		pending    *message.Message
 		shouldFail bool
 	}
 
 	tt := map[string]testCase{
 		"valid bitfield": {
-			msg:        []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 5},
-			output:     bitfield.BitField{1, 2, 3, 4, 5},
-			shouldFail: false,
+			msg:    []byte{0x00, 0x00, 0x00, 0x06, 5, 1, 2, 3, 4, 5},
+			output: bitfield.BitField{1, 2, 3, 4, 5},
 		},
-		"invalid message type": {
-			msg:        []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
-			output:     nil,
-			shouldFail: true,
+		"have instead of bitfield": {
+			msg:     []byte{0x00, 0x00, 0x00, 0x05, 4, 0x00, 0x00, 0x00, 0x03},
+			output:  bitfield.BitField{},
+			pending: message.CreateHave(3),
+		},
+		"unknown message": {
+			msg:     []byte{0x00, 0x00, 0x00, 0x06, 99, 1, 2, 3, 4, 5},
+			output:  bitfield.BitField{},
+			pending: &message.Message{ID: 99, Payload: []byte{1, 2, 3, 4, 5}},
 		},
 		"keep-alive message": {
-			msg:        []byte{0x00, 0x00, 0x00, 0x00},
-			output:     nil,
+			msg:    []byte{0x00, 0x00, 0x00, 0x00},
+			output: bitfield.BitField{},
+		},
+		"have all": {
+			msg:     []byte{0x00, 0x00, 0x00, 0x01, 14},
+			fast:    true,
+			output:  bitfield.BitField{},
+			haveAll: true,
+		},
+		"have none": {
+			msg:    []byte{0x00, 0x00, 0x00, 0x01, 15},
+			fast:   true,
+			output: bitfield.BitField{},
+		},
+		"have all without fast extension": {
+			msg:     []byte{0x00, 0x00, 0x00, 0x01, 14},
+			output:  bitfield.BitField{},
+			pending: &message.Message{ID: message.HaveAll, Payload: []byte{}},
+		},
+		"truncated message": {
+			msg:        []byte{0x00, 0x00, 0x00, 0x06, 5, 1},
 			shouldFail: true,
 		},
 	}
 
-	for _, tc := range tt {
-		client, server := createClientAndServer(t)
+	for name, tc := range tt {
+		conn, server := createClientAndServer(t)
 		server.Write(tc.msg)
+		server.Close()
 
-		bf, err := getBitField(client)
+		client := Client{Conn: conn, Fast: tc.fast}
+		err := client.getBitField()
 
 		if tc.shouldFail {
-			assert.NotNil(t, err)
+			assert.NotNil(t, err, name)
 		} else {
-			assert.Nil(t, err)
-			assert.Equal(t, bf, tc.output)
+			require.Nil(t, err, name)
+			assert.Equal(t, tc.output, client.BitField, name)
+			assert.Equal(t, tc.haveAll, client.HaveAll, name)
+			assert.Equal(t, tc.pending, client.pending, name)
 		}
 	}
 }
+
+func TestFitBitField(t *testing.T) {
+	client := Client{BitField: bitfield.BitField{}}
+	client.FitBitField(10)
+	assert.Equal(t, bitfield.BitField{0, 0}, client.BitField)
+
+	client = Client{BitField: bitfield.BitField{}, HaveAll: true}
+	client.FitBitField(10)
+	assert.Equal(t, bitfield.BitField{0xff, 0xc0}, client.BitField)
+}
+
+func TestAccept(t *testing.T) {
+	infoHash := utils.BTString{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	remoteID := utils.BTString{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	remote, conn := createClientAndServer(t)
+	defer remote.Close()
+
+	request := handshake.Create(infoHash, remoteID)
+	request.Reserved.Enable(handshake.ExtensionProtocol)
+	request.Reserved.Enable(handshake.FastExtension)
+
+	registry := NewRegistry("leech", 6881, &fakeExtension{name: "ut_pex"})
+	client, err := Accept(conn, request, utils.BTString{}, registry, bitfield.BitField{0xf0})
+	require.Nil(t, err)
+	assert.Equal(t, remoteID, client.Peer.ID)
+	assert.Equal(t, registry, client.Extensions)
+	assert.True(t, client.Fast)
+
+	response, err := handshake.Read(remote, infoHash)
+	require.Nil(t, err)
+	assert.True(t, response.Reserved.Supports(handshake.ExtensionProtocol))
+	assert.True(t, response.Reserved.Supports(handshake.FastExtension))
+
+	msg, err := message.Read(remote)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreateBitField(bitfield.BitField{0xf0}), msg)
+
+	msg, err = message.Read(remote)
+	require.Nil(t, err)
+	hs, err := msg.ParseExtendedHandshake()
+	require.Nil(t, err)
+	assert.Equal(t, map[string]int{"ut_pex": 1}, hs.M)
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/sauromates/leech/internal/message"
+)
+
+// MaxPeerRequests is the number of outstanding requests we accept from
+// a peer, advertised as `reqq` in extension handshake
+const MaxPeerRequests int = 250
+
+// Extension is a protocol extension built on top of extension protocol
+// (BEP 10), e.g. ut_metadata or ut_pex
+type Extension interface {
+	// Name is the key of the extension in `m` dictionary of the handshake
+	Name() string
+	// Connected is called once peer's extension handshake shows that
+	// it supports the extension
+	Connected(client *Client) error
+	// HandleMessage processes a message of the extension sent by a peer
+	HandleMessage(client *Client, payload []byte) error
+}
+
+// PeriodicExtension is an extension which sends messages on its own
+// schedule, e.g. ut_pex
+type PeriodicExtension interface {
+	Extension
+	// Tick is called regularly while the connection is active
+	Tick(client *Client) error
+}
+
+// Registry holds extensions enabled for connections. Local extended message
+// ID of an extension is its position in the registry starting with 1.
+type Registry struct {
+	// Version is the client name and version advertised as `v`
+	Version string
+	// Port is the local TCP listen port advertised as `p`
+	Port       uint16
+	extensions []Extension
+}
+
+// NewRegistry creates a registry with given extensions
+func NewRegistry(version string, port uint16, extensions ...Extension) *Registry {
+	return &Registry{Version: version, Port: port, extensions: extensions}
+}
+
+// Handshake builds extension handshake advertising registered extensions
+func (r *Registry) Handshake() message.ExtendedHandshake {
+	hs := message.ExtendedHandshake{
+		M:    make(map[string]int, len(r.extensions)),
+		V:    r.Version,
+		P:    int(r.Port),
+		Reqq: MaxPeerRequests,
+	}
+
+	for i, ext := range r.extensions {
+		hs.M[ext.Name()] = i + 1
+	}
+
+	return hs
+}
+
+// byID returns extension with given local extended message ID
+func (r *Registry) byID(id uint8) Extension {
+	if id == 0 || int(id) > len(r.extensions) {
+		return nil
+	}
+
+	return r.extensions[id-1]
+}
+
+// SupportsExtension tells whether peer advertised the extension in its
+// extension handshake
+func (client *Client) SupportsExtension(name string) bool {
+	return client.PeerExtensions != nil && client.PeerExtensions.M[name] > 0
+}
+
+// WriteExtended sends a message of the extension with given name using
+// extended message ID assigned by the peer
+func (client *Client) WriteExtended(name string, payload []byte) error {
+	if !client.SupportsExtension(name) {
+		return fmt.Errorf("peer doesn't support %s", name)
+	}
+
+	id := client.PeerExtensions.M[name]
+
+	return client.Write(message.CreateExtended(uint8(id), payload))
+}
+
+// HandleExtended processes extension protocol message: stores peer's
+// extension handshake or passes the payload to the registered extension
+func (client *Client) HandleExtended(msg *message.Message) error {
+	if client.Extensions == nil {
+		return nil
+	}
+
+	id, payload, err := msg.ParseExtended()
+	if err != nil {
+		return err
+	}
+
+	if id != message.ExtendedHandshakeID {
+		ext := client.Extensions.byID(id)
+		if ext == nil {
+			log.Printf("[INFO] Ignoring unknown extended message %d from %s", id, client.Peer.String())
+			return nil
+		}
+
+		return ext.HandleMessage(client, payload)
+	}
+
+	hs, err := msg.ParseExtendedHandshake()
+	if err != nil {
+		return err
+	}
+
+	// Peers may send handshake again to update the list of extensions,
+	// so only newly enabled ones are notified
+	previous := client.PeerExtensions
+	client.PeerExtensions = hs
+	for _, ext := range client.Extensions.extensions {
+		if !client.SupportsExtension(ext.Name()) || (previous != nil && previous.M[ext.Name()] > 0) {
+			continue
+		}
+
+		if err := ext.Connected(client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TickExtensions lets periodic extensions supported by the peer send
+// their messages
+func (client *Client) TickExtensions() error {
+	if client.Extensions == nil {
+		return nil
+	}
+
+	for _, ext := range client.Extensions.extensions {
+		periodic, ok := ext.(PeriodicExtension)
+		if !ok || !client.SupportsExtension(ext.Name()) {
+			continue
+		}
+
+		if err := periodic.Tick(client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendExtendedHandshake advertises registered extensions to the peer
+func (client *Client) sendExtendedHandshake() error {
+	hs := client.Extensions.Handshake()
+	if ip := client.Peer.IP.To4(); ip != nil {
+		hs.YourIP = string(ip)
+	} else {
+		hs.YourIP = string(client.Peer.IP.To16())
+	}
+
+	msg, err := message.CreateExtendedHandshake(hs)
+	if err != nil {
+		return err
+	}
+
+	return client.Write(msg)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/sauromates/leech/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExtension records calls made by the client
+type fakeExtension struct {
+	name      string
+	connected int
+	payloads  [][]byte
+}
+
+func (ext *fakeExtension) Name() string {
+	return ext.name
+}
+
+func (ext *fakeExtension) Connected(client *Client) error {
+	ext.connected++
+	return nil
+}
+
+func (ext *fakeExtension) HandleMessage(client *Client, payload []byte) error {
+	ext.payloads = append(ext.payloads, payload)
+	return nil
+}
+
+// fakePeriodicExtension counts ticks
+type fakePeriodicExtension struct {
+	fakeExtension
+	ticks int
+}
+
+func (ext *fakePeriodicExtension) Tick(client *Client) error {
+	ext.ticks++
+	return nil
+}
+
+func TestRegistryHandshake(t *testing.T) {
+	registry := NewRegistry("leech", 6881, &fakeExtension{name: "ut_metadata"}, &fakeExtension{name: "ut_pex"})
+	expected := message.ExtendedHandshake{
+		M:    map[string]int{"ut_metadata": 1, "ut_pex": 2},
+		V:    "leech",
+		P:    6881,
+		Reqq: MaxPeerRequests,
+	}
+
+	assert.Equal(t, expected, registry.Handshake())
+}
+
+func TestHandleExtended(t *testing.T) {
+	metadata := &fakeExtension{name: "ut_metadata"}
+	pex := &fakeExtension{name: "ut_pex"}
+	client := Client{Extensions: NewRegistry("leech", 6881, metadata, pex)}
+
+	handshake, err := message.CreateExtendedHandshake(message.ExtendedHandshake{M: map[string]int{"ut_pex": 7}})
+	require.Nil(t, err)
+
+	require.Nil(t, client.HandleExtended(handshake))
+	assert.True(t, client.SupportsExtension("ut_pex"))
+	assert.False(t, client.SupportsExtension("ut_metadata"))
+	assert.Equal(t, 0, metadata.connected)
+	assert.Equal(t, 1, pex.connected)
+
+	// Repeated handshake doesn't notify already connected extensions
+	require.Nil(t, client.HandleExtended(handshake))
+	assert.Equal(t, 1, pex.connected)
+
+	// Messages are dispatched by local IDs
+	require.Nil(t, client.HandleExtended(message.CreateExtended(2, []byte("de"))))
+	require.Nil(t, client.HandleExtended(message.CreateExtended(9, []byte("de"))))
+	assert.Empty(t, metadata.payloads)
+	assert.Equal(t, [][]byte{[]byte("de")}, pex.payloads)
+}
+
+func TestWriteExtended(t *testing.T) {
+	conn, server := createClientAndServer(t)
+	client := Client{
+		Conn:           conn,
+		PeerExtensions: &message.ExtendedHandshake{M: map[string]int{"ut_pex": 7}},
+	}
+
+	assert.NotNil(t, client.WriteExtended("ut_metadata", []byte("de")))
+	require.Nil(t, client.WriteExtended("ut_pex", []byte("de")))
+
+	msg, err := message.Read(server)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreateExtended(7, []byte("de")), msg)
+}
+
+func TestTickExtensions(t *testing.T) {
+	supported := &fakePeriodicExtension{fakeExtension: fakeExtension{name: "ut_pex"}}
+	unsupported := &fakePeriodicExtension{fakeExtension: fakeExtension{name: "lt_donthave"}}
+	client := Client{
+		Extensions:     NewRegistry("leech", 6881, supported, &fakeExtension{name: "ut_metadata"}, unsupported),
+		PeerExtensions: &message.ExtendedHandshake{M: map[string]int{"ut_pex": 1, "ut_metadata": 2}},
+	}
+
+	require.Nil(t, client.TickExtensions())
+	assert.Equal(t, 1, supported.ticks)
+	assert.Equal(t, 0, unsupported.ticks)
+}
@@ -3,7 +3,6 @@ module github.com/sauromates/leech
 go 1.23.0
 
 require (
-	github.com/jackpal/bencode-go v1.0.2
 	github.com/schollz/progressbar/v3 v3.17.1
 	github.com/stretchr/testify v1.9.0
 )
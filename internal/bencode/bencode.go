@@ -0,0 +1,98 @@
+// Package bencode implements encoding and decoding of bencoded data used by
+// torrent files, trackers and peer messages.
+//
+// Values map to Go types like in encoding/json: integers to integer kinds
+// and bools, strings to strings, byte slices and byte arrays, lists to
+// slices and arrays and dictionaries to maps with string keys and structs.
+// Struct fields are matched by `bencode:"key,omitempty"` tags, fields
+// tagged with "-" are ignored. Generic values decode into int64, string,
+// []interface{} and map[string]interface{}.
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// RawMessage is an exact bencoded value. It delays decoding of a value or
+// keeps its bytes intact, e.g. to hash info dictionary of a torrent file.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage{})
+
+// SyntaxError describes malformed data and the offset where it was found
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+// TypeError describes a value which can't be stored in a Go value of given
+// type. Offset points at the beginning of the value.
+type TypeError struct {
+	Offset int64
+	Value  string
+	Type   reflect.Type
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot decode %s into %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// field is a struct field mapped to a dictionary key
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+// fieldCache holds fields of already seen struct types
+var fieldCache sync.Map
+
+// structFields returns fields of a struct type sorted by field index
+func structFields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	fields := make([]field, 0, t.NumField())
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		key, opts := sf.Name, ""
+		if tag, ok := sf.Tag.Lookup("bencode"); ok {
+			key, opts = splitTag(tag)
+			if key == "-" {
+				continue
+			}
+
+			if key == "" {
+				key = sf.Name
+			}
+		}
+
+		fields = append(fields, field{key: key, index: i, omitEmpty: opts == "omitempty"})
+	}
+
+	fieldCache.Store(t, fields)
+
+	return fields
+}
+
+// splitTag splits struct tag into the key and options
+func splitTag(tag string) (string, string) {
+	for i := range len(tag) {
+		if tag[i] == ',' {
+			return tag[:i], tag[i+1:]
+		}
+	}
+
+	return tag, ""
+}
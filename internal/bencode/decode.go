@@ -0,0 +1,514 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// maxDepth limits nesting of lists and dictionaries
+	maxDepth int = 256
+	// chunkSize is the largest buffer allocated upfront for a string,
+	// so that bogus lengths fail at the end of data instead of allocating
+	chunkSize int = 64 * 1024
+)
+
+// Unmarshal decodes a single bencoded value into v, which must be a
+// non-nil pointer. It's lenient to quirks of real-world encoders: unsorted
+// and duplicate dictionary keys, integers and string lengths with leading
+// zeros and data following the value are accepted.
+func Unmarshal(data []byte, v interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// UnmarshalStrict decodes data which must be a single value in canonical
+// form
+func UnmarshalStrict(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict()
+
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+
+	if d.Offset() != int64(len(data)) {
+		return &SyntaxError{d.Offset(), "unexpected data after value"}
+	}
+
+	return nil
+}
+
+// byteReader is a reader which doesn't need additional buffering
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decoder reads consecutive bencoded values from a stream
+type Decoder struct {
+	r      byteReader
+	offset int64
+	strict bool
+	depth  int
+	// raw collects bytes of a value decoded into [RawMessage]
+	raw       []byte
+	capturing bool
+}
+
+// NewDecoder creates a decoder reading from r. Readers which don't
+// implement [io.ByteReader] are buffered, so the decoder may read past the
+// last decoded value.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &Decoder{r: br}
+}
+
+// Strict makes the decoder reject data which isn't in canonical form
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// Offset returns the number of bytes consumed by the decoder
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Decode reads the next value into v, which must be a non-nil pointer.
+// [io.EOF] is returned if the stream has no more values.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("bencode: decode target must be a non-nil pointer")
+	}
+
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	d.offset++
+
+	return d.value(c, rv.Elem())
+}
+
+// value decodes a value starting with c into v. Invalid v skips the value.
+func (d *Decoder) value(c byte, v reflect.Value) error {
+	start := d.offset - 1
+	if v.IsValid() && v.Type() == rawMessageType {
+		// The first byte is already captured by an enclosing raw value
+		outer, capturing := d.raw, d.capturing
+		d.raw, d.capturing = []byte{c}, true
+		err := d.value(c, reflect.Value{})
+		raw := d.raw
+		d.raw, d.capturing = outer, capturing
+		if capturing {
+			d.raw = append(d.raw, raw[1:]...)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		v.SetBytes(raw)
+
+		return nil
+	}
+
+	for v.IsValid() && v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		v = v.Elem()
+	}
+
+	switch {
+	case c == 'i':
+		n, err := d.integer('e', true)
+		if err != nil {
+			return err
+		}
+
+		return setInt(v, n, start)
+	case c >= '0' && c <= '9':
+		s, err := d.str(c)
+		if err != nil {
+			return err
+		}
+
+		return setString(v, s, start)
+	case c == 'l':
+		return d.list(v, start)
+	case c == 'd':
+		return d.dict(v, start)
+	default:
+		return &SyntaxError{start, "invalid value starting with " + strconv.QuoteRune(rune(c))}
+	}
+}
+
+// list decodes list items into a slice, an array or an interface
+func (d *Decoder) list(v reflect.Value, start int64) error {
+	if err := d.enter(start); err != nil {
+		return err
+	}
+
+	defer d.leave()
+
+	var items []interface{}
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	case v.Kind() == reflect.Array:
+	case isInterface(v):
+		items = make([]interface{}, 0)
+	default:
+		return &TypeError{start, "list", v.Type()}
+	}
+
+	for i := 0; ; i++ {
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		if c == 'e' {
+			break
+		}
+
+		switch {
+		case !v.IsValid():
+			err = d.value(c, v)
+		case v.Kind() == reflect.Slice:
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(c, item); err == nil {
+				v.Set(reflect.Append(v, item))
+			}
+		case v.Kind() == reflect.Array:
+			if i >= v.Len() {
+				return &TypeError{start, "list longer than " + strconv.Itoa(v.Len()), v.Type()}
+			}
+
+			err = d.value(c, v.Index(i))
+		default:
+			var item interface{}
+			err = d.value(c, reflect.ValueOf(&item).Elem())
+			items = append(items, item)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if items != nil {
+		v.Set(reflect.ValueOf(items))
+	}
+
+	return nil
+}
+
+// dict decodes dictionary entries into a map, a struct or an interface.
+// Keys missing from a struct are skipped.
+func (d *Decoder) dict(v reflect.Value, start int64) error {
+	if err := d.enter(start); err != nil {
+		return err
+	}
+
+	defer d.leave()
+
+	var fields map[string]int
+	var entries map[string]interface{}
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case v.Kind() == reflect.Struct:
+		fields = make(map[string]int)
+		for _, f := range structFields(v.Type()) {
+			fields[f.key] = f.index
+		}
+	case isInterface(v):
+		entries = make(map[string]interface{})
+	default:
+		return &TypeError{start, "dictionary", v.Type()}
+	}
+
+	var previous []byte
+	for i := 0; ; i++ {
+		c, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		if c == 'e' {
+			break
+		}
+
+		keyStart := d.offset - 1
+		if c < '0' || c > '9' {
+			return &SyntaxError{keyStart, "dictionary key is not a string"}
+		}
+
+		key, err := d.str(c)
+		if err != nil {
+			return err
+		}
+
+		if d.strict && i > 0 && bytes.Compare(previous, key) >= 0 {
+			return &SyntaxError{keyStart, "unsorted or duplicate key " + strconv.Quote(string(key))}
+		}
+
+		previous = key
+
+		c, err = d.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !v.IsValid():
+			err = d.value(c, v)
+		case v.Kind() == reflect.Map:
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(c, item); err == nil {
+				v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), item)
+			}
+		case v.Kind() == reflect.Struct:
+			var target reflect.Value
+			if index, ok := fields[string(key)]; ok {
+				target = v.Field(index)
+			}
+
+			err = d.value(c, target)
+		default:
+			var item interface{}
+			err = d.value(c, reflect.ValueOf(&item).Elem())
+			entries[string(key)] = item
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if entries != nil {
+		v.Set(reflect.ValueOf(entries))
+	}
+
+	return nil
+}
+
+// integer reads digits until the terminator. Leading zeros and negative
+// zero are rejected in strict mode.
+func (d *Decoder) integer(term byte, signed bool) (int64, error) {
+	return d.digits(0, term, d.offset, signed)
+}
+
+// digits reads an integer which may start with already consumed byte
+func (d *Decoder) digits(first, term byte, start int64, signed bool) (int64, error) {
+	var digits []byte
+	if first != 0 {
+		digits = append(digits, first)
+	}
+
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if c == term {
+			break
+		}
+
+		if len(digits) > 20 {
+			return 0, &SyntaxError{start, "integer is too long"}
+		}
+
+		digits = append(digits, c)
+	}
+
+	return d.parseInt(digits, start, signed)
+}
+
+// parseInt validates and parses integer digits
+func (d *Decoder) parseInt(digits []byte, start int64, signed bool) (int64, error) {
+	unsigned := digits
+	if signed && len(digits) > 0 && digits[0] == '-' {
+		unsigned = digits[1:]
+	}
+
+	if len(unsigned) == 0 {
+		return 0, &SyntaxError{start, "empty integer"}
+	}
+
+	for _, c := range unsigned {
+		if c < '0' || c > '9' {
+			return 0, &SyntaxError{start, "invalid integer " + strconv.Quote(string(digits))}
+		}
+	}
+
+	if d.strict && unsigned[0] == '0' && (len(unsigned) > 1 || len(unsigned) < len(digits)) {
+		return 0, &SyntaxError{start, "non-canonical integer " + strconv.Quote(string(digits))}
+	}
+
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, &SyntaxError{start, "integer " + strconv.Quote(string(digits)) + " is out of range"}
+	}
+
+	return n, nil
+}
+
+// str reads a string which length starts with given digit
+func (d *Decoder) str(first byte) ([]byte, error) {
+	start := d.offset - 1
+	length, err := d.digits(first, ':', start, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.read(length)
+}
+
+// read reads exactly n bytes of a string
+func (d *Decoder) read(n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(min(n, int64(chunkSize))))
+
+	copied, err := io.CopyN(&buf, d.r, n)
+	d.offset += copied
+	if d.capturing {
+		d.raw = append(d.raw, buf.Bytes()...)
+	}
+
+	if err != nil {
+		return nil, d.unexpected(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readByte reads a byte within a value
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.unexpected(err)
+	}
+
+	d.offset++
+	if d.capturing {
+		d.raw = append(d.raw, c)
+	}
+
+	return c, nil
+}
+
+// unexpected converts end of data within a value into syntax error
+func (d *Decoder) unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return &SyntaxError{d.offset, "unexpected end of data"}
+	}
+
+	return err
+}
+
+// enter descends into a list or a dictionary
+func (d *Decoder) enter(start int64) error {
+	d.depth++
+	if d.depth > maxDepth {
+		return &SyntaxError{start, "nesting is too deep"}
+	}
+
+	return nil
+}
+
+// leave returns from a list or a dictionary
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// setInt stores an integer in v
+func setInt(v reflect.Value, n int64, start int64) error {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			return &TypeError{start, "integer " + strconv.FormatInt(n, 10), v.Type()}
+		}
+
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return &TypeError{start, "integer " + strconv.FormatInt(n, 10), v.Type()}
+		}
+
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		if n != 0 && n != 1 {
+			return &TypeError{start, "integer " + strconv.FormatInt(n, 10), v.Type()}
+		}
+
+		v.SetBool(n == 1)
+	case reflect.Float32, reflect.Float64:
+		if math.Abs(float64(n)) > 1<<53 {
+			return &TypeError{start, "integer " + strconv.FormatInt(n, 10), v.Type()}
+		}
+
+		v.SetFloat(float64(n))
+	default:
+		if !isInterface(v) {
+			return &TypeError{start, "integer", v.Type()}
+		}
+
+		v.Set(reflect.ValueOf(n))
+	}
+
+	return nil
+}
+
+// setString stores a string in v
+func setString(v reflect.Value, s []byte, start int64) error {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte{}, s...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if v.Len() != len(s) {
+			return &TypeError{start, "string of length " + strconv.Itoa(len(s)), v.Type()}
+		}
+
+		reflect.Copy(v, reflect.ValueOf(s))
+	case isInterface(v):
+		v.Set(reflect.ValueOf(string(s)))
+	default:
+		return &TypeError{start, "string", v.Type()}
+	}
+
+	return nil
+}
+
+// isInterface tells whether any value may be stored in v
+func isInterface(v reflect.Value) bool {
+	return v.Kind() == reflect.Interface && v.NumMethod() == 0
+}
@@ -0,0 +1,265 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testInfo struct {
+	Name   string `bencode:"name"`
+	Length int    `bencode:"length"`
+}
+
+type testTorrent struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+	Private  bool       `bencode:"private"`
+	Tiers    [][]string `bencode:"announce-list"`
+	Peer     *testInfo  `bencode:"peer"`
+	Skipped  string     `bencode:"-"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	type testCase struct {
+		input      string
+		output     testTorrent
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"raw info": {
+			input:  "d8:announce3:url4:infod4:name1:ae7:privatei1ee",
+			output: testTorrent{Announce: "url", Info: RawMessage("d4:name1:ae"), Private: true},
+		},
+		"nested lists and pointer": {
+			input:  "d13:announce-listll1:ael1:b1:cee4:peerd6:lengthi5e4:name1:xee",
+			output: testTorrent{Tiers: [][]string{{"a"}, {"b", "c"}}, Peer: &testInfo{Name: "x", Length: 5}},
+		},
+		"unknown keys are skipped": {
+			input:  "d1:-d1:xli1eee8:announce3:urle",
+			output: testTorrent{Announce: "url"},
+		},
+		"keys are case sensitive": {
+			input:  "d8:Announce3:urle",
+			output: testTorrent{},
+		},
+		"unsorted and duplicate keys": {
+			input:  "d8:announce1:a8:announce1:b7:privatei0e4:infoi1ee",
+			output: testTorrent{Announce: "b", Info: RawMessage("i1e")},
+		},
+		"non-canonical integers": {
+			input:  "d7:privatei01e8:announce03:urle",
+			output: testTorrent{Announce: "url", Private: true},
+		},
+		"trailing data":          {input: "d8:announce3:urleGARBAGE", output: testTorrent{Announce: "url"}},
+		"list instead of string": {input: "d8:announcel3:urlee", shouldFail: true},
+		"string instead of list": {input: "d13:announce-list3:urle", shouldFail: true},
+		"integer out of bool":    {input: "d7:privatei2ee", shouldFail: true},
+		"not a dictionary":       {input: "i1e", shouldFail: true},
+		"truncated string":       {input: "d8:announce30:url", shouldFail: true},
+		"unterminated dict":      {input: "d8:announce3:url", shouldFail: true},
+		"non-string key":         {input: "di1e3:urle", shouldFail: true},
+		"invalid value":          {input: "d8:announcex3:urle", shouldFail: true},
+		"empty integer":          {input: "d7:privateiee", shouldFail: true},
+		"invalid integer":        {input: "d7:privatei1x0ee", shouldFail: true},
+		"negative length":        {input: "d8:announce-1:e", shouldFail: true},
+		"empty input":            {input: "", shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		v := testTorrent{}
+		err := Unmarshal([]byte(tc.input), &v)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, tc.output, v, name)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	type testCase struct {
+		input      string
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"canonical":           {input: "d8:announce3:url4:infoi-1e7:privatei0ee"},
+		"unsorted keys":       {input: "d7:privatei1e8:announce3:urle", shouldFail: true},
+		"duplicate keys":      {input: "d8:announce1:a8:announce1:be", shouldFail: true},
+		"leading zero":        {input: "d7:privatei01ee", shouldFail: true},
+		"negative zero":       {input: "d4:infoi-0ee", shouldFail: true},
+		"zero padded length":  {input: "d8:announce03:urle", shouldFail: true},
+		"trailing data":       {input: "d8:announce3:urlee", shouldFail: true},
+		"unsorted raw values": {input: "d4:infod1:bi1e1:ai2eee", shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		err := UnmarshalStrict([]byte(tc.input), &testTorrent{})
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestUnmarshalGeneric(t *testing.T) {
+	var v interface{}
+	require.Nil(t, Unmarshal([]byte("d1:ai-3e1:bl1:xdee1:c0:e"), &v))
+
+	expected := map[string]interface{}{
+		"a": int64(-3),
+		"b": []interface{}{"x", map[string]interface{}{}},
+		"c": "",
+	}
+
+	assert.Equal(t, expected, v)
+}
+
+func TestUnmarshalTypes(t *testing.T) {
+	var values struct {
+		Small  int8              `bencode:"small"`
+		Uint   uint16            `bencode:"uint"`
+		Hash   [4]byte           `bencode:"hash"`
+		Bytes  []byte            `bencode:"bytes"`
+		Fixed  [2]string         `bencode:"fixed"`
+		Map    map[string]int    `bencode:"map"`
+		Nested map[string][]byte `bencode:"nested"`
+	}
+
+	input := "d5:bytes2:ab5:fixedl1:x1:ye4:hash4:abcd3:mapd1:ai1e1:bi2ee6:nestedd1:k1:ve5:smalli-128e4:uinti65535ee"
+	require.Nil(t, Unmarshal([]byte(input), &values))
+
+	assert.Equal(t, int8(-128), values.Small)
+	assert.Equal(t, uint16(65535), values.Uint)
+	assert.Equal(t, [4]byte{'a', 'b', 'c', 'd'}, values.Hash)
+	assert.Equal(t, []byte("ab"), values.Bytes)
+	assert.Equal(t, [2]string{"x", "y"}, values.Fixed)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, values.Map)
+	assert.Equal(t, map[string][]byte{"k": []byte("v")}, values.Nested)
+
+	type testCase struct {
+		input string
+	}
+
+	tt := map[string]testCase{
+		"int8 overflow":       {input: "d5:smalli128ee"},
+		"negative uint":       {input: "d4:uinti-1ee"},
+		"hash of wrong size":  {input: "d4:hash3:abce"},
+		"array too long":      {input: "d5:fixedl1:x1:y1:zee"},
+		"integer into string": {input: "d3:mapd1:a1:xee"},
+	}
+
+	for name, tc := range tt {
+		err := Unmarshal([]byte(tc.input), &values)
+		var typeErr *TypeError
+		assert.True(t, errors.As(err, &typeErr), name)
+	}
+}
+
+func TestErrorOffsets(t *testing.T) {
+	type testCase struct {
+		input  string
+		offset int64
+		syntax bool
+	}
+
+	tt := map[string]testCase{
+		"type mismatch":    {input: "d8:announcei1ee", offset: 11},
+		"nested mismatch":  {input: "d4:peerd4:namelee", offset: 14},
+		"invalid value":    {input: "d8:announce3:url4:infoxe", offset: 22, syntax: true},
+		"truncated string": {input: "d8:announce9:url", offset: 16, syntax: true},
+	}
+
+	for name, tc := range tt {
+		err := Unmarshal([]byte(tc.input), &testTorrent{})
+		var syntaxErr *SyntaxError
+		var typeErr *TypeError
+		if tc.syntax {
+			require.True(t, errors.As(err, &syntaxErr), name)
+			assert.Equal(t, tc.offset, syntaxErr.Offset, name)
+		} else {
+			require.True(t, errors.As(err, &typeErr), name)
+			assert.Equal(t, tc.offset, typeErr.Offset, name)
+		}
+
+		assert.Contains(t, err.Error(), "offset", name)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	// Bare reader without ReadByte is buffered by the decoder
+	stream := io.MultiReader(bytes.NewBufferString("i1e4:spam"), bytes.NewBufferString("d1:ai2ee"))
+	d := NewDecoder(stream)
+
+	var n int
+	require.Nil(t, d.Decode(&n))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(3), d.Offset())
+
+	var s string
+	require.Nil(t, d.Decode(&s))
+	assert.Equal(t, "spam", s)
+	assert.Equal(t, int64(9), d.Offset())
+
+	var raw RawMessage
+	require.Nil(t, d.Decode(&raw))
+	assert.Equal(t, RawMessage("d1:ai2ee"), raw)
+
+	assert.Equal(t, io.EOF, d.Decode(&raw))
+}
+
+func TestDecoderOffset(t *testing.T) {
+	// Metadata messages carry raw piece data right after the dictionary
+	data := []byte("d8:msg_typei1e5:piecei0eeRAWDATA")
+	d := NewDecoder(bytes.NewReader(data))
+
+	var header map[string]int
+	require.Nil(t, d.Decode(&header))
+
+	assert.Equal(t, map[string]int{"msg_type": 1, "piece": 0}, header)
+	assert.Equal(t, "RAWDATA", string(data[d.Offset():]))
+}
+
+func TestNestedRawMessage(t *testing.T) {
+	var outer struct {
+		Info RawMessage `bencode:"info"`
+	}
+
+	var inner struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+
+	input := "d4:infod4:infol1:ae4:name1:xee"
+	require.Nil(t, Unmarshal([]byte(input), &outer))
+	assert.Equal(t, RawMessage("d4:infol1:ae4:name1:xe"), outer.Info)
+
+	require.Nil(t, Unmarshal(outer.Info, &inner))
+	assert.Equal(t, RawMessage("l1:ae"), inner.Info)
+	assert.Equal(t, "x", inner.Name)
+}
+
+func TestDepthLimit(t *testing.T) {
+	input := bytes.Repeat([]byte("l"), maxDepth+1)
+	input = append(input, bytes.Repeat([]byte("e"), maxDepth+1)...)
+
+	var v interface{}
+	assert.NotNil(t, Unmarshal(input, &v))
+	assert.Nil(t, Unmarshal(input[1:len(input)-1], &v))
+}
+
+func TestHugeStringLength(t *testing.T) {
+	var s string
+	err := Unmarshal([]byte("999999999999:spam"), &s)
+
+	var syntaxErr *SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr))
+}
@@ -0,0 +1,191 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Marshal returns canonical bencoding of v. Dictionary keys are sorted,
+// struct fields tagged with omitempty are skipped if they're empty and nil
+// pointers and interfaces are skipped in structs and maps.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder creates an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w}
+}
+
+// Encode writes bencoding of v
+func (e *Encoder) Encode(v interface{}) error {
+	w := bufio.NewWriter(e.w)
+	if err := encode(w, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// encode writes a single value
+func encode(w *bufio.Writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot encode nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: cannot encode empty raw message")
+		}
+
+		_, err := w.Write(v.Bytes())
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot encode nil %s", v.Type())
+		}
+
+		return encode(w, v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(w, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatUint(v.Uint(), 10))
+		w.WriteByte('e')
+	case reflect.Bool:
+		if v.Bool() {
+			writeInt(w, 1)
+		} else {
+			writeInt(w, 0)
+		}
+	case reflect.String:
+		writeString(w, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Array {
+				bytes := make([]byte, v.Len())
+				reflect.Copy(reflect.ValueOf(bytes), v)
+				v = reflect.ValueOf(bytes)
+			}
+
+			writeString(w, string(v.Bytes()))
+			return nil
+		}
+
+		w.WriteByte('l')
+		for i := range v.Len() {
+			if err := encode(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+		w.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: cannot encode map with %s keys", v.Type().Key())
+		}
+
+		return encodeMap(w, v)
+	case reflect.Struct:
+		return encodeStruct(w, v)
+	default:
+		return fmt.Errorf("bencode: cannot encode %s", v.Type())
+	}
+
+	return nil
+}
+
+// encodeMap writes map entries sorted by key
+func encodeMap(w *bufio.Writer, v reflect.Value) error {
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		if !isNil(v.MapIndex(key)) {
+			keys = append(keys, key.String())
+		}
+	}
+
+	slices.Sort(keys)
+
+	w.WriteByte('d')
+	for _, key := range keys {
+		writeString(w, key)
+		if err := encode(w, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))); err != nil {
+			return err
+		}
+	}
+
+	w.WriteByte('e')
+
+	return nil
+}
+
+// encodeStruct writes struct fields sorted by key
+func encodeStruct(w *bufio.Writer, v reflect.Value) error {
+	fields := slices.Clone(structFields(v.Type()))
+	slices.SortFunc(fields, func(a, b field) int {
+		return bytes.Compare([]byte(a.key), []byte(b.key))
+	})
+
+	w.WriteByte('d')
+	for i, f := range fields {
+		if i > 0 && fields[i-1].key == f.key {
+			return fmt.Errorf("bencode: duplicate key %q in %s", f.key, v.Type())
+		}
+
+		value := v.Field(f.index)
+		if isNil(value) || f.omitEmpty && value.IsZero() {
+			continue
+		}
+
+		if f.omitEmpty && (value.Kind() == reflect.Slice || value.Kind() == reflect.Map) && value.Len() == 0 {
+			continue
+		}
+
+		writeString(w, f.key)
+		if err := encode(w, value); err != nil {
+			return err
+		}
+	}
+
+	w.WriteByte('e')
+
+	return nil
+}
+
+// writeInt writes an integer
+func writeInt(w *bufio.Writer, n int64) {
+	w.WriteByte('i')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteByte('e')
+}
+
+// writeString writes a length prefixed string
+func writeString(w *bufio.Writer, s string) {
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteByte(':')
+	w.WriteString(s)
+}
+
+// isNil tells whether v is a nil pointer or interface, which have no
+// bencoded representation
+func isNil(v reflect.Value) bool {
+	return (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil()
+}
@@ -0,0 +1,80 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	type file struct {
+		Length int      `bencode:"length"`
+		Path   []string `bencode:"path"`
+	}
+
+	type info struct {
+		Name     string  `bencode:"name"`
+		Private  int     `bencode:"private,omitempty"`
+		Files    []file  `bencode:"files,omitempty"`
+		Pieces   [2]byte `bencode:"pieces"`
+		Parent   *info   `bencode:"parent"`
+		Skipped  string  `bencode:"-"`
+		hidden   string
+		Untagged bool
+	}
+
+	type testCase struct {
+		input      interface{}
+		output     string
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"integer":          {input: -42, output: "i-42e"},
+		"unsigned":         {input: uint64(1 << 63), output: "i9223372036854775808e"},
+		"string":           {input: "spam", output: "4:spam"},
+		"bytes":            {input: []byte{0, 1}, output: "2:\x00\x01"},
+		"list":             {input: []interface{}{1, "a", []int{}}, output: "li1e1:alee"},
+		"sorted map keys":  {input: map[string]int{"b": 2, "a": 1, "B": 3}, output: "d1:Bi3e1:ai1e1:bi2ee"},
+		"nil map values":   {input: map[string]interface{}{"a": nil, "b": 1}, output: "d1:bi1ee"},
+		"raw message":      {input: map[string]RawMessage{"info": RawMessage("d1:ai1ee")}, output: "d4:infod1:ai1eee"},
+		"pointer":          {input: &file{Length: 1, Path: []string{"a"}}, output: "d6:lengthi1e4:pathl1:aee"},
+		"empty raw":        {input: RawMessage{}, shouldFail: true},
+		"nil":              {input: nil, shouldFail: true},
+		"non-string keys":  {input: map[int]int{1: 1}, shouldFail: true},
+		"unsupported type": {input: 1.5, shouldFail: true},
+		"struct omitting empty fields": {
+			input:  info{Name: "a", Pieces: [2]byte{'x', 'y'}, Skipped: "x", hidden: "x"},
+			output: "d8:Untaggedi0e4:name1:a6:pieces2:xye",
+		},
+		"struct with all fields": {
+			input:  info{Name: "a", Private: 1, Files: []file{{Length: 2, Path: []string{"d", "f"}}}, Parent: &info{Untagged: true}},
+			output: "d8:Untaggedi0e5:filesld6:lengthi2e4:pathl1:d1:feee4:name1:a6:parentd8:Untaggedi1e4:name0:6:pieces2:\x00\x00e6:pieces2:\x00\x007:privatei1ee",
+		},
+	}
+
+	for name, tc := range tt {
+		data, err := Marshal(tc.input)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, tc.output, string(data), name)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Canonical data is encoded back into the same bytes
+	input := []byte("d8:announce3:url13:announce-listll1:aee4:infod6:lengthi10e4:name1:x12:piece lengthi16384e6:pieces0:ee")
+
+	var v interface{}
+	require.Nil(t, UnmarshalStrict(input, &v))
+
+	var buf bytes.Buffer
+	require.Nil(t, NewEncoder(&buf).Encode(v))
+
+	assert.Equal(t, input, buf.Bytes())
+}
@@ -0,0 +1,456 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// refreshInterval is how often the node pings questionable nodes and
+// expires stored peers
+const refreshInterval time.Duration = 15 * time.Minute
+
+// queryTimeout is how long the node waits for a response. It's a variable
+// so that tests can shorten it.
+var queryTimeout = 2 * time.Second
+
+// DefaultBootstrapNodes are well-known routers used to join the network
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	// Returned when a node doesn't respond in time
+	ErrTimeout error = errors.New("dht query timed out")
+	// Returned when the routing table is empty and bootstrap failed
+	ErrNoNodes error = errors.New("no dht nodes to query")
+	// Returned for queries made after the node was closed
+	ErrClosed error = errors.New("dht node is closed")
+)
+
+// Config holds DHT node settings
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881"
+	Addr string
+	// BootstrapNodes are "host:port" addresses of nodes used to join the
+	// network when the routing table is empty
+	BootstrapNodes []string
+	// StatePath is a file where node ID and routing table are kept between
+	// runs. Empty path disables persistence
+	StatePath string
+}
+
+// DHT is a node of mainline DHT (BEP 5) used to find peers without trackers
+type DHT struct {
+	// ID is the node ID of the local node
+	ID     utils.BTString
+	config Config
+	conn   *net.UDPConn
+	table  *routingTable
+	tokens *tokenManager
+	store  *peerStore
+
+	// mu guards pending transactions and transaction counter
+	mu      sync.Mutex
+	pending map[string]transaction
+	txID    uint16
+
+	once sync.Once
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// transaction is a query waiting for response
+type transaction struct {
+	addr     string
+	response chan *krpcMessage
+}
+
+// Create starts a DHT node listening on configured address. Node ID and
+// known nodes are restored from the state file if it exists.
+func Create(config Config) (*DHT, error) {
+	addr, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := DHT{
+		ID:      randomID(),
+		config:  config,
+		conn:    conn,
+		tokens:  newTokenManager(),
+		store:   newPeerStore(),
+		pending: make(map[string]transaction),
+		stop:    make(chan struct{}),
+	}
+
+	var saved []*node
+	if config.StatePath != "" {
+		state, err := loadState(config.StatePath)
+		if err != nil {
+			log.Printf("[ERROR] Failed to load DHT state: %s", err)
+		} else if state != nil {
+			d.ID, saved = state.id, state.nodes
+		}
+	}
+
+	d.table = newRoutingTable(d.ID)
+	for _, n := range saved {
+		d.table.insert(n)
+	}
+
+	d.wg.Add(2)
+	go d.listen()
+	go d.maintain()
+
+	return &d, nil
+}
+
+// Addr returns local address of the node
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Bootstrap fills the routing table by asking bootstrap nodes and already
+// known nodes for nodes close to own ID
+func (d *DHT) Bootstrap() error {
+	var wg sync.WaitGroup
+	for _, address := range d.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			log.Printf("[ERROR] Failed to resolve DHT bootstrap node %s: %s", address, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(addr, methodFindNode, queryArgs{Target: string(d.ID[:])})
+		}()
+	}
+
+	wg.Wait()
+
+	closest, _ := d.lookup(d.ID, methodFindNode)
+	if len(closest) == 0 {
+		return ErrNoNodes
+	}
+
+	log.Printf("[INFO] DHT bootstrapped with %d nodes", len(d.table.nodes()))
+
+	return nil
+}
+
+// GetPeers looks up peers of the torrent with given infohash
+func (d *DHT) GetPeers(infoHash utils.BTString) ([]peers.Peer, error) {
+	_, found, err := d.getPeers(infoHash)
+
+	return found, err
+}
+
+// Announce looks up peers of the torrent and announces that the local peer
+// accepts connections on given TCP port to the closest nodes
+func (d *DHT) Announce(infoHash utils.BTString, port uint16) ([]peers.Peer, error) {
+	closest, found, err := d.getPeers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			args := queryArgs{InfoHash: string(infoHash[:]), Port: int(port), Token: c.token}
+			if _, err := d.query(c.node.addr, methodAnnouncePeer, args); err != nil {
+				log.Printf("[ERROR] DHT announce to %s failed: %s", c.node.addr, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return found, nil
+}
+
+// Close stops the node and saves its state
+func (d *DHT) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.stop)
+		d.conn.Close()
+		d.wg.Wait()
+
+		if d.config.StatePath != "" {
+			err = d.save(d.config.StatePath)
+		}
+	})
+
+	return err
+}
+
+// getPeers runs get_peers lookup bootstrapping the node first if needed
+func (d *DHT) getPeers(infoHash utils.BTString) ([]*candidate, []peers.Peer, error) {
+	if len(d.table.nodes()) == 0 {
+		if err := d.Bootstrap(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	closest, found := d.lookup(infoHash, methodGetPeers)
+	if len(closest) == 0 {
+		return nil, nil, ErrNoNodes
+	}
+
+	log.Printf("[INFO] DHT found %d peers for %x", len(found), infoHash)
+
+	return closest, found, nil
+}
+
+// query sends a query to given address and waits for the response.
+// Responding nodes are added to the routing table.
+func (d *DHT) query(addr *net.UDPAddr, method string, args queryArgs) (*response, error) {
+	args.ID = string(d.ID[:])
+
+	d.mu.Lock()
+	d.txID++
+	txID := string(binary.BigEndian.AppendUint16(nil, d.txID))
+	tx := transaction{addr: addr.String(), response: make(chan *krpcMessage, 1)}
+	d.pending[txID] = tx
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, txID)
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(&krpcMessage{T: txID, Y: typeQuery, Q: method, A: args}, addr); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-tx.response:
+		if msg.Y == typeError {
+			return nil, msg.err()
+		}
+
+		if len(msg.R.ID) != len(utils.BTString{}) {
+			return nil, &KRPCError{Code: errCodeProtocol, Message: "invalid node ID"}
+		}
+
+		d.table.insert(&node{id: utils.BTString([]byte(msg.R.ID)), addr: addr, lastSeen: time.Now()})
+
+		return &msg.R, nil
+	case <-time.After(queryTimeout):
+		return nil, ErrTimeout
+	case <-d.stop:
+		return nil, ErrClosed
+	}
+}
+
+// send writes a message to given address
+func (d *DHT) send(msg *krpcMessage, addr *net.UDPAddr) error {
+	data, err := msg.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(data, addr)
+
+	return err
+}
+
+// listen reads incoming messages until the node is closed
+func (d *DHT) listen() {
+	defer d.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if msg.Y == typeQuery {
+			d.handleQuery(msg, addr)
+			continue
+		}
+
+		d.mu.Lock()
+		tx, ok := d.pending[msg.T]
+		d.mu.Unlock()
+
+		if ok && tx.addr == addr.String() {
+			select {
+			case tx.response <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// handleQuery answers a query of another node
+func (d *DHT) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if len(msg.A.ID) != len(utils.BTString{}) {
+		d.sendError(msg.T, addr, errCodeProtocol, "invalid node ID")
+		return
+	}
+
+	d.table.insert(&node{id: utils.BTString([]byte(msg.A.ID)), addr: addr, lastSeen: time.Now()})
+
+	r := response{ID: string(d.ID[:])}
+	switch msg.Q {
+	case methodPing:
+	case methodFindNode:
+		if len(msg.A.Target) != len(d.ID) {
+			d.sendError(msg.T, addr, errCodeProtocol, "invalid target")
+			return
+		}
+
+		d.closestNodes(utils.BTString([]byte(msg.A.Target)), addr, &r)
+	case methodGetPeers:
+		if len(msg.A.InfoHash) != len(d.ID) {
+			d.sendError(msg.T, addr, errCodeProtocol, "invalid info_hash")
+			return
+		}
+
+		infoHash := utils.BTString([]byte(msg.A.InfoHash))
+		r.Token = d.tokens.create(compactIP(addr.IP))
+		if r.Values = d.store.get(infoHash); len(r.Values) == 0 {
+			d.closestNodes(infoHash, addr, &r)
+		}
+	case methodAnnouncePeer:
+		if len(msg.A.InfoHash) != len(d.ID) {
+			d.sendError(msg.T, addr, errCodeProtocol, "invalid info_hash")
+			return
+		}
+
+		if !d.tokens.valid(msg.A.Token, compactIP(addr.IP)) {
+			d.sendError(msg.T, addr, errCodeProtocol, "bad token")
+			return
+		}
+
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+
+		if port <= 0 || port > 65535 {
+			d.sendError(msg.T, addr, errCodeProtocol, "invalid port")
+			return
+		}
+
+		d.store.add(utils.BTString([]byte(msg.A.InfoHash)), peers.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		d.sendError(msg.T, addr, errCodeMethod, "method unknown")
+		return
+	}
+
+	d.send(&krpcMessage{T: msg.T, Y: typeResponse, R: r}, addr)
+}
+
+// sendError replies to a query with KRPC error
+func (d *DHT) sendError(txID string, addr *net.UDPAddr, code int, message string) {
+	d.send(&krpcMessage{T: txID, Y: typeError, E: []interface{}{code, message}}, addr)
+}
+
+// closestNodes puts known nodes closest to the target into the response.
+// Nodes of the same address family as the querying node are returned.
+func (d *DHT) closestNodes(target utils.BTString, addr *net.UDPAddr, r *response) {
+	ipv4 := addr.IP.To4() != nil
+
+	var nodes []*node
+	for _, n := range d.table.closest(target, len(d.table.nodes())) {
+		if (n.addr.IP.To4() != nil) == ipv4 && len(nodes) < bucketSize {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if ipv4 {
+		r.Nodes, _ = encodeNodes(nodes)
+	} else {
+		_, r.Nodes6 = encodeNodes(nodes)
+	}
+}
+
+// maintain periodically pings questionable nodes, expires stored peers and
+// re-bootstraps the node if it lost all contacts
+func (d *DHT) maintain() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		d.store.expire()
+
+		nodes := d.table.nodes()
+		if len(nodes) == 0 {
+			if err := d.Bootstrap(); err != nil {
+				log.Printf("[ERROR] DHT bootstrap failed: %s", err)
+			}
+
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			if !n.questionable() {
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := d.query(n.addr, methodPing, queryArgs{}); errors.Is(err, ErrTimeout) {
+					d.table.failed(n.id)
+				}
+			}()
+		}
+
+		wg.Wait()
+	}
+}
+
+// compactIP returns 4-byte form of IPv4 addresses and 16-byte form of IPv6
+func compactIP(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip.To16()
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := createNetwork(t, 8)
+	infoHash := utils.BTString{1, 2, 3, 4, 5}
+
+	for _, node := range nodes[1:] {
+		require.Nil(t, node.Bootstrap())
+	}
+
+	found, err := nodes[1].Announce(infoHash, 6881)
+	require.Nil(t, err)
+	assert.Empty(t, found)
+
+	found, err = nodes[len(nodes)-1].GetPeers(infoHash)
+	require.Nil(t, err)
+	require.Len(t, found, 1)
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(found[0].IP))
+	assert.Equal(t, uint16(6881), found[0].Port)
+}
+
+func TestGetPeersBootstrapsEmptyTable(t *testing.T) {
+	nodes := createNetwork(t, 3)
+	infoHash := utils.BTString{5, 4, 3, 2, 1}
+	nodes[0].store.add(infoHash, peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881})
+
+	found, err := nodes[2].GetPeers(infoHash)
+
+	require.Nil(t, err)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}, found)
+}
+
+func TestGetPeersWithoutNodes(t *testing.T) {
+	node, err := Create(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+
+	defer node.Close()
+
+	_, err = node.GetPeers(utils.BTString{})
+
+	assert.ErrorIs(t, err, ErrNoNodes)
+}
+
+func TestQueryErrors(t *testing.T) {
+	nodes := createNetwork(t, 2)
+	addr := nodes[1].Addr()
+
+	type testCase struct {
+		method string
+		args   queryArgs
+		code   int
+	}
+
+	tt := map[string]testCase{
+		"unknown method": {
+			method: "vote",
+			code:   errCodeMethod,
+		},
+		"invalid target": {
+			method: methodFindNode,
+			args:   queryArgs{Target: "short"},
+			code:   errCodeProtocol,
+		},
+		"bad token": {
+			method: methodAnnouncePeer,
+			args:   queryArgs{InfoHash: string(make([]byte, 20)), Port: 6881, Token: "forged"},
+			code:   errCodeProtocol,
+		},
+	}
+
+	for name, tc := range tt {
+		_, err := nodes[0].query(addr, tc.method, tc.args)
+
+		var krpcErr *KRPCError
+		require.ErrorAs(t, err, &krpcErr, name)
+		assert.Equal(t, tc.code, krpcErr.Code, name)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	nodes := createNetwork(t, 1)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	node, err := Create(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{nodes[0].Addr().String()}, StatePath: path})
+	require.Nil(t, err)
+	require.Nil(t, node.Bootstrap())
+
+	id := node.ID
+	require.Nil(t, node.Close())
+
+	restored, err := Create(Config{Addr: "127.0.0.1:0", StatePath: path})
+	require.Nil(t, err)
+
+	defer restored.Close()
+
+	assert.Equal(t, id, restored.ID)
+	require.Len(t, restored.table.nodes(), 1)
+	assert.Equal(t, nodes[0].ID, restored.table.nodes()[0].id)
+}
+
+// createNetwork starts DHT nodes on loopback which use the first node
+// for bootstrap
+func createNetwork(t *testing.T, count int) []*DHT {
+	queryTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { queryTimeout = 2 * time.Second })
+
+	nodes := make([]*DHT, count)
+	for i := range nodes {
+		config := Config{Addr: "127.0.0.1:0"}
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+
+		node, err := Create(config)
+		require.Nil(t, err)
+
+		t.Cleanup(func() { node.Close() })
+		nodes[i] = node
+	}
+
+	return nodes
+}
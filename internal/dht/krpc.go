@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// KRPC message types
+const (
+	typeQuery    string = "q"
+	typeResponse string = "r"
+	typeError    string = "e"
+)
+
+// KRPC query methods
+const (
+	methodPing         string = "ping"
+	methodFindNode     string = "find_node"
+	methodGetPeers     string = "get_peers"
+	methodAnnouncePeer string = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	errCodeGeneric  int = 201
+	errCodeProtocol int = 203
+	errCodeMethod   int = 204
+)
+
+// queryArgs holds arguments of all supported queries
+type queryArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+// response holds return values of all supported queries
+type response struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// krpcMessage is a bencoded dictionary exchanged by DHT nodes. Only the
+// fields relevant to message type are encoded.
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q"`
+	A queryArgs     `bencode:"a"`
+	R response      `bencode:"r"`
+	E []interface{} `bencode:"e"`
+}
+
+// KRPCError is an error returned by a remote node
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// encode serializes the message into bencoded dictionary
+func (msg *krpcMessage) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": msg.T, "y": msg.Y}
+
+	switch msg.Y {
+	case typeQuery:
+		dict["q"] = msg.Q
+		dict["a"] = msg.A
+	case typeResponse:
+		dict["r"] = msg.R
+	case typeError:
+		dict["e"] = msg.E
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Y)
+	}
+
+	return bencode.Marshal(dict)
+}
+
+// decodeMessage parses bencoded KRPC message
+func decodeMessage(data []byte) (*krpcMessage, error) {
+	msg := krpcMessage{}
+	if err := bencode.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.T == "" {
+		return nil, fmt.Errorf("message has no transaction ID")
+	}
+
+	switch msg.Y {
+	case typeQuery, typeResponse, typeError:
+		return &msg, nil
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Y)
+	}
+}
+
+// err converts error message into [*KRPCError]
+func (msg *krpcMessage) err() error {
+	e := KRPCError{Code: errCodeGeneric}
+	if len(msg.E) > 0 {
+		if code, ok := msg.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+
+	if len(msg.E) > 1 {
+		e.Message, _ = msg.E[1].(string)
+	}
+
+	return &e
+}
+
+// encodeNodes serializes nodes into compact node info strings for IPv4
+// and IPv6 nodes
+func encodeNodes(nodes []*node) (string, string) {
+	var v4, v6 []byte
+	for _, n := range nodes {
+		if ip := n.addr.IP.To4(); ip != nil {
+			v4 = append(v4, n.id[:]...)
+			v4 = append(v4, ip...)
+			v4 = binary.BigEndian.AppendUint16(v4, uint16(n.addr.Port))
+		} else {
+			v6 = append(v6, n.id[:]...)
+			v6 = append(v6, n.addr.IP.To16()...)
+			v6 = binary.BigEndian.AppendUint16(v6, uint16(n.addr.Port))
+		}
+	}
+
+	return string(v4), string(v6)
+}
+
+// decodeNodes parses compact node info string where each node takes
+// 20 bytes of ID followed by IP address of given length and port
+func decodeNodes(compact string, ipLen int) ([]*node, error) {
+	size := 20 + ipLen + 2
+	if len(compact)%size != 0 {
+		return nil, fmt.Errorf("received malformed nodes data of length %d", len(compact))
+	}
+
+	nodes := make([]*node, 0, len(compact)/size)
+	for offset := 0; offset < len(compact); offset += size {
+		raw := []byte(compact[offset : offset+size])
+		n := node{
+			id: utils.BTString(raw[:20]),
+			addr: &net.UDPAddr{
+				IP:   net.IP(raw[20 : 20+ipLen]),
+				Port: int(binary.BigEndian.Uint16(raw[20+ipLen:])),
+			},
+		}
+
+		nodes = append(nodes, &n)
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	type testCase struct {
+		input  krpcMessage
+		output string
+	}
+
+	id := "abcdefghij0123456789"
+	tt := map[string]testCase{
+		"ping query": {
+			input:  krpcMessage{T: "aa", Y: typeQuery, Q: methodPing, A: queryArgs{ID: id}},
+			output: "d1:ad2:id20:" + id + "e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		"get_peers response": {
+			input:  krpcMessage{T: "aa", Y: typeResponse, R: response{ID: id, Token: "aoeusnth", Values: []string{"axje.u", "idhtnm"}}},
+			output: "d1:rd2:id20:" + id + "5:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+		},
+		"error": {
+			input:  krpcMessage{T: "aa", Y: typeError, E: []interface{}{201, "A Generic Error Ocurred"}},
+			output: "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+
+	for name, tc := range tt {
+		data, err := tc.input.encode()
+
+		require.Nil(t, err, name)
+		assert.Equal(t, tc.output, string(data), name)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	type testCase struct {
+		input      string
+		output     *krpcMessage
+		shouldFail bool
+	}
+
+	id := "mnopqrstuvwxyz123456"
+	tt := map[string]testCase{
+		"announce_peer query": {
+			input: "d1:ad2:id20:" + id + "12:implied_porti1e9:info_hash20:" + id + "4:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe",
+			output: &krpcMessage{T: "aa", Y: typeQuery, Q: methodAnnouncePeer, A: queryArgs{
+				ID:          id,
+				InfoHash:    id,
+				Port:        6881,
+				ImpliedPort: 1,
+				Token:       "aoeusnth",
+			}},
+		},
+		"error with unknown keys": {
+			input:  "d1:eli203e14:Protocol Errore1:t2:aa1:v4:LT011:y1:ee",
+			output: &krpcMessage{T: "aa", Y: typeError, E: []interface{}{int64(203), "Protocol Error"}},
+		},
+		"missing transaction ID": {
+			input:      "d1:y1:qe",
+			shouldFail: true,
+		},
+		"unknown type": {
+			input:      "d1:t2:aa1:y1:xe",
+			shouldFail: true,
+		},
+		"not a dictionary": {
+			input:      "4:spam",
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		msg, err := decodeMessage([]byte(tc.input))
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, tc.output, msg, name)
+		}
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []*node{
+		{id: utils.BTString{1}, addr: &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881}},
+		{id: utils.BTString{2}, addr: &net.UDPAddr{IP: net.IPv6loopback, Port: 6882}},
+	}
+
+	v4, v6 := encodeNodes(nodes)
+	require.Len(t, v4, 26)
+	require.Len(t, v6, 38)
+
+	decoded, err := decodeNodes(v4, net.IPv4len)
+	require.Nil(t, err)
+	assert.Equal(t, nodes[:1], decoded)
+
+	decoded, err = decodeNodes(v6, net.IPv6len)
+	require.Nil(t, err)
+	assert.Equal(t, nodes[1:], decoded)
+
+	_, err = decodeNodes(v4[:10], net.IPv4len)
+	assert.NotNil(t, err)
+}
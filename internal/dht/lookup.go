@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// alpha is the number of concurrent queries during a lookup
+const alpha int = 3
+
+// candidate is a node considered during a lookup
+type candidate struct {
+	node      *node
+	queried   bool
+	responded bool
+	// token is received in get_peers response and required to announce
+	token string
+}
+
+// failed tells whether the candidate didn't answer the query
+func (c *candidate) failed() bool {
+	return c.queried && !c.responded
+}
+
+// lookup iteratively queries nodes closer and closer to the target until
+// the closest ones are all queried. Returns responded nodes closest to
+// the target and peers found along the way for get_peers lookups.
+func (d *DHT) lookup(target utils.BTString, method string) ([]*candidate, []peers.Peer) {
+	args := queryArgs{Target: string(target[:])}
+	if method == methodGetPeers {
+		args = queryArgs{InfoHash: string(target[:])}
+	}
+
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	add := func(n *node) {
+		if n.id == d.ID || n.addr.Port == 0 || seen[n.addr.String()] {
+			return
+		}
+
+		seen[n.addr.String()] = true
+		candidates = append(candidates, &candidate{node: n})
+	}
+
+	for _, n := range d.table.closest(target, bucketSize) {
+		add(n)
+	}
+
+	var found []peers.Peer
+	known := make(map[string]bool)
+	for {
+		sortCandidates(candidates, target)
+
+		batch := nextBatch(candidates)
+		if len(batch) == 0 {
+			break
+		}
+
+		responses := make([]*response, len(batch))
+
+		var wg sync.WaitGroup
+		for i, c := range batch {
+			c.queried = true
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				r, err := d.query(c.node.addr, method, args)
+				if errors.Is(err, ErrTimeout) {
+					d.table.failed(c.node.id)
+				}
+
+				responses[i] = r
+			}()
+		}
+
+		wg.Wait()
+
+		for i, c := range batch {
+			r := responses[i]
+			if r == nil {
+				continue
+			}
+
+			c.responded = true
+			c.token = r.Token
+
+			nodes, _ := decodeNodes(r.Nodes, net.IPv4len)
+			nodes6, _ := decodeNodes(r.Nodes6, net.IPv6len)
+			for _, n := range append(nodes, nodes6...) {
+				add(n)
+			}
+
+			for _, peer := range decodeValues(r.Values) {
+				if !known[peer.String()] {
+					known[peer.String()] = true
+					found = append(found, peer)
+				}
+			}
+		}
+	}
+
+	var closest []*candidate
+	for _, c := range candidates {
+		if c.responded && len(closest) < bucketSize {
+			closest = append(closest, c)
+		}
+	}
+
+	return closest, found
+}
+
+// nextBatch picks up to [alpha] not queried candidates among [bucketSize]
+// closest candidates which didn't fail
+func nextBatch(candidates []*candidate) []*candidate {
+	var batch []*candidate
+	live := 0
+	for _, c := range candidates {
+		if live == bucketSize || len(batch) == alpha {
+			break
+		}
+
+		if c.failed() {
+			continue
+		}
+
+		live++
+		if !c.queried {
+			batch = append(batch, c)
+		}
+	}
+
+	return batch
+}
+
+// sortCandidates orders candidates from the closest to the farthest
+func sortCandidates(candidates []*candidate, target utils.BTString) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		di, dj := distance(candidates[i].node.id, target), distance(candidates[j].node.id, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// decodeValues parses compact peers from get_peers response. Malformed
+// values are skipped.
+func decodeValues(values []string) []peers.Peer {
+	var found []peers.Peer
+	for _, value := range values {
+		var parsed []peers.Peer
+		switch len(value) {
+		case net.IPv4len + 2:
+			parsed, _ = peers.Unmarshal([]byte(value))
+		case net.IPv6len + 2:
+			parsed, _ = peers.Unmarshal6([]byte(value))
+		}
+
+		found = append(found, parsed...)
+	}
+
+	return found
+}
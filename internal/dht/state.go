@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// bencodeState is the content of DHT state file
+type bencodeState struct {
+	ID     string `bencode:"id"`
+	Nodes  string `bencode:"nodes"`
+	Nodes6 string `bencode:"nodes6"`
+}
+
+// state is decoded node ID and routing table
+type state struct {
+	id    utils.BTString
+	nodes []*node
+}
+
+// loadState reads DHT state from given path. Missing file results in nil
+// state without an error.
+func loadState(path string) (*state, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	saved := bencodeState{}
+	if err := bencode.NewDecoder(file).Decode(&saved); err != nil {
+		return nil, err
+	}
+
+	if len(saved.ID) != len(utils.BTString{}) {
+		return nil, fmt.Errorf("invalid node ID in %s", path)
+	}
+
+	nodes, err := decodeNodes(saved.Nodes, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes6, err := decodeNodes(saved.Nodes6, net.IPv6len)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state{id: utils.BTString([]byte(saved.ID)), nodes: append(nodes, nodes6...)}, nil
+}
+
+// save writes node ID and routing table to given path
+func (d *DHT) save(path string) error {
+	nodes, nodes6 := encodeNodes(d.table.nodes())
+	saved := bencodeState{ID: string(d.ID[:]), Nodes: nodes, Nodes6: nodes6}
+
+	data, err := bencode.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Write into a temporary file first so that a crash doesn't leave
+	// truncated state behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
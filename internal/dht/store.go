@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+const (
+	// tokenRotation is how often token secret changes. Tokens created with
+	// the previous secret are still accepted.
+	tokenRotation time.Duration = 5 * time.Minute
+	// peerTTL is how long announced peers are kept
+	peerTTL time.Duration = 30 * time.Minute
+	// maxStoredPeers limits the number of peers kept per infohash
+	maxStoredPeers int = 200
+	// maxInfoHashes limits the number of infohashes peers are kept for, so
+	// announces of random infohashes can't exhaust memory
+	maxInfoHashes int = 2000
+	// maxValues limits the number of peers returned in a single response
+	// to keep it within a single UDP packet
+	maxValues int = 50
+)
+
+// tokenManager issues and verifies tokens required to announce peers
+type tokenManager struct {
+	mu       sync.Mutex
+	secret   []byte
+	previous []byte
+	rotated  time.Time
+}
+
+// newTokenManager creates token manager with a random secret
+func newTokenManager() *tokenManager {
+	return &tokenManager{secret: newSecret(), previous: newSecret(), rotated: time.Now()}
+}
+
+// create returns a token for given IP address
+func (tm *tokenManager) create(ip []byte) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+
+	return token(tm.secret, ip)
+}
+
+// valid tells whether the token was issued for given IP address recently
+func (tm *tokenManager) valid(t string, ip []byte) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+
+	return hmac.Equal([]byte(t), []byte(token(tm.secret, ip))) ||
+		hmac.Equal([]byte(t), []byte(token(tm.previous, ip)))
+}
+
+// rotate replaces the secret once it gets old
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotated) < tokenRotation {
+		return
+	}
+
+	tm.previous, tm.secret = tm.secret, newSecret()
+	tm.rotated = time.Now()
+}
+
+// token derives a token from the secret and IP address
+func token(secret, ip []byte) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(ip)
+
+	return string(mac.Sum(nil)[:8])
+}
+
+// newSecret generates random token secret
+func newSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	return secret
+}
+
+// peerStore keeps peers announced to the node
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[utils.BTString]map[string]storedPeer
+}
+
+// storedPeer is an announced peer with time of the last announce
+type storedPeer struct {
+	peer      peers.Peer
+	announced time.Time
+}
+
+// newPeerStore creates an empty peer store
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[utils.BTString]map[string]storedPeer)}
+}
+
+// add stores a peer announced for the infohash. Announces of new
+// infohashes are dropped once [maxInfoHashes] are tracked.
+func (s *peerStore) add(infoHash utils.BTString, peer peers.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm, ok := s.peers[infoHash]
+	if !ok {
+		if len(s.peers) >= maxInfoHashes {
+			return
+		}
+
+		swarm = make(map[string]storedPeer)
+		s.peers[infoHash] = swarm
+	}
+
+	if _, known := swarm[peer.String()]; !known && len(swarm) >= maxStoredPeers {
+		return
+	}
+
+	swarm[peer.String()] = storedPeer{peer, time.Now()}
+}
+
+// get returns compact forms of up to [maxValues] peers of the infohash
+func (s *peerStore) get(infoHash utils.BTString) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var values []string
+	for _, stored := range s.peers[infoHash] {
+		if len(values) == maxValues {
+			break
+		}
+
+		if time.Since(stored.announced) < peerTTL {
+			values = append(values, string(stored.peer.Marshal()))
+		}
+	}
+
+	return values
+}
+
+// expire removes peers which weren't announced for a while
+func (s *peerStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, swarm := range s.peers {
+		for key, stored := range swarm {
+			if time.Since(stored.announced) >= peerTTL {
+				delete(swarm, key)
+			}
+		}
+
+		if len(swarm) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
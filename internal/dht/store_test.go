@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerStoreLimitsInfoHashes(t *testing.T) {
+	store := newPeerStore()
+	peer := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+
+	// Announces of random infohashes stop being stored at the limit
+	var first utils.BTString
+	for i := range maxInfoHashes + 100 {
+		var infoHash utils.BTString
+		rand.Read(infoHash[:])
+		if i == 0 {
+			first = infoHash
+		}
+
+		store.add(infoHash, peer)
+	}
+
+	assert.Len(t, store.peers, maxInfoHashes)
+
+	var infoHash utils.BTString
+	rand.Read(infoHash[:])
+	store.add(infoHash, peer)
+	assert.Empty(t, store.get(infoHash), "new infohash")
+
+	// Tracked infohashes still accept peers
+	store.add(first, peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881})
+	assert.Len(t, store.get(first), 2)
+}
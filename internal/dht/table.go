@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/utils"
+)
+
+const (
+	// bucketSize is the maximum number of nodes in a k-bucket
+	bucketSize int = 8
+	// maxFailures is the number of unanswered queries after which a node
+	// is removed from the routing table
+	maxFailures int = 2
+	// questionableAge is the time after which a silent node is questionable
+	questionableAge time.Duration = 15 * time.Minute
+)
+
+// node is a contact of another DHT node
+type node struct {
+	id       utils.BTString
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// questionable tells whether the node wasn't heard from for a while
+func (n *node) questionable() bool {
+	return time.Since(n.lastSeen) > questionableAge
+}
+
+// routingTable keeps known good nodes in k-buckets. Bucket i holds nodes
+// whose IDs share exactly i leading bits with own ID, which is equivalent
+// to splitting the bucket covering own ID as described in BEP 5.
+type routingTable struct {
+	self    utils.BTString
+	mu      sync.Mutex
+	buckets [160][]*node
+}
+
+// newRoutingTable creates an empty routing table for given own ID
+func newRoutingTable(self utils.BTString) *routingTable {
+	return &routingTable{self: self}
+}
+
+// insert adds a node or refreshes already known one. When the bucket is
+// full, a node with failed queries is replaced, otherwise the new node
+// is dropped. Returns true if the node is in the table afterwards.
+func (t *routingTable) insert(n *node) bool {
+	if n.id == t.self {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.bucketIndex(n.id)
+	bucket := t.buckets[index]
+
+	for i, known := range bucket {
+		if known.id == n.id {
+			known.addr = n.addr
+			known.lastSeen = n.lastSeen
+			known.failures = 0
+			// Keep the bucket ordered from least to most recently seen
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), known)
+
+			return true
+		}
+	}
+
+	if len(bucket) < bucketSize {
+		t.buckets[index] = append(bucket, n)
+		return true
+	}
+
+	for i, known := range bucket {
+		if known.failures > 0 {
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return true
+		}
+	}
+
+	return false
+}
+
+// failed registers unanswered query to a node and removes it from the
+// table once it fails too many times
+func (t *routingTable) failed(id utils.BTString) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.bucketIndex(id)
+	bucket := t.buckets[index]
+	for i, known := range bucket {
+		if known.id != id {
+			continue
+		}
+
+		known.failures++
+		if known.failures >= maxFailures {
+			t.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+		}
+
+		return
+	}
+}
+
+// closest returns up to count known nodes closest to the target
+func (t *routingTable) closest(target utils.BTString, count int) []*node {
+	nodes := t.nodes()
+	sortByDistance(nodes, target)
+
+	return nodes[:min(count, len(nodes))]
+}
+
+// nodes returns copies of all nodes in the table
+func (t *routingTable) nodes() []*node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []*node
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			copied := *n
+			nodes = append(nodes, &copied)
+		}
+	}
+
+	return nodes
+}
+
+// bucketIndex returns index of the bucket for given ID
+func (t *routingTable) bucketIndex(id utils.BTString) int {
+	return min(prefixLen(t.self, id), len(t.buckets)-1)
+}
+
+// distance returns XOR distance between two IDs
+func distance(a, b utils.BTString) utils.BTString {
+	var d utils.BTString
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+
+	return d
+}
+
+// prefixLen returns the number of leading bits shared by two IDs
+func prefixLen(a, b utils.BTString) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(a) * 8
+}
+
+// sortByDistance orders nodes from the closest to the farthest from target
+func sortByDistance(nodes []*node, target utils.BTString) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di, dj := distance(nodes[i].id, target), distance(nodes[j].id, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// randomID generates random node ID
+func randomID() utils.BTString {
+	var id utils.BTString
+	rand.Read(id[:])
+
+	return id
+}
@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixLen(t *testing.T) {
+	type testCase struct {
+		a, b   utils.BTString
+		output int
+	}
+
+	tt := map[string]testCase{
+		"same IDs":             {utils.BTString{1}, utils.BTString{1}, 160},
+		"differ in first bit":  {utils.BTString{0x80}, utils.BTString{}, 0},
+		"differ in ninth bit":  {utils.BTString{0xff, 0x80}, utils.BTString{0xff}, 8},
+		"differ in last bytes": {utils.BTString{19: 1}, utils.BTString{}, 159},
+	}
+
+	for name, tc := range tt {
+		assert.Equal(t, tc.output, prefixLen(tc.a, tc.b), name)
+	}
+}
+
+func TestRoutingTableInsert(t *testing.T) {
+	table := newRoutingTable(utils.BTString{})
+
+	// All these IDs fall into the same bucket of IDs starting with bit 1
+	for i := range bucketSize {
+		assert.True(t, table.insert(createNode(byte(0x80+i))))
+	}
+
+	assert.False(t, table.insert(createNode(0xf0)), "full bucket")
+	assert.False(t, table.insert(createNode(0)), "own ID")
+	assert.True(t, table.insert(createNode(0x01)), "other bucket")
+
+	// Failed node gets replaced by a new one
+	table.failed(utils.BTString{0x80})
+	assert.True(t, table.insert(createNode(0xf0)))
+	assert.Len(t, table.nodes(), bucketSize+1)
+
+	table.failed(utils.BTString{0x81})
+	table.failed(utils.BTString{0x81})
+	assert.Len(t, table.nodes(), bucketSize, "node removed after failures")
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := newRoutingTable(utils.BTString{})
+	for _, id := range []byte{0x80, 0x40, 0x41, 0x01, 0xff} {
+		table.insert(createNode(id))
+	}
+
+	closest := table.closest(utils.BTString{0x42}, 3)
+
+	ids := make([]byte, len(closest))
+	for i, n := range closest {
+		ids[i] = n.id[0]
+	}
+
+	assert.Equal(t, []byte{0x40, 0x41, 0x01}, ids)
+}
+
+// createNode creates a node with ID starting with given byte
+func createNode(first byte) *node {
+	return &node{
+		id:       utils.BTString{first},
+		addr:     &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 6881 + int(first)},
+		lastSeen: time.Now(),
+	}
+}
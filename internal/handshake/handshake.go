@@ -10,20 +10,51 @@ import (
 
 const pstr string = "BitTorrent protocol"
 
+// Extension is a protocol extension advertised by a bit of reserved bytes.
+// Its value is the bit number counting from the most significant bit of
+// the first reserved byte.
+type Extension uint8
+
+const (
+	ExtensionProtocol Extension = 43 // Extension protocol (BEP 10)
+	FastExtension     Extension = 61 // Fast extension (BEP 6)
+	DHT               Extension = 63 // DHT port message (BEP 5)
+)
+
+// Reserved holds 8 reserved handshake bytes used to negotiate extensions
+type Reserved [8]byte
+
 // Handshake represents a message exchanged between peers over TCP connection
 type Handshake struct {
-	PSTR     string
+	PSTR string
+	// Reserved bytes announce protocol extensions supported by a peer
+	Reserved Reserved
 	InfoHash utils.BTString
 	PeerID   utils.BTString
 }
 
 // Create creates a new handshake message to connect with peers
 func Create(infoHash, peerID utils.BTString) *Handshake {
-	return &Handshake{pstr, infoHash, peerID}
+	return &Handshake{PSTR: pstr, InfoHash: infoHash, PeerID: peerID}
 }
 
 // Read reads received handshake message to a struct
 func Read(r io.Reader, expectedHash utils.BTString) (*Handshake, error) {
+	hs, err := ReadAny(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(hs.InfoHash[:], expectedHash[:]) {
+		return nil, fmt.Errorf("handshake integrity failed")
+	}
+
+	return hs, nil
+}
+
+// ReadAny reads handshake message with any infohash. It's used for inbound
+// connections where the infohash tells which torrent the peer wants.
+func ReadAny(r io.Reader) (*Handshake, error) {
 	lenBuf := make([]byte, 1)
 	if _, err := io.ReadFull(r, lenBuf); err != nil {
 		return nil, err
@@ -41,17 +72,15 @@ func Read(r io.Reader, expectedHash utils.BTString) (*Handshake, error) {
 
 	pstr := string(payload[0:pstrLen])
 	var infoHash, peerID utils.BTString
+	var reserved Reserved
 
 	infoHashStart, infoHashEnd := pstrLen+8, pstrLen+8+20
 
+	copy(reserved[:], payload[pstrLen:infoHashStart])
 	copy(infoHash[:], payload[infoHashStart:infoHashEnd])
 	copy(peerID[:], payload[infoHashEnd:])
 
-	if !bytes.Equal(infoHash[:], expectedHash[:]) {
-		return nil, fmt.Errorf("handshake integrity failed")
-	}
-
-	return &Handshake{pstr, infoHash, peerID}, nil
+	return &Handshake{pstr, reserved, infoHash, peerID}, nil
 }
 
 // Serialize serializes handshake into a slice of bytes
@@ -61,9 +90,19 @@ func (msg *Handshake) Serialize() []byte {
 
 	curr := 1
 	curr += copy(buf[curr:], msg.PSTR)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], msg.Reserved[:])
 	curr += copy(buf[curr:], msg.InfoHash[:])
 	curr += copy(buf[curr:], msg.PeerID[:])
 
 	return buf
 }
+
+// Enable sets the bit of given extension
+func (r *Reserved) Enable(ext Extension) {
+	r[ext/8] |= 0x80 >> (ext % 8)
+}
+
+// Supports tells whether the bit of given extension is set
+func (r Reserved) Supports(ext Extension) bool {
+	return r[ext/8]&(0x80>>(ext%8)) != 0
+}
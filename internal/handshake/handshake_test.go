@@ -40,6 +40,16 @@ func TestRead(t *testing.T) {
 			},
 			shouldFail: false,
 		},
+		"reserved bits": {
+			input: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x05, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			output: &Handshake{
+				PSTR:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05},
+				InfoHash: validHash,
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			shouldFail: false,
+		},
 		"empty message": {
 			input:      []byte{},
 			output:     nil,
@@ -71,6 +81,18 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestReadAny(t *testing.T) {
+	input := []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0, 0, 0, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+
+	// Infohash isn't checked, so the handshake is read for any torrent
+	handshake, err := ReadAny(bytes.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}, [20]byte(handshake.InfoHash))
+
+	_, err = Read(bytes.NewReader(input), [20]byte{})
+	assert.NotNil(t, err)
+}
+
 func TestSerialize(t *testing.T) {
 	type testCase struct {
 		input  *Handshake
@@ -86,6 +108,15 @@ func TestSerialize(t *testing.T) {
 			},
 			output: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0, 0, 0, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 		},
+		"reserved bits": {
+			input: &Handshake{
+				PSTR:     "BitTorrent protocol",
+				Reserved: [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x01},
+				InfoHash: [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116},
+				PeerID:   [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			},
+			output: []byte{19, 66, 105, 116, 84, 111, 114, 114, 101, 110, 116, 32, 112, 114, 111, 116, 111, 99, 111, 108, 0, 0, 0, 0, 0, 0x10, 0, 0x01, 134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+		},
 		"different pstr": {
 			input: &Handshake{
 				PSTR:     "BitTorrent protocol, but cooler?",
@@ -100,3 +131,26 @@ func TestSerialize(t *testing.T) {
 		assert.Equal(t, tc.output, tc.input.Serialize())
 	}
 }
+
+func TestReserved(t *testing.T) {
+	type testCase struct {
+		ext      Extension
+		reserved Reserved
+	}
+
+	tt := map[string]testCase{
+		"extension protocol": {ExtensionProtocol, Reserved{0, 0, 0, 0, 0, 0x10, 0, 0}},
+		"fast extension":     {FastExtension, Reserved{0, 0, 0, 0, 0, 0, 0, 0x04}},
+		"DHT":                {DHT, Reserved{0, 0, 0, 0, 0, 0, 0, 0x01}},
+	}
+
+	for name, tc := range tt {
+		var reserved Reserved
+		assert.False(t, reserved.Supports(tc.ext), name)
+
+		reserved.Enable(tc.ext)
+
+		assert.Equal(t, tc.reserved, reserved, name)
+		assert.True(t, reserved.Supports(tc.ext), name)
+	}
+}
@@ -0,0 +1,77 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/sauromates/leech/internal/bencode"
+)
+
+// ExtendedHandshakeID is the extended message ID of extension handshake
+const ExtendedHandshakeID uint8 = 0
+
+// ExtendedHandshake is a bencoded dictionary exchanged by peers supporting
+// extension protocol (BEP 10) right after the handshake
+type ExtendedHandshake struct {
+	// M maps names of supported extensions to their extended message IDs.
+	// Zero ID means the extension is disabled
+	M map[string]int `bencode:"m"`
+	// V is the client name and version
+	V string `bencode:"v,omitempty"`
+	// P is the local TCP listen port
+	P int `bencode:"p,omitempty"`
+	// Reqq is the number of outstanding requests the client accepts
+	Reqq int `bencode:"reqq,omitempty"`
+	// YourIP is the compact IP address of the receiver as seen by the sender
+	YourIP string `bencode:"yourip,omitempty"`
+	// MetadataSize is the size of info dictionary (BEP 9)
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+// CreateExtended creates a message with code 20 (`extended`) carrying a
+// payload of extension with given extended message ID
+func CreateExtended(id uint8, payload []byte) *Message {
+	return &Message{ID: Extended, Payload: append([]byte{id}, payload...)}
+}
+
+// CreateExtendedHandshake creates extension handshake message
+func CreateExtendedHandshake(hs ExtendedHandshake) (*Message, error) {
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateExtended(ExtendedHandshakeID, payload), nil
+}
+
+// ParseExtended splits `extended` message into extended message ID and
+// payload of the extension
+func (msg *Message) ParseExtended() (uint8, []byte, error) {
+	if msg.ID != Extended {
+		return 0, nil, fmt.Errorf("unexpected code %d", msg.ID)
+	}
+
+	if len(msg.Payload) == 0 {
+		return 0, nil, fmt.Errorf("extended message has no ID")
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseExtendedHandshake decodes extension handshake dictionary
+func (msg *Message) ParseExtendedHandshake() (*ExtendedHandshake, error) {
+	id, payload, err := msg.ParseExtended()
+	if err != nil {
+		return nil, err
+	}
+
+	if id != ExtendedHandshakeID {
+		return nil, fmt.Errorf("unexpected extended message ID %d", id)
+	}
+
+	hs := ExtendedHandshake{}
+	if err := bencode.Unmarshal(payload, &hs); err != nil {
+		return nil, err
+	}
+
+	return &hs, nil
+}
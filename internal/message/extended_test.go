@@ -0,0 +1,82 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateExtended(t *testing.T) {
+	msg := CreateExtended(3, []byte("d1:ai1ee"))
+	expected := &Message{
+		ID:      Extended,
+		Payload: []byte{3, 'd', '1', ':', 'a', 'i', '1', 'e', 'e'},
+	}
+
+	assert.Equal(t, expected, msg)
+}
+
+func TestCreateExtendedHandshake(t *testing.T) {
+	msg, err := CreateExtendedHandshake(ExtendedHandshake{
+		M:      map[string]int{"ut_pex": 2, "ut_metadata": 1},
+		V:      "leech",
+		P:      6881,
+		Reqq:   250,
+		YourIP: string([]byte{127, 0, 0, 1}),
+	})
+	expected := "d1:md11:ut_metadatai1e6:ut_pexi2ee1:pi6881e4:reqqi250e1:v5:leech6:yourip4:\x7f\x00\x00\x01e"
+
+	require.Nil(t, err)
+	assert.Equal(t, Extended, msg.ID)
+	assert.Equal(t, ExtendedHandshakeID, msg.Payload[0])
+	assert.Equal(t, expected, string(msg.Payload[1:]))
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	type testCase struct {
+		input      *Message
+		output     *ExtendedHandshake
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"valid handshake": {
+			input: &Message{Extended, []byte("\x00d1:md11:ut_metadatai3ee1:pi6881e4:reqqi500e1:v9:qBT 4.6.013:metadata_sizei31235ee")},
+			output: &ExtendedHandshake{
+				M:            map[string]int{"ut_metadata": 3},
+				V:            "qBT 4.6.0",
+				P:            6881,
+				Reqq:         500,
+				MetadataSize: 31235,
+			},
+		},
+		"invalid message type": {
+			input:      &Message{Piece, []byte("\x00de")},
+			shouldFail: true,
+		},
+		"empty payload": {
+			input:      &Message{Extended, []byte{}},
+			shouldFail: true,
+		},
+		"not a handshake": {
+			input:      &Message{Extended, []byte("\x01de")},
+			shouldFail: true,
+		},
+		"malformed dictionary": {
+			input:      &Message{Extended, []byte("\x00d1:m")},
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		hs, err := tc.input.ParseExtendedHandshake()
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+
+		assert.Equal(t, tc.output, hs, name)
+	}
+}
@@ -3,6 +3,8 @@ package message
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/sauromates/leech/internal/bitfield"
 )
 
 // CreateHave creates a message with code 4 (`have`)
@@ -13,9 +15,10 @@ func CreateHave(index int) *Message {
 	return &Message{ID: Have, Payload: payload}
 }
 
-// ParseHave transforms message `HAVE` to an integer value
+// ParseHave transforms message `HAVE` to an integer value. Piece index of
+// `suggest piece` and `allowed fast` messages is parsed the same way
 func (msg *Message) ParseHave() (int, error) {
-	if msg.ID != Have {
+	if msg.ID != Have && msg.ID != SuggestPiece && msg.ID != AllowedFast {
 		return 0, fmt.Errorf("unexpected code %d", msg.ID)
 	}
 
@@ -25,3 +28,24 @@ func (msg *Message) ParseHave() (int, error) {
 
 	return int(binary.BigEndian.Uint32(msg.Payload)), nil
 }
+
+// CreateSuggest creates a message with code 13 (`suggest piece`)
+func CreateSuggest(index int) *Message {
+	msg := CreateHave(index)
+	msg.ID = SuggestPiece
+
+	return msg
+}
+
+// CreateAllowedFast creates a message with code 17 (`allowed fast`)
+func CreateAllowedFast(index int) *Message {
+	msg := CreateHave(index)
+	msg.ID = AllowedFast
+
+	return msg
+}
+
+// CreateBitField creates a message with code 5 (`bitfield`)
+func CreateBitField(bf bitfield.BitField) *Message {
+	return &Message{ID: BitField, Payload: append([]byte{}, bf...)}
+}
@@ -29,6 +29,14 @@ func TestParseHave(t *testing.T) {
 			output:     4,
 			shouldFail: false,
 		},
+		"suggest piece": {
+			input:  CreateSuggest(7),
+			output: 7,
+		},
+		"allowed fast": {
+			input:  CreateAllowedFast(1340),
+			output: 1340,
+		},
 		"invalid message type": {
 			input:      &Message{Piece, []byte{0x00, 0x00, 0x00, 0x04}},
 			output:     0,
@@ -8,20 +8,31 @@ import (
 )
 
 const (
-	Choke         uint8 = 0 // Chokes the receiver
-	Unchoke       uint8 = 1 // Unchokes the receiver
-	Interested    uint8 = 2 // Expresses interest in receiving data
-	NotInterested uint8 = 3 // Expresses disinterest in receiving data
-	Have          uint8 = 4 // Alerts the receiver that the sender has downloaded a piece
-	BitField      uint8 = 5 // Encodes which pieces the sender has downloaded
-	Request       uint8 = 6 // Requests a block of data from the receiver
-	Piece         uint8 = 7 // Delivers a block of data to fulfill a request
-	Cancel        uint8 = 8 // Cancels a request
+	Choke         uint8 = 0  // Chokes the receiver
+	Unchoke       uint8 = 1  // Unchokes the receiver
+	Interested    uint8 = 2  // Expresses interest in receiving data
+	NotInterested uint8 = 3  // Expresses disinterest in receiving data
+	Have          uint8 = 4  // Alerts the receiver that the sender has downloaded a piece
+	BitField      uint8 = 5  // Encodes which pieces the sender has downloaded
+	Request       uint8 = 6  // Requests a block of data from the receiver
+	Piece         uint8 = 7  // Delivers a block of data to fulfill a request
+	Cancel        uint8 = 8  // Cancels a request
+	SuggestPiece  uint8 = 13 // Suggests a piece to download (BEP 6)
+	HaveAll       uint8 = 14 // Replaces bitfield of a peer having every piece (BEP 6)
+	HaveNone      uint8 = 15 // Replaces bitfield of a peer having no pieces (BEP 6)
+	RejectRequest uint8 = 16 // Tells that a request won't be fulfilled (BEP 6)
+	AllowedFast   uint8 = 17 // Allows requesting a piece while choked (BEP 6)
+	Extended      uint8 = 20 // Carries extension protocol messages (BEP 10)
 )
 
+// MaxLength limits the length of received messages so that peers can't
+// make the client allocate arbitrary amounts of memory
+const MaxLength uint32 = 1 << 20
+
 var (
 	ErrMessageEmpty   error = errors.New("failed to read empty message")
 	ErrInvalidPayload error = errors.New("failed to read message payload")
+	ErrMessageTooLong error = errors.New("message is too long")
 )
 
 // Message represents request to a peer
@@ -50,6 +61,10 @@ func Read(r io.Reader) (*Message, error) {
 		return nil, nil // keep-alive message
 	}
 
+	if length > MaxLength {
+		return nil, ErrMessageTooLong
+	}
+
 	payload := make([]byte, length)
 	if _, err := io.ReadFull(r, payload); err != nil {
 		return nil, ErrInvalidPayload
@@ -100,6 +115,18 @@ func (msg *Message) Name() string {
 		return "Piece"
 	case Cancel:
 		return "Cancel"
+	case SuggestPiece:
+		return "SuggestPiece"
+	case HaveAll:
+		return "HaveAll"
+	case HaveNone:
+		return "HaveNone"
+	case RejectRequest:
+		return "RejectRequest"
+	case AllowedFast:
+		return "AllowedFast"
+	case Extended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", msg.ID)
 	}
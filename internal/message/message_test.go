@@ -35,6 +35,11 @@ func TestRead(t *testing.T) {
 			output:     nil,
 			shouldFail: true,
 		},
+		"too long message": {
+			input:      []byte{0xff, 0xff, 0xff, 0xff, 7},
+			output:     nil,
+			shouldFail: true,
+		},
 	}
 
 	for _, test := range tests {
@@ -98,6 +103,12 @@ func TestString(t *testing.T) {
 		{&Message{Request, []byte{1, 2, 3}}, "Request [3]"},
 		{&Message{Piece, []byte{1, 2, 3}}, "Piece [3]"},
 		{&Message{Cancel, []byte{1, 2, 3}}, "Cancel [3]"},
+		{&Message{SuggestPiece, []byte{1, 2, 3}}, "SuggestPiece [3]"},
+		{&Message{HaveAll, nil}, "HaveAll [0]"},
+		{&Message{HaveNone, nil}, "HaveNone [0]"},
+		{&Message{RejectRequest, []byte{1, 2, 3}}, "RejectRequest [3]"},
+		{&Message{AllowedFast, []byte{1, 2, 3}}, "AllowedFast [3]"},
+		{&Message{Extended, []byte{1, 2, 3}}, "Extended [3]"},
 		{&Message{99, []byte{1, 2, 3}}, "Unknown#99 [3]"},
 	}
 
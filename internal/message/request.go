@@ -16,6 +16,68 @@ func CreateRequest(index, begin, length int) *Message {
 	return &Message{ID: Request, Payload: payload}
 }
 
+// CreateCancel creates a message with code 8 `cancel`
+func CreateCancel(index, begin, length int) *Message {
+	msg := CreateRequest(index, begin, length)
+	msg.ID = Cancel
+
+	return msg
+}
+
+// CreatePiece creates a message with code 7 `piece` delivering a block
+func CreatePiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	return &Message{ID: Piece, Payload: payload}
+}
+
+// CreateReject creates a message with code 16 `reject request` (BEP 6)
+func CreateReject(index, begin, length int) *Message {
+	msg := CreateRequest(index, begin, length)
+	msg.ID = RejectRequest
+
+	return msg
+}
+
+// ParseRequest returns index, offset and length of requested block from
+// `request`, `cancel` or `reject request` message
+func (msg *Message) ParseRequest() (index, begin, length int, err error) {
+	if msg.ID != Request && msg.ID != Cancel && msg.ID != RejectRequest {
+		return 0, 0, 0, fmt.Errorf("unexpected message code %d", msg.ID)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("unexpected payload size %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+	return index, begin, length, nil
+}
+
+// ParseBlock returns index, offset and data of a block delivered by
+// `piece` message without checking them against a requested piece
+func (msg *Message) ParseBlock() (index, begin int, block []byte, err error) {
+	if msg.ID != Piece {
+		return 0, 0, nil, fmt.Errorf("unexpected message code %d", msg.ID)
+	}
+
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload is smaller than 8 bytes")
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+
+	return index, begin, msg.Payload[8:], nil
+}
+
 // ParsePiece verifies incoming message and returns length of downloaded piece
 func (msg *Message) ParsePiece(index int, content []byte) (int, error) {
 	if msg.ID != Piece {
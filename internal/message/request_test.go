@@ -20,6 +20,78 @@ func TestCreateRequest(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestCreatePiece(t *testing.T) {
+	msg := CreatePiece(4, 567, []byte{0xaa, 0xbb})
+	expected := &Message{
+		ID: Piece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04, // Index
+			0x00, 0x00, 0x02, 0x37, // Begin
+			0xaa, 0xbb, // Block
+		},
+	}
+
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseRequest(t *testing.T) {
+	type testCase struct {
+		msg        *Message
+		index      int
+		begin      int
+		length     int
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"request":         {msg: CreateRequest(4, 567, 4321), index: 4, begin: 567, length: 4321},
+		"cancel":          {msg: CreateCancel(1, 16384, 16384), index: 1, begin: 16384, length: 16384},
+		"reject":          {msg: CreateReject(2, 0, 16384), index: 2, begin: 0, length: 16384},
+		"invalid code":    {msg: &Message{ID: Have, Payload: make([]byte, 12)}, shouldFail: true},
+		"invalid payload": {msg: &Message{ID: Request, Payload: make([]byte, 8)}, shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		index, begin, length, err := tc.msg.ParseRequest()
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		assert.Nil(t, err, name)
+		assert.Equal(t, []int{tc.index, tc.begin, tc.length}, []int{index, begin, length}, name)
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	type testCase struct {
+		msg        *Message
+		index      int
+		begin      int
+		block      []byte
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"block":             {msg: CreatePiece(4, 567, []byte{0xaa, 0xbb}), index: 4, begin: 567, block: []byte{0xaa, 0xbb}},
+		"empty block":       {msg: CreatePiece(1, 0, nil), index: 1, begin: 0, block: []byte{}},
+		"invalid code":      {msg: CreateRequest(4, 567, 2), shouldFail: true},
+		"too short payload": {msg: &Message{ID: Piece, Payload: make([]byte, 7)}, shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		index, begin, block, err := tc.msg.ParseBlock()
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		assert.Nil(t, err, name)
+		assert.Equal(t, []int{tc.index, tc.begin}, []int{index, begin}, name)
+		assert.Equal(t, tc.block, block, name)
+	}
+}
+
 func TestParsePiece(t *testing.T) {
 	type testCase struct {
 		msg           *Message
@@ -0,0 +1,238 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/handshake"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/mse"
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+const (
+	// BlockSize is the size of metadata pieces exchanged by peers
+	BlockSize int = 16384
+	// MaxSize limits metadata size announced by peers to avoid huge allocations
+	MaxSize int = 64 * 1024 * 1024
+	// localID is the extended message ID peers should use to send us
+	// ut_metadata messages
+	localID uint8 = 1
+)
+
+// ut_metadata message types
+const (
+	msgRequest int = 0
+	msgData    int = 1
+	msgReject  int = 2
+)
+
+// Returned when none of the peers provided valid metadata
+var ErrNoMetadata error = errors.New("failed to fetch metadata from peers")
+
+// metadataMessage is a header of ut_metadata message
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Fetch asks peers one by one for an info dictionary of the torrent with
+// given infohash via ut_metadata extension (BEP 9). Connections are
+// encrypted according to given policy. Returned dictionary is verified
+// against the infohash.
+func Fetch(candidates []peers.Peer, infoHash, peerID utils.BTString, encryption mse.Policy) ([]byte, error) {
+	for _, peer := range candidates {
+		info, err := fetchFrom(peer, infoHash, peerID, encryption)
+		if err != nil {
+			log.Printf("[ERROR] Failed to fetch metadata from %s: %s", peer.String(), err)
+			continue
+		}
+
+		log.Printf("[INFO] Received %d bytes of metadata from %s", len(info), peer.String())
+
+		return info, nil
+	}
+
+	return nil, ErrNoMetadata
+}
+
+// exchange holds state of metadata download from a single peer
+type exchange struct {
+	conn     net.Conn
+	infoHash utils.BTString
+	remoteID uint8
+	content  []byte
+	received map[int]bool
+}
+
+// fetchFrom connects to a peer advertising extension protocol support and
+// downloads metadata from it
+func fetchFrom(peer peers.Peer, infoHash, peerID utils.BTString, encryption mse.Policy) ([]byte, error) {
+	conn, err := mse.Dial(peer.Network(), peer.String(), infoHash, encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// Metadata is small, so the whole exchange should fit into this deadline
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	request := handshake.Create(infoHash, peerID)
+	request.Reserved.Enable(handshake.ExtensionProtocol)
+	if _, err := conn.Write(request.Serialize()); err != nil {
+		return nil, err
+	}
+
+	response, err := handshake.Read(conn, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Reserved.Supports(handshake.ExtensionProtocol) {
+		return nil, fmt.Errorf("peer doesn't support extension protocol")
+	}
+
+	ex := exchange{conn: conn, infoHash: infoHash, received: make(map[int]bool)}
+	hs, err := message.CreateExtendedHandshake(message.ExtendedHandshake{M: map[string]int{"ut_metadata": int(localID)}})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		return nil, err
+	}
+
+	return ex.run()
+}
+
+// run reads messages from a peer until all metadata pieces are received
+func (ex *exchange) run() ([]byte, error) {
+	for {
+		msg, err := message.Read(ex.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil || msg.ID != message.Extended || len(msg.Payload) == 0 {
+			continue
+		}
+
+		switch msg.Payload[0] {
+		case message.ExtendedHandshakeID:
+			if err := ex.handleHandshake(msg); err != nil {
+				return nil, err
+			}
+		case localID:
+			done, err := ex.handleData(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			if done {
+				return ex.content, nil
+			}
+		}
+	}
+}
+
+// handleHandshake reads metadata size and peer's ut_metadata ID from
+// extension handshake and requests all metadata pieces
+func (ex *exchange) handleHandshake(msg *message.Message) error {
+	hs, err := msg.ParseExtendedHandshake()
+	if err != nil {
+		return err
+	}
+
+	id, ok := hs.M["ut_metadata"]
+	if !ok || id <= 0 || id > 255 {
+		return fmt.Errorf("peer doesn't support ut_metadata")
+	}
+
+	if hs.MetadataSize <= 0 || hs.MetadataSize > MaxSize {
+		return fmt.Errorf("invalid metadata size %d", hs.MetadataSize)
+	}
+
+	ex.remoteID = uint8(id)
+	ex.content = make([]byte, hs.MetadataSize)
+
+	for piece := range ex.pieceCount() {
+		request := metadataMessage{MsgType: msgRequest, Piece: piece}
+		if err := ex.write(ex.remoteID, request, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleData copies received metadata piece. Returns true when all pieces
+// are received and verified
+func (ex *exchange) handleData(payload []byte) (bool, error) {
+	if ex.content == nil {
+		return false, fmt.Errorf("received metadata before extension handshake")
+	}
+
+	// Piece data follows the dictionary
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	header := metadataMessage{}
+	if err := d.Decode(&header); err != nil {
+		return false, err
+	}
+
+	switch header.MsgType {
+	case msgReject:
+		return false, fmt.Errorf("peer rejected request for metadata piece %d", header.Piece)
+	case msgData:
+	default:
+		return false, nil
+	}
+
+	begin := header.Piece * BlockSize
+	data := payload[d.Offset():]
+	if header.Piece < 0 || header.Piece >= ex.pieceCount() || begin+len(data) > len(ex.content) {
+		return false, fmt.Errorf("invalid metadata piece %d of length %d", header.Piece, len(data))
+	}
+
+	copy(ex.content[begin:], data)
+	ex.received[header.Piece] = true
+
+	if len(ex.received) < ex.pieceCount() {
+		return false, nil
+	}
+
+	if sha1.Sum(ex.content) != ex.infoHash {
+		return false, fmt.Errorf("metadata doesn't match infohash")
+	}
+
+	return true, nil
+}
+
+// pieceCount returns the number of metadata pieces
+func (ex *exchange) pieceCount() int {
+	return (len(ex.content) + BlockSize - 1) / BlockSize
+}
+
+// write sends extended message with given ID and bencoded dictionary
+// optionally followed by raw data
+func (ex *exchange) write(id uint8, dict interface{}, data []byte) error {
+	buf := bytes.NewBuffer([]byte{id})
+	if err := bencode.NewEncoder(buf).Encode(dict); err != nil {
+		return err
+	}
+
+	buf.Write(data)
+
+	msg := message.Message{ID: message.Extended, Payload: buf.Bytes()}
+	_, err := ex.conn.Write(msg.Serialize())
+
+	return err
+}
@@ -0,0 +1,145 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/handshake"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/mse"
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	// Metadata spans 3 pieces with the last one being shorter
+	info := []byte("d4:name" + "40000:" + strings.Repeat("x", 40000) + "e")
+	infoHash := utils.BTString(sha1.Sum(info))
+
+	type testCase struct {
+		peers      []peers.Peer
+		encryption mse.Policy
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"peer serves metadata": {
+			peers:      []peers.Peer{createPeer(t, infoHash, info, true, mse.Disable)},
+			encryption: mse.Disable,
+		},
+		"first peer has no extension support": {
+			peers: []peers.Peer{
+				createPeer(t, infoHash, info, false, mse.Disable),
+				createPeer(t, infoHash, info, true, mse.Disable),
+			},
+			encryption: mse.Disable,
+		},
+		"peer serves wrong metadata": {
+			peers:      []peers.Peer{createPeer(t, infoHash, []byte("d4:name4:fakee"), true, mse.Disable)},
+			encryption: mse.Disable,
+			shouldFail: true,
+		},
+		"peer serves metadata over encrypted connection": {
+			peers:      []peers.Peer{createPeer(t, infoHash, info, true, mse.Require)},
+			encryption: mse.Require,
+		},
+		"plaintext peer when encryption is required": {
+			peers:      []peers.Peer{createPeer(t, infoHash, info, true, mse.Disable)},
+			encryption: mse.Require,
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		fetched, err := Fetch(tc.peers, infoHash, utils.BTString{}, tc.encryption)
+		if tc.shouldFail {
+			assert.ErrorIs(t, err, ErrNoMetadata, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, info, fetched, name)
+		}
+	}
+}
+
+// createPeer starts a peer on localhost which serves given metadata via
+// ut_metadata if extension protocol support is enabled. Connection is
+// encrypted according to given policy.
+func createPeer(t *testing.T, infoHash utils.BTString, info []byte, extensions bool, encryption mse.Policy) peers.Peer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		if encryption != mse.Disable {
+			encrypted, err := mse.Receive(conn, []utils.BTString{infoHash}, encryption)
+			if err != nil {
+				return
+			}
+
+			conn = encrypted
+		}
+
+		if _, err := handshake.Read(conn, infoHash); err != nil {
+			return
+		}
+
+		response := handshake.Create(infoHash, utils.BTString{})
+		if extensions {
+			response.Reserved.Enable(handshake.ExtensionProtocol)
+		}
+
+		conn.Write(response.Serialize())
+		conn.Write((&message.Message{ID: message.BitField, Payload: []byte{0x00}}).Serialize())
+
+		if !extensions {
+			return
+		}
+
+		const remoteID uint8 = 3
+		ex := exchange{conn: conn}
+		hs, _ := message.CreateExtendedHandshake(message.ExtendedHandshake{
+			M:            map[string]int{"ut_metadata": int(remoteID)},
+			MetadataSize: len(info),
+		})
+		conn.Write(hs.Serialize())
+
+		for {
+			msg, err := message.Read(conn)
+			if err != nil {
+				return
+			}
+
+			if msg == nil || msg.ID != message.Extended || msg.Payload[0] != remoteID {
+				continue
+			}
+
+			request := metadataMessage{}
+			if err := bencode.Unmarshal(msg.Payload[1:], &request); err != nil {
+				return
+			}
+
+			begin := request.Piece * BlockSize
+			end := min(begin+BlockSize, len(info))
+			response := metadataMessage{MsgType: msgData, Piece: request.Piece, TotalSize: len(info)}
+
+			ex.write(localID, response, info[begin:end])
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
@@ -0,0 +1,462 @@
+// Package mse implements Message Stream Encryption, also known as protocol
+// encryption (PE). Peers agree on a shared secret with Diffie-Hellman key
+// exchange and obfuscate the connection with RC4, so that the traffic
+// doesn't look like BitTorrent to ISPs throttling it.
+//
+// The handshake is performed by [Initiate] on outgoing connections and by
+// [Receive] on incoming ones. Both return a [net.Conn] which encrypts
+// written and decrypts read data transparently. [Dial] connects to a peer
+// and initiates the handshake according to a [Policy].
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// Policy tells whether connections are encrypted
+type Policy int
+
+const (
+	Prefer  Policy = iota // Encrypts connections unless peers don't support it
+	Require               // Drops peers which don't support encryption
+	Disable               // Uses plaintext connections only
+)
+
+const (
+	// keySize is the length of public keys and shared secret in bytes
+	keySize int = 96
+	// maxPad is the largest length of random padding
+	maxPad int = 512
+	// Crypto methods offered and selected during handshake
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+	// pstr is the beginning of plaintext BitTorrent handshake
+	pstr string = "\x13BitTorrent protocol"
+)
+
+var (
+	// prime is the 768-bit modulus of Diffie-Hellman key exchange
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	// vc is the verification constant both sides encrypt to prove they
+	// derived the same keys
+	vc = make([]byte, 8)
+)
+
+var (
+	ErrPlaintext       error = errors.New("peer doesn't support encryption")
+	ErrEncrypted       error = errors.New("encrypted connections are disabled")
+	ErrUnknownTorrent  error = errors.New("peer asked for unknown torrent")
+	ErrNoCommonMethod  error = errors.New("no common crypto method")
+	ErrSyncNotFound    error = errors.New("failed to synchronize encrypted stream")
+	ErrInvalidPadding  error = errors.New("padding is too long")
+	ErrInvalidVerifier error = errors.New("invalid verification constant")
+)
+
+// ParsePolicy converts policy name to a [Policy]
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "prefer":
+		return Prefer, nil
+	case "require":
+		return Require, nil
+	case "disable":
+		return Disable, nil
+	default:
+		return Prefer, fmt.Errorf("unknown encryption policy %q", name)
+	}
+}
+
+// String returns policy name
+func (p Policy) String() string {
+	switch p {
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	case Disable:
+		return "disable"
+	default:
+		return fmt.Sprintf("Policy#%d", int(p))
+	}
+}
+
+// Conn is a connection with a peer which completed encryption handshake.
+// Data is encrypted with RC4 unless peers agreed on plaintext, then only
+// the handshake itself is obfuscated.
+type Conn struct {
+	net.Conn
+	r io.Reader
+	// mu keeps encrypted writes in order of the key stream
+	mu sync.Mutex
+	// encrypt is nil if peers agreed on plaintext
+	encrypt cipher.Stream
+}
+
+// Read reads and decrypts data from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write encrypts and writes data to the connection
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+
+	return c.Conn.Write(buf)
+}
+
+// Dial connects to a peer of the torrent with given infohash and performs
+// encryption handshake unless encryption is disabled. Peers which don't
+// support encryption are dialed again with plaintext connection unless
+// encryption is required.
+func Dial(network, address string, infoHash utils.BTString, policy Policy) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, 3*time.Second)
+	if err != nil || policy == Disable {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	encrypted, err := Initiate(conn, infoHash, policy)
+	if err == nil {
+		return encrypted, nil
+	}
+
+	conn.Close()
+	if policy == Require {
+		return nil, err
+	}
+
+	return net.DialTimeout(network, address, 3*time.Second)
+}
+
+// Initiate performs encryption handshake on an outgoing connection to a
+// peer of the torrent with given infohash. RC4 is the only method offered
+// if encryption is required, plaintext is offered too otherwise. The
+// connection is returned as is if encryption is disabled.
+func Initiate(conn net.Conn, infoHash utils.BTString, policy Policy) (net.Conn, error) {
+	if policy == Disable {
+		return conn, nil
+	}
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, padding()...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, keySize)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, err
+	}
+
+	secret := sharedSecret(private, peerPublic)
+	encrypt := newCipher("keyA", secret, infoHash[:])
+	decrypt := newCipher("keyB", secret, infoHash[:])
+
+	provide := cryptoRC4
+	if policy == Prefer {
+		provide |= cryptoPlaintext
+	}
+
+	// Header is followed by empty padding and empty initial payload
+	header := make([]byte, 16)
+	copy(header, vc)
+	binary.BigEndian.PutUint32(header[8:12], provide)
+	encrypt.XORKeyStream(header, header)
+
+	request := append(hash("req1", secret), xor(hash("req2", infoHash[:]), hash("req3", secret))...)
+	if _, err := conn.Write(append(request, header...)); err != nil {
+		return nil, err
+	}
+
+	// Peer's padding is skipped by looking for encrypted verification
+	// constant
+	encryptedVC := make([]byte, len(vc))
+	decrypt.XORKeyStream(encryptedVC, vc)
+	if err := synchronize(r, encryptedVC); err != nil {
+		return nil, err
+	}
+
+	reply, err := readEncrypted(r, decrypt, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := readPadding(r, decrypt, binary.BigEndian.Uint16(reply[4:6])); err != nil {
+		return nil, err
+	}
+
+	switch selected := binary.BigEndian.Uint32(reply[:4]); {
+	case selected == cryptoRC4:
+		return &Conn{Conn: conn, r: cipher.StreamReader{S: decrypt, R: r}, encrypt: encrypt}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &Conn{Conn: conn, r: r}, nil
+	default:
+		return nil, fmt.Errorf("peer selected unsupported crypto method %d", selected)
+	}
+}
+
+// Receive performs encryption handshake on an incoming connection. The
+// peer has to ask for one of given infohashes. Plaintext handshakes are
+// accepted unless encryption is required, encrypted ones are rejected if
+// encryption is disabled. RC4 is selected whenever the peer offers it.
+func Receive(conn net.Conn, infoHashes []utils.BTString, policy Policy) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(len(pstr))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(head) == pstr {
+		if policy == Require {
+			return nil, ErrPlaintext
+		}
+
+		return &Conn{Conn: conn, r: r}, nil
+	}
+
+	if policy == Disable {
+		return nil, ErrEncrypted
+	}
+
+	peerPublic := make([]byte, keySize)
+	if _, err := io.ReadFull(r, peerPublic); err != nil {
+		return nil, err
+	}
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(public, padding()...)); err != nil {
+		return nil, err
+	}
+
+	// Peer's padding is skipped by looking for the hash of the secret
+	secret := sharedSecret(private, peerPublic)
+	if err := synchronize(r, hash("req1", secret)); err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, err
+	}
+
+	skey, ok := findTorrent(obfuscated, secret, infoHashes)
+	if !ok {
+		return nil, ErrUnknownTorrent
+	}
+
+	decrypt := newCipher("keyA", secret, skey)
+	encrypt := newCipher("keyB", secret, skey)
+
+	header, err := readEncrypted(r, decrypt, 14)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:8], vc) {
+		return nil, ErrInvalidVerifier
+	}
+
+	if _, err := readPadding(r, decrypt, binary.BigEndian.Uint16(header[12:14])); err != nil {
+		return nil, err
+	}
+
+	length, err := readEncrypted(r, decrypt, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := readEncrypted(r, decrypt, int(binary.BigEndian.Uint16(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	provide := binary.BigEndian.Uint32(header[8:12])
+	selected, err := selectMethod(provide, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reply has no padding
+	reply := make([]byte, 14)
+	copy(reply, vc)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	encrypted := &Conn{Conn: conn, r: r}
+	if selected == cryptoRC4 {
+		encrypted.r = cipher.StreamReader{S: decrypt, R: r}
+		encrypted.encrypt = encrypt
+	}
+
+	// Initial payload is read before the rest of the stream
+	if len(payload) > 0 {
+		encrypted.r = io.MultiReader(bytes.NewReader(payload), encrypted.r)
+	}
+
+	return encrypted, nil
+}
+
+// selectMethod picks RC4 if the peer offers it, plaintext is picked only
+// if encryption isn't required
+func selectMethod(provide uint32, policy Policy) (uint32, error) {
+	switch {
+	case provide&cryptoRC4 != 0:
+		return cryptoRC4, nil
+	case provide&cryptoPlaintext != 0 && policy != Require:
+		return cryptoPlaintext, nil
+	default:
+		return 0, ErrNoCommonMethod
+	}
+}
+
+// findTorrent returns the infohash the peer asked for. The peer sends it
+// obfuscated with the shared secret, so every infohash is tried.
+func findTorrent(obfuscated, secret []byte, infoHashes []utils.BTString) ([]byte, bool) {
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(xor(hash("req2", infoHash[:]), hash("req3", secret)), obfuscated) {
+			return infoHash[:], true
+		}
+	}
+
+	return nil, false
+}
+
+// newKeys generates random private key and public key derived from it
+func newKeys() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, err
+	}
+
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return private, public.FillBytes(make([]byte, keySize)), nil
+}
+
+// sharedSecret derives the secret from own private key and peer's public
+// key. Public keys out of range produce a secret the peer can't match, so
+// the handshake fails.
+func sharedSecret(private *big.Int, peerPublic []byte) []byte {
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(peerPublic), private, prime)
+
+	return secret.FillBytes(make([]byte, keySize))
+}
+
+// newCipher creates RC4 cipher keyed with the secret and infohash. First
+// 1024 bytes of the key stream are discarded.
+func newCipher(name string, secret, skey []byte) cipher.Stream {
+	c, _ := rc4.NewCipher(hash(name, secret, skey))
+
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// padding returns random bytes of random length
+func padding() []byte {
+	pad := make([]byte, mathrand.IntN(maxPad+1))
+	rand.Read(pad)
+
+	return pad
+}
+
+// synchronize skips the stream up to the end of given pattern, which has
+// to appear within [maxPad] bytes
+func synchronize(r *bufio.Reader, pattern []byte) error {
+	window := make([]byte, 0, len(pattern)+maxPad)
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return ErrSyncNotFound
+}
+
+// readEncrypted reads and decrypts n bytes
+func readEncrypted(r io.Reader, decrypt cipher.Stream, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	decrypt.XORKeyStream(buf, buf)
+
+	return buf, nil
+}
+
+// readPadding reads encrypted padding of given length
+func readPadding(r io.Reader, decrypt cipher.Stream, length uint16) ([]byte, error) {
+	if int(length) > maxPad {
+		return nil, ErrInvalidPadding
+	}
+
+	return readEncrypted(r, decrypt, int(length))
+}
+
+// hash returns SHA-1 hash of a name followed by given values
+func hash(name string, values ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(name))
+	for _, value := range values {
+		h.Write(value)
+	}
+
+	return h.Sum(nil)
+}
+
+// xor returns bytes of a xored with bytes of b
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
@@ -0,0 +1,166 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	type testCase struct {
+		dialer     Policy
+		listener   Policy
+		encrypted  bool
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"both prefer":                  {dialer: Prefer, listener: Prefer, encrypted: true},
+		"both require":                 {dialer: Require, listener: Require, encrypted: true},
+		"dialer requires":              {dialer: Require, listener: Prefer, encrypted: true},
+		"listener requires":            {dialer: Prefer, listener: Require, encrypted: true},
+		"plaintext dialer":             {dialer: Disable, listener: Prefer},
+		"plaintext dialer rejected":    {dialer: Disable, listener: Require, shouldFail: true},
+		"encrypted dialer rejected":    {dialer: Prefer, listener: Disable, shouldFail: true},
+		"plaintext on both sides":      {dialer: Disable, listener: Disable},
+		"required encryption rejected": {dialer: Require, listener: Disable, shouldFail: true},
+	}
+
+	infoHash := utils.BTString{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	other := utils.BTString{20, 19, 18}
+
+	for name, tc := range tt {
+		local, remote := pair(t)
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := Receive(remote, []utils.BTString{other, infoHash}, tc.listener)
+			if err != nil {
+				remote.Close()
+			}
+
+			accepted <- conn
+		}()
+
+		// Plaintext handshake passes through unchanged. It's written right
+		// away since the listener tells plaintext peers by it
+		message := append([]byte(pstr), bytes.Repeat([]byte{0xab}, 100)...)
+		reply := []byte("reply from the listener")
+
+		conn, err := Initiate(local, infoHash, tc.dialer)
+		if err == nil {
+			go conn.Write(message)
+		}
+
+		peer := <-accepted
+		if tc.shouldFail {
+			assert.True(t, err != nil || peer == nil, name)
+			local.Close()
+			continue
+		}
+
+		require.Nil(t, err, name)
+		require.NotNil(t, peer, name)
+
+		received := make([]byte, len(message))
+		_, err = io.ReadFull(peer, received)
+		require.Nil(t, err, name)
+		assert.Equal(t, message, received, name)
+
+		go func() {
+			peer.Write(reply)
+		}()
+
+		received = make([]byte, len(reply))
+		_, err = io.ReadFull(conn, received)
+		require.Nil(t, err, name)
+		assert.Equal(t, reply, received, name)
+
+		encrypted, ok := conn.(*Conn)
+		assert.Equal(t, tc.encrypted, ok && encrypted.encrypt != nil, name)
+
+		conn.Close()
+		peer.Close()
+	}
+}
+
+func TestHandshakeUnknownTorrent(t *testing.T) {
+	local, remote := pair(t)
+	defer local.Close()
+
+	go func() {
+		Receive(remote, []utils.BTString{{1}}, Prefer)
+		remote.Close()
+	}()
+
+	_, err := Initiate(local, utils.BTString{2}, Require)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedStream(t *testing.T) {
+	local, remote := pair(t)
+
+	// Data on the wire is observed through the raw connection
+	raw := make(chan []byte, 1)
+	go func() {
+		conn, err := Receive(remote, []utils.BTString{{7}}, Require)
+		if err != nil {
+			raw <- nil
+			return
+		}
+
+		encrypted := conn.(*Conn)
+		buf := make([]byte, len(pstr))
+		io.ReadFull(encrypted.Conn, buf)
+		raw <- buf
+	}()
+
+	conn, err := Initiate(local, utils.BTString{7}, Require)
+	require.Nil(t, err)
+
+	_, err = conn.Write([]byte(pstr))
+	require.Nil(t, err)
+	assert.NotEqual(t, []byte(pstr), <-raw)
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{Prefer, Require, Disable} {
+		parsed, err := ParsePolicy(policy.String())
+		require.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+
+	_, err := ParsePolicy("always")
+	assert.NotNil(t, err)
+}
+
+// pair returns both ends of a loopback TCP connection
+func pair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	local, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+
+	remote := <-accepted
+	require.NotNil(t, remote)
+
+	deadline := time.Now().Add(5 * time.Second)
+	local.SetDeadline(deadline)
+	remote.SetDeadline(deadline)
+
+	return local, remote
+}
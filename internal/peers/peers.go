@@ -5,15 +5,32 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+
+	"github.com/sauromates/leech/internal/utils"
 )
 
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	// ID is known only for peers received in non-compact form
+	ID utils.BTString
 }
 
+// Unmarshal parses compact IPv4 peers list where each peer takes 6 bytes
 func Unmarshal(raw []byte) ([]Peer, error) {
-	const size int = 6 // 4 for IP, 2 for port
+	return unmarshal(raw, net.IPv4len)
+}
+
+// Unmarshal6 parses compact IPv6 peers list (BEP 7) where each peer
+// takes 18 bytes
+func Unmarshal6(raw []byte) ([]Peer, error) {
+	return unmarshal(raw, net.IPv6len)
+}
+
+// unmarshal splits compact peers list into IP addresses of given length
+// each followed by 2 bytes of port
+func unmarshal(raw []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
 	if len(raw)%size != 0 {
 		return nil, fmt.Errorf("received malformed peers data of length %d", len(raw))
 	}
@@ -23,13 +40,34 @@ func Unmarshal(raw []byte) ([]Peer, error) {
 	for i := range count {
 		offset := i * size
 
-		peers[i].IP = net.IP(raw[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(raw[offset+4 : offset+6]))
+		peers[i].IP = net.IP(raw[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(raw[offset+ipLen : offset+size]))
 	}
 
 	return peers, nil
 }
 
+// Marshal encodes the peer in compact form: 4 or 16 bytes of IP address
+// depending on its family followed by 2 bytes of port
+func (p *Peer) Marshal() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), p.Port)
+}
+
+// Network returns network name to dial the peer with. IPv4-mapped IPv6
+// addresses are dialed over IPv4.
+func (p *Peer) Network() string {
+	if p.IP.To4() != nil {
+		return "tcp4"
+	}
+
+	return "tcp6"
+}
+
 func (p *Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
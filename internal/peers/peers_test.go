@@ -42,9 +42,87 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshal6(t *testing.T) {
+	type testCase struct {
+		input      []byte
+		output     []Peer
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"valid peers string": {
+			input: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb,
+			},
+			output: []Peer{
+				{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+				{IP: net.IPv6loopback, Port: 443},
+			},
+			shouldFail: false,
+		},
+		"compact IPv4 string": {
+			input:      []byte{127, 0, 0, 1, 0x00, 0x50, 1, 1, 1, 1, 0x01, 0xbb},
+			output:     nil,
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tt {
+		peers, err := Unmarshal6(tc.input)
+		if tc.shouldFail {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+
+		assert.Equal(t, tc.output, peers)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	type testCase struct {
+		peer    Peer
+		network string
+	}
+
+	tt := map[string]testCase{
+		"IPv4":        {Peer{IP: net.IP{127, 0, 0, 1}}, "tcp4"},
+		"mapped IPv4": {Peer{IP: net.ParseIP("::ffff:127.0.0.1")}, "tcp4"},
+		"IPv6":        {Peer{IP: net.IPv6loopback}, "tcp6"},
+	}
+
+	for name, tc := range tt {
+		assert.Equal(t, tc.network, tc.peer.Network(), name)
+	}
+}
+
 func TestString(t *testing.T) {
 	peer := &Peer{IP: net.IP{127, 0, 0, 1}, Port: 8080}
 	expected := "127.0.0.1:8080"
 
 	assert.Equal(t, expected, peer.String())
+
+	peer = &Peer{IP: net.IPv6loopback, Port: 8080}
+	assert.Equal(t, "[::1]:8080", peer.String())
+}
+
+func TestMarshal(t *testing.T) {
+	type testCase struct {
+		peer   Peer
+		output []byte
+	}
+
+	tt := map[string]testCase{
+		"IPv4":        {Peer{IP: net.IP{127, 0, 0, 1}, Port: 80}, []byte{127, 0, 0, 1, 0x00, 0x50}},
+		"mapped IPv4": {Peer{IP: net.ParseIP("::ffff:1.1.1.1"), Port: 443}, []byte{1, 1, 1, 1, 0x01, 0xbb}},
+		"IPv6": {
+			Peer{IP: net.IPv6loopback, Port: 6881},
+			[]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE1},
+		},
+	}
+
+	for name, tc := range tt {
+		assert.Equal(t, tc.output, tc.peer.Marshal(), name)
+	}
 }
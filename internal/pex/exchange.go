@@ -0,0 +1,222 @@
+package pex
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/peers"
+)
+
+// Name is the name of peer exchange extension in extension handshake
+const Name string = "ut_pex"
+
+// maxPeers limits the number of added and dropped peers in one message
+const maxPeers int = 50
+
+// Interval is the minimal time between messages sent to a peer. It's
+// a variable so that tests can shorten it.
+var Interval = time.Minute
+
+// Exchange implements peer exchange (BEP 11) on top of extension protocol.
+// It advertises peers the client is connected to and collects peers
+// advertised by others.
+type Exchange struct {
+	mu sync.Mutex
+	// connected are peers the client is currently connected to with flags
+	// they are advertised with
+	connected map[string]AddedPeer
+	// listening are listen addresses of incoming connections by remote
+	// address
+	listening map[string]peers.Peer
+	// states hold what was advertised to each peer supporting the extension
+	states map[string]*state
+	found  chan []peers.Peer
+}
+
+// state tracks messages sent to a single peer
+type state struct {
+	sent       time.Time
+	advertised map[string]peers.Peer
+}
+
+// New creates peer exchange without connected peers
+func New() *Exchange {
+	return &Exchange{
+		connected: make(map[string]AddedPeer),
+		listening: make(map[string]peers.Peer),
+		states:    make(map[string]*state),
+		found:     make(chan []peers.Peer, 16),
+	}
+}
+
+// Found returns a channel of peers received from other peers
+func (e *Exchange) Found() <-chan []peers.Peer {
+	return e.found
+}
+
+// Add registers an established outgoing connection with a peer. The peer
+// is advertised as reachable since the client could connect to it.
+func (e *Exchange) Add(peer peers.Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.connected[peer.String()] = AddedPeer{Peer: peer, Flags: FlagReachable}
+}
+
+// AddIncoming registers an incoming connection from remote address of a
+// peer which told it accepts connections on listen address. Remote port of
+// incoming connections is useless for others, so the listen address is
+// advertised instead, without reachable flag since nobody connected to it.
+func (e *Exchange) AddIncoming(remote, listen peers.Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.listening[remote.String()] = listen
+	if _, ok := e.connected[listen.String()]; !ok {
+		e.connected[listen.String()] = AddedPeer{Peer: listen}
+	}
+}
+
+// Drop registers a closed connection with a peer. Incoming connections are
+// dropped by their remote address.
+func (e *Exchange) Drop(peer peers.Peer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.connected, peer.String())
+	delete(e.states, peer.String())
+
+	listen, ok := e.listening[peer.String()]
+	if !ok {
+		return
+	}
+
+	delete(e.listening, peer.String())
+
+	// Outgoing connection to the same address keeps it advertised
+	if added := e.connected[listen.String()]; added.Flags&FlagReachable == 0 {
+		delete(e.connected, listen.String())
+	}
+}
+
+// Name implements [client.Extension]
+func (e *Exchange) Name() string {
+	return Name
+}
+
+// Connected sends the list of all connected peers to a new peer
+func (e *Exchange) Connected(c *client.Client) error {
+	e.mu.Lock()
+	e.states[c.Peer.String()] = &state{advertised: make(map[string]peers.Peer)}
+	e.mu.Unlock()
+
+	return e.send(c)
+}
+
+// HandleMessage passes peers added by the remote peer to [Exchange.Found]
+// channel. Peers are dropped if nobody reads the channel.
+func (e *Exchange) HandleMessage(c *client.Client, payload []byte) error {
+	msg, err := Decode(payload)
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Added) == 0 {
+		return nil
+	}
+
+	added := make([]peers.Peer, len(msg.Added))
+	for i, peer := range msg.Added {
+		added[i] = peer.Peer
+	}
+
+	log.Printf("[INFO] Received %d peers from %s via PEX", len(added), c.Peer.String())
+
+	select {
+	case e.found <- added:
+	default:
+	}
+
+	return nil
+}
+
+// Tick implements [client.PeriodicExtension] sending changes in the list
+// of connected peers at most once per [Interval]
+func (e *Exchange) Tick(c *client.Client) error {
+	e.mu.Lock()
+	s, ok := e.states[c.Peer.String()]
+	due := ok && time.Since(s.sent) >= Interval
+	e.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+
+	return e.send(c)
+}
+
+// send advertises peers connected and disconnected since the previous
+// message to the peer
+func (e *Exchange) send(c *client.Client) error {
+	msg := e.diff(c.Peer)
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+
+	payload, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	return c.WriteExtended(Name, payload)
+}
+
+// diff builds a message with changes not advertised to the peer yet and
+// marks them as advertised
+func (e *Exchange) diff(to peers.Peer) *Message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	msg := Message{}
+
+	s, ok := e.states[to.String()]
+	if !ok {
+		return &msg
+	}
+
+	s.sent = time.Now()
+
+	// Peers aren't told about themselves
+	self := to.String()
+	if listen, ok := e.listening[self]; ok {
+		self = listen.String()
+	}
+
+	for key, added := range e.connected {
+		if len(msg.Added) == maxPeers {
+			break
+		}
+
+		if _, known := s.advertised[key]; known || key == to.String() || key == self {
+			continue
+		}
+
+		msg.Added = append(msg.Added, added)
+		s.advertised[key] = added.Peer
+	}
+
+	for key, peer := range s.advertised {
+		if len(msg.Dropped) == maxPeers {
+			break
+		}
+
+		if _, connected := e.connected[key]; !connected {
+			msg.Dropped = append(msg.Dropped, peer)
+			delete(s.advertised, key)
+		}
+	}
+
+	return &msg
+}
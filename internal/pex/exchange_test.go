@@ -0,0 +1,140 @@
+package pex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeAdvertisesPeers(t *testing.T) {
+	Interval = 50 * time.Millisecond
+	defer func() { Interval = time.Minute }()
+
+	first := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	second := peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+
+	e := New()
+	e.Add(first)
+	e.Add(second)
+
+	c, server := createClient(t, first)
+
+	// Initial message lists all connected peers except the receiver
+	require.Nil(t, e.Connected(c))
+	msg := readMessage(t, server)
+	assert.Equal(t, []AddedPeer{{second, FlagReachable}}, msg.Added)
+	assert.Empty(t, msg.Dropped)
+
+	e.Drop(second)
+
+	// Changes are sent only after the interval passes
+	require.Nil(t, e.Tick(c))
+	time.Sleep(Interval)
+	require.Nil(t, e.Tick(c))
+
+	msg = readMessage(t, server)
+	assert.Empty(t, msg.Added)
+	assert.Equal(t, []peers.Peer{second}, msg.Dropped)
+}
+
+func TestExchangeAdvertisesIncomingPeers(t *testing.T) {
+	Interval = 50 * time.Millisecond
+	defer func() { Interval = time.Minute }()
+
+	remote := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 50123}
+	listen := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	other := peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+
+	e := New()
+	e.AddIncoming(remote, listen)
+	e.Add(other)
+
+	// Incoming peer is advertised by listen port and isn't reachable
+	c, server := createClient(t, other)
+	require.Nil(t, e.Connected(c))
+	msg := readMessage(t, server)
+	assert.Equal(t, []AddedPeer{{Peer: listen}}, msg.Added)
+
+	// Incoming peer isn't told about itself
+	incoming, incomingServer := createClient(t, remote)
+	require.Nil(t, e.Connected(incoming))
+	msg = readMessage(t, incomingServer)
+	assert.Equal(t, []AddedPeer{{other, FlagReachable}}, msg.Added)
+
+	// Incoming connection is dropped by remote address
+	e.Drop(remote)
+	time.Sleep(Interval)
+	require.Nil(t, e.Tick(c))
+
+	msg = readMessage(t, server)
+	assert.Equal(t, []peers.Peer{listen}, msg.Dropped)
+}
+
+func TestExchangeCollectsPeers(t *testing.T) {
+	e := New()
+	c, _ := createClient(t, peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881})
+	added := []peers.Peer{{IP: net.IP{10, 0, 0, 2}, Port: 6882}}
+
+	payload, err := (&Message{Added: []AddedPeer{{added[0], FlagSeed}}}).Encode()
+	require.Nil(t, err)
+	require.Nil(t, e.HandleMessage(c, payload))
+
+	select {
+	case found := <-e.Found():
+		assert.Equal(t, added, found)
+	default:
+		t.Error("received peers weren't passed to the channel")
+	}
+
+	assert.NotNil(t, e.HandleMessage(c, []byte("i1e")))
+}
+
+// createClient connects a client supporting ut_pex to a local server
+func createClient(t *testing.T, peer peers.Peer) (*client.Client, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+
+	server, err := listener.Accept()
+	require.Nil(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+
+	c := client.Client{
+		Conn:           conn,
+		Peer:           peer,
+		PeerExtensions: &message.ExtendedHandshake{M: map[string]int{Name: 3}},
+	}
+
+	return &c, server
+}
+
+// readMessage reads PEX message sent by the client
+func readMessage(t *testing.T, conn net.Conn) *Message {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	raw, err := message.Read(conn)
+	require.Nil(t, err)
+
+	id, payload, err := raw.ParseExtended()
+	require.Nil(t, err)
+	require.Equal(t, uint8(3), id)
+
+	msg, err := Decode(payload)
+	require.Nil(t, err)
+
+	return msg
+}
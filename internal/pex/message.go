@@ -0,0 +1,116 @@
+package pex
+
+import (
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/peers"
+)
+
+// Flag describes an added peer
+type Flag byte
+
+// Flags of added peers
+const (
+	FlagEncryption Flag = 0x01
+	FlagSeed       Flag = 0x02
+	FlagUTP        Flag = 0x04
+	FlagHolepunch  Flag = 0x08
+	FlagReachable  Flag = 0x10
+)
+
+// AddedPeer is a peer announced in a PEX message with its flags
+type AddedPeer struct {
+	peers.Peer
+	Flags Flag
+}
+
+// Message is a list of peers connected to and disconnected from the
+// sender since its previous message
+type Message struct {
+	Added   []AddedPeer
+	Dropped []peers.Peer
+}
+
+// bencodeMessage is a PEX message payload with compact IPv4 and IPv6
+// peer lists
+type bencodeMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// Decode parses PEX message payload. Flags missing for some peers are
+// treated as zero.
+func Decode(payload []byte) (*Message, error) {
+	raw := bencodeMessage{}
+	if err := bencode.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+
+	msg := Message{}
+
+	added, err := peers.Unmarshal([]byte(raw.Added))
+	if err != nil {
+		return nil, err
+	}
+
+	added6, err := peers.Unmarshal6([]byte(raw.Added6))
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Added = append(withFlags(added, raw.AddedF), withFlags(added6, raw.Added6F)...)
+
+	dropped, err := peers.Unmarshal([]byte(raw.Dropped))
+	if err != nil {
+		return nil, err
+	}
+
+	dropped6, err := peers.Unmarshal6([]byte(raw.Dropped6))
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Dropped = append(dropped, dropped6...)
+
+	return &msg, nil
+}
+
+// Encode serializes the message into PEX message payload
+func (msg *Message) Encode() ([]byte, error) {
+	raw := bencodeMessage{}
+	for _, peer := range msg.Added {
+		if peer.IP.To4() != nil {
+			raw.Added += string(peer.Marshal())
+			raw.AddedF += string([]byte{byte(peer.Flags)})
+		} else {
+			raw.Added6 += string(peer.Marshal())
+			raw.Added6F += string([]byte{byte(peer.Flags)})
+		}
+	}
+
+	for _, peer := range msg.Dropped {
+		if peer.IP.To4() != nil {
+			raw.Dropped += string(peer.Marshal())
+		} else {
+			raw.Dropped6 += string(peer.Marshal())
+		}
+	}
+
+	return bencode.Marshal(raw)
+}
+
+// withFlags pairs peers with flags from a string of one byte per peer
+func withFlags(list []peers.Peer, flags string) []AddedPeer {
+	added := make([]AddedPeer, len(list))
+	for i, peer := range list {
+		added[i].Peer = peer
+		if i < len(flags) {
+			added[i].Flags = Flag(flags[i])
+		}
+	}
+
+	return added
+}
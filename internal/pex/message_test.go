@@ -0,0 +1,76 @@
+package pex
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	type testCase struct {
+		input      string
+		output     *Message
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"IPv4 and IPv6 peers": {
+			input: "d5:added12:" + string([]byte{10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE2}) +
+				"7:added.f1:" + string([]byte{0x12}) +
+				"6:added618:" + string(net.IPv6loopback) + string([]byte{0x1A, 0xE1}) +
+				"8:added6.f1:" + string([]byte{0x01}) +
+				"7:dropped6:" + string([]byte{10, 0, 0, 3, 0x1A, 0xE3}) + "e",
+			output: &Message{
+				Added: []AddedPeer{
+					{peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}, FlagSeed | FlagReachable},
+					{peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6882}, 0},
+					{peers.Peer{IP: net.IPv6loopback, Port: 6881}, FlagEncryption},
+				},
+				Dropped: []peers.Peer{{IP: net.IP{10, 0, 0, 3}, Port: 6883}},
+			},
+		},
+		"empty message": {
+			input:  "de",
+			output: &Message{Added: []AddedPeer{}, Dropped: []peers.Peer{}},
+		},
+		"malformed peers": {
+			input:      "d5:added5:abcdee",
+			shouldFail: true,
+		},
+		"not a dictionary": {
+			input:      "i1e",
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		msg, err := Decode([]byte(tc.input))
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			assert.Equal(t, tc.output, msg, name)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	msg := Message{
+		Added: []AddedPeer{
+			{peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}, FlagReachable},
+			{peers.Peer{IP: net.IPv6loopback, Port: 6881}, FlagSeed},
+		},
+		Dropped: []peers.Peer{{IP: net.IPv6loopback, Port: 6882}},
+	}
+
+	payload, err := msg.Encode()
+	require.Nil(t, err)
+
+	decoded, err := Decode(payload)
+	require.Nil(t, err)
+	assert.Equal(t, msg.Added, decoded.Added)
+	assert.Equal(t, msg.Dropped, decoded.Dropped)
+}
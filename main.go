@@ -1,42 +1,350 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/sauromates/leech/internal/dht"
+	"github.com/sauromates/leech/internal/mse"
 	"github.com/sauromates/leech/torrent"
 	"github.com/sauromates/leech/torrentfile"
 )
 
+// dhtStatePath is a file keeping DHT routing table between runs
+const dhtStatePath string = "leech.dht"
+
 func main() {
+	port := flag.Uint("port", uint(torrent.DefaultPort), "port for incoming peer connections and DHT")
+	seed := flag.Bool("seed", true, "keep uploading to peers after download completes")
+	files := flag.String("files", "", "comma-separated zero-based indices or glob patterns of files to download (default is all)")
+	encryption := flag.String("encryption", "prefer", "peer connection encryption: prefer, require or disable")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "verify":
+		os.Exit(verify(flag.Args()[1:]))
+	case "create":
+		os.Exit(create(flag.Args()[1:]))
+	}
+
 	if err := configureLogs("leech.log"); err != nil {
 		log.Fatal(err)
 	}
 
-	inputPath := os.Args[1]
-	torrentfile, err := torrentfile.Open(inputPath)
-	if err != nil {
+	if err := run(flag.Arg(0), uint16(*port), *seed, *files, *encryption); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// run downloads a torrent file or magnet link and seeds it afterwards if
+// asked to. Peer server and DHT node are closed before it returns.
+func run(inputPath string, port uint16, seed bool, files, encryption string) error {
+	policy, err := mse.ParsePolicy(encryption)
+	if err != nil {
+		return err
+	}
+
+	server := startServer(port, policy)
+	defer closeServer(server)
+
+	node, sources := startDHT(port)
+	defer closeDHT(node)
+
+	torrentfile, err := openTorrentFile(inputPath, port, policy, sources)
+	if err != nil {
+		return err
+	}
 
 	dir, err := createDownloadDir(torrentfile.Name)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	torrent, err := torrent.CreateFromTorrentFile(torrentfile)
+	torrent, err := torrent.CreateFromTorrentFile(torrentfile, port, sources...)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	torrent.Encryption = policy
+
+	if files != "" {
+		if err := selectFiles(torrent, files); err != nil {
+			return err
+		}
+	}
+
+	closeOnInterrupt(torrent, server, node)
+
+	if server != nil {
+		server.Add(torrent)
 	}
 
 	fmt.Printf("Downloading\n---\n%s\n", torrent)
 
 	if err := torrent.Download(dir); err != nil {
-		log.Fatal(err)
+		torrent.Close()
+		return err
 	}
 
 	printResultDetails(dir)
+
+	if seed && server != nil {
+		fmt.Printf("---\nSeeding on port %d, press Ctrl+C to stop\n", server.Port())
+		torrent.Seed()
+
+		// Interrupt handler stops seeding and exits
+		select {}
+	}
+
+	if err := torrent.Close(); err != nil {
+		log.Printf("[ERROR] Failed to announce stop: %s", err)
+	}
+
+	return nil
+}
+
+// usage prints supported commands and flags
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n")
+	fmt.Fprintf(out, "  leech [flags] <torrent file or magnet link>\n")
+	fmt.Fprintf(out, "  leech verify <torrent file> <directory>\n")
+	fmt.Fprintf(out, "  leech create [create flags] <file or directory>\n")
+	fmt.Fprintf(out, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+// verify checks downloaded files against a torrent and returns exit code,
+// which is non-zero if the files don't match
+func verify(args []string) int {
+	if len(args) != 2 {
+		usage()
+		return 2
+	}
+
+	tf, err := torrentfile.Open(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	report := torrent.Verify(tf, args[1])
+
+	fmt.Printf("Verifying %s\n---\n%s:\n", tf.Name, args[1])
+	for _, file := range report.Files {
+		switch {
+		case file.Missing():
+			fmt.Printf("    %s: missing\n", file.Path)
+		case file.WrongSize():
+			fmt.Printf("    %s: %.2f%%, size %d instead of %d\n", file.Path, file.Completion(), file.ActualSize, file.Size)
+		default:
+			fmt.Printf("    %s: %.2f%%\n", file.Path, file.Completion())
+		}
+	}
+
+	if len(report.Corrupt) > 0 {
+		fmt.Printf("---\nCorrupt pieces: %v\n", report.Corrupt)
+	}
+
+	if !report.OK() {
+		fmt.Println("---\nFiles don't match the torrent")
+		return 1
+	}
+
+	fmt.Println("---\nAll files match the torrent")
+
+	return 0
+}
+
+// listFlag collects values of a flag given multiple times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// create writes a torrent of a file or directory and returns exit code
+func create(args []string) int {
+	var trackers, webSeeds listFlag
+
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	flags.Var(&trackers, "tracker", "tracker URL, may be repeated to add tiers; comma-separated URLs share a tier")
+	flags.Var(&webSeeds, "webseed", "web seed URL, may be repeated")
+	output := flags.String("o", "", "output path (default is <name>.torrent)")
+	comment := flags.String("comment", "", "torrent comment")
+	private := flags.Bool("private", false, "restrict peers to the ones from trackers")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes (default is picked by size)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		usage()
+		return 2
+	}
+
+	tiers := make([][]string, 0, len(trackers))
+	for _, tier := range trackers {
+		tiers = append(tiers, strings.Split(tier, ","))
+	}
+
+	input := flags.Arg(0)
+	path := *output
+	if path == "" {
+		path = filepath.Base(filepath.Clean(input)) + ".torrent"
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	defer file.Close()
+
+	fmt.Printf("Hashing %s\n", input)
+
+	tf, err := torrentfile.Create(input, file, torrentfile.CreateOptions{
+		AnnounceList: tiers,
+		Comment:      *comment,
+		CreatedBy:    "leech",
+		CreationDate: time.Now(),
+		Private:      *private,
+		WebSeeds:     webSeeds,
+		PieceLength:  *pieceLength,
+	})
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		fmt.Println(err)
+
+		return 1
+	}
+
+	fmt.Printf("---\nCreated %s\nInfoHash: %x\nPieces: %d\n", path, tf.InfoHash, len(tf.PieceHashes))
+
+	return 0
+}
+
+// selectFiles skips files not matching the selector and prints the ones
+// which will be downloaded
+func selectFiles(t *torrent.Torrent, selector string) error {
+	if err := t.SelectFiles(strings.Split(selector, ",")...); err != nil {
+		return err
+	}
+
+	fmt.Printf("Selected files\n---\n")
+	for index, file := range t.Files {
+		if t.Priority(index) != torrent.PrioritySkip {
+			fmt.Printf("    %d: %s\n", index, file.Path)
+		}
+	}
+
+	return nil
+}
+
+// closeOnInterrupt closes the torrent, peer server and DHT node and exits
+// when the process is interrupted so that trackers learn the client has
+// left the swarm
+func closeOnInterrupt(torrent *torrent.Torrent, server *torrent.Server, node *dht.DHT) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-interrupt
+		torrent.Close()
+		closeServer(server)
+		closeDHT(node)
+		os.Exit(1)
+	}()
+}
+
+// startServer starts accepting connections from peers on given port.
+// Without it the client still downloads but can't upload anything
+func startServer(port uint16, encryption mse.Policy) *torrent.Server {
+	server, err := torrent.Listen(port, encryption)
+	if err != nil {
+		log.Printf("[ERROR] Failed to accept peer connections: %s", err)
+		return nil
+	}
+
+	return server
+}
+
+// closeServer closes connections of all inbound peers
+func closeServer(server *torrent.Server) {
+	if server == nil {
+		return
+	}
+
+	if err := server.Close(); err != nil {
+		log.Printf("[ERROR] Failed to stop peer server: %s", err)
+	}
+}
+
+// startDHT starts a DHT node to find peers without trackers. DHT is
+// optional, so the client proceeds without it if the node fails to start.
+// The node uses the same port number as the one announced for incoming TCP
+// connections
+func startDHT(port uint16) (*dht.DHT, []torrent.PeerSource) {
+	node, err := dht.Create(dht.Config{
+		Addr:           fmt.Sprintf(":%d", port),
+		BootstrapNodes: dht.DefaultBootstrapNodes,
+		StatePath:      dhtStatePath,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to start DHT: %s", err)
+		return nil, nil
+	}
+
+	return node, []torrent.PeerSource{node}
+}
+
+// closeDHT stops DHT node saving its routing table
+func closeDHT(node *dht.DHT) {
+	if node == nil {
+		return
+	}
+
+	if err := node.Close(); err != nil {
+		log.Printf("[ERROR] Failed to save DHT state: %s", err)
+	}
+}
+
+// openTorrentFile decodes a .torrent file from given path or resolves
+// torrent metadata from a magnet link using connections encrypted
+// according to given policy
+func openTorrentFile(input string, port uint16, encryption mse.Policy, sources []torrent.PeerSource) (torrentfile.TorrentFile, error) {
+	if !strings.HasPrefix(input, "magnet:") {
+		return torrentfile.Open(input)
+	}
+
+	link, err := torrentfile.ParseMagnet(input)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+
+	fmt.Printf("Fetching metadata for %x %s\n", link.InfoHash, link.Name)
+
+	return torrent.ResolveMagnet(link, port, encryption, sources...)
 }
 
 // configureLogs sets default log output to a file with given path
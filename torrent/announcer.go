@@ -0,0 +1,235 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/sauromates/leech/torrentfile"
+)
+
+const (
+	// defaultInterval is used when trackers don't specify announce interval
+	defaultInterval time.Duration = 30 * time.Minute
+	// retryInterval is used after all trackers failed to answer
+	retryInterval time.Duration = time.Minute
+)
+
+// PeerSource finds peers of a torrent besides its trackers, e.g. DHT
+type PeerSource interface {
+	// Announce returns peers of the torrent and tells the source that the
+	// client accepts connections on given port
+	Announce(infoHash utils.BTString, port uint16) ([]peers.Peer, error)
+}
+
+// announcer keeps the torrent announced to its trackers and other peer
+// sources and pulls fresh peers from them as often as trackers allow
+type announcer struct {
+	tracker *torrentfile.TorrentFile
+	sources []PeerSource
+	// exchanged are peers received from other peers, e.g. via PEX
+	exchanged <-chan []peers.Peer
+	interval  time.Duration
+	known     map[string]bool
+	// unstarted is set while no tracker acknowledged started event, which
+	// is then sent again instead of regular announces
+	unstarted bool
+	// mu serializes announces made from background loop and lifecycle events
+	// and guards known peers
+	mu sync.Mutex
+	// loop guards channels of background announces, which are nil while
+	// announcer isn't running
+	loop sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newAnnouncer creates an announcer for trackers of given torrent file
+// and additional peer sources
+func newAnnouncer(tf *torrentfile.TorrentFile, sources ...PeerSource) *announcer {
+	return &announcer{
+		tracker:  tf,
+		sources:  sources,
+		interval: retryInterval,
+		known:    make(map[string]bool),
+	}
+}
+
+// announce requests peers from trackers and other sources and returns the
+// ones which weren't received before. It also schedules the next announce
+// according to the intervals from tracker response. Failed trackers are
+// tolerated as long as other sources found peers.
+func (a *announcer) announce(req torrentfile.AnnounceRequest) ([]peers.Peer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if req.Event == torrentfile.EventNone && a.unstarted {
+		req.Event = torrentfile.EventStarted
+	}
+
+	var found []peers.Peer
+	var sourceErr error
+	sourcesDone := make(chan struct{})
+	go func() {
+		defer close(sourcesDone)
+		found, sourceErr = a.announceSources(req)
+	}()
+
+	result, err := a.tracker.RequestPeers(req)
+	<-sourcesDone
+
+	if req.Event == torrentfile.EventStarted {
+		a.unstarted = err != nil
+	}
+
+	switch {
+	case err == nil:
+		a.interval = max(result.Interval, result.MinInterval)
+		found = append(result.Peers, found...)
+	case len(found) > 0:
+		// Trackers are retried soon even though other sources found peers
+		log.Printf("[ERROR] Trackers failed, using peers from other sources: %s", err)
+		a.interval = retryInterval
+	default:
+		a.interval = retryInterval
+		return nil, errors.Join(err, sourceErr)
+	}
+
+	if a.interval == 0 {
+		a.interval = defaultInterval
+	}
+
+	return a.filter(found), nil
+}
+
+// nextInterval returns the delay before the next announce
+func (a *announcer) nextInterval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.interval
+}
+
+// filter returns peers which weren't received before. Caller must hold
+// the mutex.
+func (a *announcer) filter(found []peers.Peer) []peers.Peer {
+	fresh := make([]peers.Peer, 0, len(found))
+	for _, peer := range found {
+		if !a.known[peer.String()] {
+			a.known[peer.String()] = true
+			fresh = append(fresh, peer)
+		}
+	}
+
+	return fresh
+}
+
+// announceSources concurrently announces to peer sources when the client
+// needs peers. Completed and stopped events aren't sent to sources.
+func (a *announcer) announceSources(req torrentfile.AnnounceRequest) ([]peers.Peer, error) {
+	if req.Event != torrentfile.EventNone && req.Event != torrentfile.EventStarted {
+		return nil, nil
+	}
+
+	found := make([][]peers.Peer, len(a.sources))
+	errs := make([]error, len(a.sources))
+
+	var wg sync.WaitGroup
+	for i, source := range a.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found[i], errs[i] = source.Announce(a.tracker.InfoHash, req.Port)
+		}()
+	}
+
+	wg.Wait()
+
+	var merged []peers.Peer
+	for _, peers := range found {
+		merged = append(merged, peers...)
+	}
+
+	return merged, errors.Join(errs...)
+}
+
+// start launches background announces which push fresh peers into the
+// pool. Nil pool keeps the torrent announced without collecting peers,
+// which is enough for seeding. Announcer may be started again after close.
+func (a *announcer) start(torrent *Torrent, pool chan *peers.Peer) {
+	a.loop.Lock()
+	defer a.loop.Unlock()
+
+	if a.stop != nil {
+		return
+	}
+
+	a.stop, a.done = make(chan struct{}), make(chan struct{})
+	go a.run(torrent, pool, a.stop, a.done)
+}
+
+// run re-announces the torrent in background until announcer is closed.
+// Fresh peers from announces and exchanged peers are pushed into the pool
+// of connections.
+func (a *announcer) run(torrent *Torrent, pool chan *peers.Peer, stop, done chan struct{}) {
+	defer close(done)
+
+	exchanged := a.exchanged
+	if pool == nil {
+		exchanged = nil
+	}
+
+	next := time.After(a.nextInterval())
+	for {
+		var fresh []peers.Peer
+		select {
+		case <-stop:
+			return
+		case exchanged := <-exchanged:
+			a.mu.Lock()
+			fresh = a.filter(exchanged)
+			a.mu.Unlock()
+		case <-next:
+			var err error
+			fresh, err = a.announce(torrent.announceRequest(torrentfile.EventNone))
+			interval := a.nextInterval()
+			next = time.After(interval)
+			if err != nil {
+				log.Printf("[ERROR] Announce failed, retrying in %s: %s", interval, err)
+				continue
+			}
+
+			log.Printf("[INFO] Received %d new peers, next announce in %s", len(fresh), interval)
+		}
+
+		if pool == nil {
+			continue
+		}
+
+		for _, peer := range fresh {
+			select {
+			case pool <- &peer:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// close stops background announces and waits until the loop exits.
+// It's safe to call it multiple times.
+func (a *announcer) close() {
+	a.loop.Lock()
+	defer a.loop.Unlock()
+
+	if a.stop == nil {
+		return
+	}
+
+	close(a.stop)
+	<-a.done
+	a.stop, a.done = nil, nil
+}
@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/pex"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/sauromates/leech/torrentfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounce(t *testing.T) {
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		return "d8:intervali900e12:min intervali1800e5:peers12:" + string([]byte{
+			192, 0, 2, 123, 0x1A, 0xE1,
+			127, 0, 0, 1, 0x1A, 0xE9,
+		}) + "e"
+	})
+	a := newAnnouncer(tf)
+
+	fresh, err := a.announce(torrentfile.AnnounceRequest{})
+
+	require.Nil(t, err)
+	assert.Len(t, fresh, 2)
+	assert.Equal(t, 1800*time.Second, a.interval)
+
+	fresh, err = a.announce(torrentfile.AnnounceRequest{})
+
+	require.Nil(t, err)
+	assert.Empty(t, fresh)
+}
+
+func TestAnnouncerRun(t *testing.T) {
+	var lastQuery atomic.Value
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		lastQuery.Store(req.URL.Query())
+
+		return "d8:intervali900e5:peers6:" + string([]byte{10, 0, 0, byte(announces), 0x1A, 0xE1}) + "e"
+	})
+
+	torrent := fakeTorrent(50, 100, nil)
+	torrent.downloaded, torrent.uploaded, torrent.left = 50, 25, 50
+
+	a := newAnnouncer(tf)
+	a.interval = 10 * time.Millisecond
+
+	pool := make(chan *peers.Peer)
+	a.start(&torrent, pool)
+
+	select {
+	case peer := <-pool:
+		assert.Equal(t, net.IP{10, 0, 0, 1}, peer.IP)
+	case <-time.After(time.Second):
+		t.Error("announcer didn't push new peer into the pool")
+	}
+
+	a.close()
+
+	query := lastQuery.Load().(url.Values)
+	assert.Equal(t, []string{"50"}, query["downloaded"])
+	assert.Equal(t, []string{"25"}, query["uploaded"])
+	assert.Equal(t, []string{"50"}, query["left"])
+	assert.Empty(t, query["event"])
+	assert.Equal(t, 900*time.Second, a.interval)
+}
+
+func TestAnnounceLifecycleEvents(t *testing.T) {
+	events := make(chan url.Values, 2)
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		events <- req.URL.Query()
+
+		return "d8:intervali900e10:tracker id3:abc5:peers0:e"
+	})
+
+	torrent := fakeTorrent(50, 100, nil)
+	torrent.announcer = newAnnouncer(tf)
+	torrent.announceKey = 0xdeadbeef
+
+	_, err := torrent.announcer.announce(torrent.announceRequest(torrentfile.EventCompleted))
+	require.Nil(t, err)
+
+	query := <-events
+	assert.Equal(t, "completed", query.Get("event"))
+	assert.Equal(t, "deadbeef", query.Get("key"))
+	assert.Equal(t, "50", query.Get("numwant"))
+	assert.Empty(t, query.Get("trackerid"))
+
+	require.Nil(t, torrent.Close())
+
+	query = <-events
+	assert.Equal(t, "stopped", query.Get("event"))
+	assert.Equal(t, "abc", query.Get("trackerid"))
+	assert.Empty(t, query.Get("numwant"))
+}
+
+func TestAnnounceWithPeerSources(t *testing.T) {
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		return "d14:failure reason4:downe"
+	})
+	source := &fakePeerSource{peers: []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}}
+	a := newAnnouncer(tf, source)
+
+	fresh, err := a.announce(torrentfile.AnnounceRequest{Port: 6882, Event: torrentfile.EventStarted})
+
+	require.Nil(t, err)
+	assert.Equal(t, source.peers, fresh)
+	assert.Equal(t, retryInterval, a.interval, "failed trackers are retried soon")
+	assert.Equal(t, uint16(6882), source.port)
+
+	_, err = a.announce(torrentfile.AnnounceRequest{Event: torrentfile.EventStopped})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, source.announces, "stopped event isn't sent to sources")
+}
+
+func TestPrivateTorrentIgnoresPeerSources(t *testing.T) {
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		return "d8:intervali900e5:peers6:" + string([]byte{10, 0, 0, 2, 0x1A, 0xE1}) + "e"
+	})
+	tf.Private = true
+	source := &fakePeerSource{peers: []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}}
+
+	torrent, err := CreateFromTorrentFile(*tf, 6882, source)
+
+	require.Nil(t, err)
+	assert.True(t, torrent.Private)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{10, 0, 0, 2}, Port: 6881}}, torrent.Peers)
+	assert.Zero(t, source.announces)
+	assert.NotContains(t, torrent.extensions.Handshake().M, pex.Name)
+}
+
+func TestAnnouncerForwardsExchangedPeers(t *testing.T) {
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		return "d8:intervali900e5:peers0:e"
+	})
+
+	torrent := fakeTorrent(50, 100, nil)
+	exchanged := make(chan []peers.Peer, 2)
+	peer := peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+
+	a := newAnnouncer(tf)
+	a.exchanged = exchanged
+	a.interval = time.Hour
+
+	// The same peer advertised twice is pushed into the pool once
+	exchanged <- []peers.Peer{peer}
+	exchanged <- []peers.Peer{peer}
+
+	pool := make(chan *peers.Peer, 2)
+	a.start(&torrent, pool)
+
+	select {
+	case received := <-pool:
+		assert.Equal(t, peer, *received)
+	case <-time.After(time.Second):
+		t.Error("announcer didn't push exchanged peer into the pool")
+	}
+
+	assert.Eventually(t, func() bool { return len(exchanged) == 0 }, time.Second, time.Millisecond)
+	a.close()
+	assert.Empty(t, pool)
+}
+
+func TestAnnounceRepeatsStartedEvent(t *testing.T) {
+	events := make(chan string, 3)
+	tf := fakeTrackerFile(t, func(announces int, req *http.Request) string {
+		events <- req.URL.Query().Get("event")
+		if announces == 1 {
+			return "d14:failure reason4:downe"
+		}
+
+		return "d8:intervali900e5:peers6:" + string([]byte{10, 0, 0, 2, 0x1A, 0xE1}) + "e"
+	})
+	source := &fakePeerSource{peers: []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}}
+	a := newAnnouncer(tf, source)
+
+	for _, event := range []torrentfile.AnnounceEvent{torrentfile.EventStarted, torrentfile.EventNone, torrentfile.EventNone} {
+		_, err := a.announce(torrentfile.AnnounceRequest{Event: event})
+		require.Nil(t, err)
+	}
+
+	assert.Equal(t, "started", <-events)
+	assert.Equal(t, "started", <-events, "started event is repeated until a tracker answers")
+	assert.Equal(t, "", <-events)
+}
+
+// fakePeerSource returns the same peers on every announce
+type fakePeerSource struct {
+	peers     []peers.Peer
+	port      uint16
+	announces int
+}
+
+func (s *fakePeerSource) Announce(infoHash utils.BTString, port uint16) ([]peers.Peer, error) {
+	s.port = port
+	s.announces++
+
+	return s.peers, nil
+}
+
+// fakeTrackerFile creates a torrent file with HTTP tracker stand-in which
+// replies with the result of a handler. Handler receives the number of
+// announces made so far.
+func fakeTrackerFile(t *testing.T, handler func(announces int, req *http.Request) string) *torrentfile.TorrentFile {
+	var announces atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(handler(int(announces.Add(1)), req)))
+	}))
+
+	t.Cleanup(server.Close)
+
+	length := 100
+
+	return &torrentfile.TorrentFile{Announce: server.URL, Length: &length}
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// uploadSlots is the number of peers unchoked at once including the
+	// optimistic unchoke
+	uploadSlots int = 4
+	// chokeInterval is how often upload slots are reassigned
+	chokeInterval time.Duration = 10 * time.Second
+	// optimisticRounds is the number of choke rounds between optimistic
+	// unchoke rotations, i.e. every 30 seconds
+	optimisticRounds int = 3
+)
+
+// chokable is a connection which may be choked by [choker]
+type chokable interface {
+	// isInterested tells whether the peer wants to download from the client
+	isInterested() bool
+	// uploaded is the total of bytes sent to the peer
+	uploaded() int64
+	// downloaded is the total of bytes of blocks received from the peer
+	downloaded() int64
+	// setChoked chokes or unchokes the peer
+	setChoked(choked bool)
+}
+
+// chokeState holds choker's view of a connection
+type chokeState struct {
+	unchoked     bool
+	lastUploaded int64
+	lastReceived int64
+}
+
+// choker implements tit-for-tat: upload slots go to the peers the client
+// downloads from fastest, or to the peers downloading fastest while
+// seeding, plus one optimistic unchoke rotating between the rest so that
+// new peers get a chance to prove themselves.
+type choker struct {
+	mu         sync.Mutex
+	seeding    func() bool
+	peers      map[chokable]*chokeState
+	optimistic chokable
+	round      int
+	// stop ends rechoke loop. Nil while there are no peers
+	stop chan struct{}
+}
+
+// newChoker creates a choker which ranks peers by upload rate when
+// seeding returns true
+func newChoker(seeding func() bool) *choker {
+	return &choker{
+		seeding: seeding,
+		peers:   make(map[chokable]*chokeState),
+	}
+}
+
+// add starts managing the connection. Peers begin choked.
+func (c *choker) add(p chokable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peers[p] = &chokeState{lastUploaded: p.uploaded(), lastReceived: p.downloaded()}
+	if c.stop == nil {
+		c.stop = make(chan struct{})
+		go c.run(c.stop)
+	}
+}
+
+// remove stops managing closed connection
+func (c *choker) remove(p chokable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.peers, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+
+	if len(c.peers) == 0 && c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// interested unchokes newly interested peer right away if there is a free
+// slot instead of making it wait for the next round
+func (c *choker) interested(p chokable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.peers[p]
+	if !ok || state.unchoked || !p.isInterested() {
+		return
+	}
+
+	unchoked := 0
+	for _, s := range c.peers {
+		if s.unchoked {
+			unchoked++
+		}
+	}
+
+	if unchoked < uploadSlots {
+		state.unchoked = true
+		p.setChoked(false)
+	}
+}
+
+// run reassigns upload slots periodically until stop is closed
+func (c *choker) run(stop chan struct{}) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.rechoke()
+		}
+	}
+}
+
+// rechoke unchokes interested peers with the best rates since the previous
+// round and the optimistic unchoke and chokes everyone else
+func (c *choker) rechoke() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seeding := c.seeding()
+	rates := make(map[chokable]int64, len(c.peers))
+	candidates := make([]chokable, 0, len(c.peers))
+	for p, state := range c.peers {
+		uploaded, received := p.uploaded(), p.downloaded()
+		if seeding {
+			rates[p] = uploaded - state.lastUploaded
+		} else {
+			rates[p] = received - state.lastReceived
+		}
+
+		state.lastUploaded, state.lastReceived = uploaded, received
+		if p.isInterested() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	// Current optimistic unchoke keeps its slot until rotation
+	rotate := c.round%optimisticRounds == 0 || !slices.Contains(candidates, c.optimistic)
+	if !rotate {
+		candidates = slices.DeleteFunc(candidates, func(p chokable) bool { return p == c.optimistic })
+	}
+
+	// Shuffling breaks ties between equally fast peers randomly
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	slices.SortStableFunc(candidates, func(a, b chokable) int {
+		return cmp.Compare(rates[b], rates[a])
+	})
+
+	regular := candidates[:min(len(candidates), uploadSlots-1)]
+	if rotate {
+		c.optimistic = nil
+		if rest := candidates[len(regular):]; len(rest) > 0 {
+			c.optimistic = rest[rand.IntN(len(rest))]
+		}
+	}
+
+	c.round++
+
+	for p, state := range c.peers {
+		unchoked := p == c.optimistic || slices.Contains(regular, p)
+		if unchoked != state.unchoked {
+			state.unchoked = unchoked
+			p.setChoked(!unchoked)
+		}
+	}
+}
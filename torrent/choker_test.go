@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePeer records choke state set by the choker
+type fakePeer struct {
+	interested bool
+	sent       int64
+	received   int64
+	choked     bool
+}
+
+func (p *fakePeer) isInterested() bool {
+	return p.interested
+}
+
+func (p *fakePeer) uploaded() int64 {
+	return p.sent
+}
+
+func (p *fakePeer) downloaded() int64 {
+	return p.received
+}
+
+func (p *fakePeer) setChoked(choked bool) {
+	p.choked = choked
+}
+
+func TestRechoke(t *testing.T) {
+	type testCase struct {
+		seeding bool
+		// fastest are the peers expected to get regular slots
+		fastest []int
+	}
+
+	tt := map[string]testCase{
+		"downloading ranks by download rate": {seeding: false, fastest: []int{5, 4, 3}},
+		"seeding ranks by upload rate":       {seeding: true, fastest: []int{0, 1, 2}},
+	}
+
+	for name, tc := range tt {
+		c := newChoker(func() bool { return tc.seeding })
+		peers := fakePeers(c, 7)
+		for i, p := range peers {
+			p.sent = int64(100 - i)
+			p.received = int64(i)
+		}
+
+		// Uninterested peers never get a slot
+		peers[6].interested = false
+
+		c.rechoke()
+
+		for _, i := range tc.fastest {
+			assert.False(t, peers[i].choked, "%s: peer %d", name, i)
+		}
+
+		assert.True(t, peers[6].choked, name)
+		assert.Equal(t, uploadSlots, countUnchoked(peers), name)
+		assert.NotContains(t, tc.fastest, c.optimistic, name)
+	}
+}
+
+func TestOptimisticUnchokeRotation(t *testing.T) {
+	c := newChoker(func() bool { return false })
+	fakePeers(c, 10)
+
+	c.rechoke()
+	optimistic := c.optimistic
+	assert.NotNil(t, optimistic)
+
+	// Optimistic unchoke is kept for several rounds
+	for range optimisticRounds - 1 {
+		c.rechoke()
+		assert.Same(t, optimistic, c.optimistic)
+	}
+
+	// Removed optimistic unchoke is replaced in the next round
+	c.remove(optimistic)
+	c.rechoke()
+	assert.NotNil(t, c.optimistic)
+	assert.NotSame(t, optimistic, c.optimistic)
+}
+
+func TestInterestedUsesFreeSlots(t *testing.T) {
+	c := newChoker(func() bool { return false })
+	peers := fakePeers(c, uploadSlots+1)
+
+	for _, p := range peers {
+		c.interested(p)
+	}
+
+	assert.Equal(t, uploadSlots, countUnchoked(peers))
+	assert.True(t, peers[uploadSlots].choked)
+}
+
+// fakePeers adds given number of interested peers to the choker
+func fakePeers(c *choker, count int) []*fakePeer {
+	peers := make([]*fakePeer, count)
+	for i := range peers {
+		peers[i] = &fakePeer{interested: true, choked: true}
+		c.add(peers[i])
+	}
+
+	return peers
+}
+
+// countUnchoked returns the number of unchoked peers
+func countUnchoked(peers []*fakePeer) int {
+	count := 0
+	for _, p := range peers {
+		if !p.choked {
+			count++
+		}
+	}
+
+	return count
+}
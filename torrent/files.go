@@ -0,0 +1,149 @@
+package torrent
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// Priority tells whether and how soon a file is downloaded. Pieces of
+// files with higher priority are requested first.
+type Priority int
+
+const (
+	PrioritySkip   Priority = iota // File isn't downloaded
+	PriorityLow                    // Downloaded after everything else
+	PriorityNormal                 // Default priority of every file
+	PriorityHigh                   // Downloaded before everything else
+)
+
+// Priority returns download priority of the file with given index
+func (torrent *Torrent) Priority(index int) Priority {
+	if index < 0 || index >= len(torrent.Files) {
+		return PrioritySkip
+	}
+
+	return torrent.filePriority(torrent.Files[index].Path)
+}
+
+// SetPriority changes download priority of the file with given index. It
+// has to be called before [Torrent.Download].
+func (torrent *Torrent) SetPriority(index int, priority Priority) error {
+	if index < 0 || index >= len(torrent.Files) {
+		return fmt.Errorf("torrent has no file %d", index)
+	}
+
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	if torrent.priorities == nil {
+		torrent.priorities = make(map[string]Priority, len(torrent.Files))
+	}
+
+	torrent.priorities[torrent.Files[index].Path] = priority
+
+	return nil
+}
+
+// SelectFiles skips every file except the ones matching given selectors.
+// A selector is either a zero-based file index or a glob pattern matched
+// against file's path or name.
+func (torrent *Torrent) SelectFiles(selectors ...string) error {
+	selected := make(map[int]bool, len(torrent.Files))
+	for _, selector := range selectors {
+		if index, err := strconv.Atoi(selector); err == nil {
+			if index < 0 || index >= len(torrent.Files) {
+				return fmt.Errorf("torrent has no file %d", index)
+			}
+
+			selected[index] = true
+			continue
+		}
+
+		matched := false
+		for index, file := range torrent.Files {
+			byPath, err := filepath.Match(selector, file.Path)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", selector, err)
+			}
+
+			byName, _ := filepath.Match(selector, filepath.Base(file.Path))
+			if byPath || byName {
+				selected[index] = true
+				matched = true
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("no files match %q", selector)
+		}
+	}
+
+	for index := range torrent.Files {
+		if !selected[index] {
+			torrent.SetPriority(index, PrioritySkip)
+		} else if torrent.Priority(index) == PrioritySkip {
+			torrent.SetPriority(index, PriorityNormal)
+		}
+	}
+
+	return nil
+}
+
+// filePriority returns priority of the file with given path
+func (torrent *Torrent) filePriority(path string) Priority {
+	if priority, ok := torrent.priorities[path]; ok {
+		return priority
+	}
+
+	return PriorityNormal
+}
+
+// piecePriority returns the highest priority of the files the piece
+// belongs to, so that pieces shared with skipped files are still
+// downloaded for the wanted ones
+func (torrent *Torrent) piecePriority(index int) Priority {
+	files, err := torrent.whichFiles(index)
+	if err != nil {
+		return PrioritySkip
+	}
+
+	priority := PrioritySkip
+	for path := range files {
+		priority = max(priority, torrent.filePriority(path))
+	}
+
+	return priority
+}
+
+// wantedPieces returns indices of pieces of wanted files ordered by
+// priority, pieces of the same priority ordered by index
+func (torrent *Torrent) wantedPieces() []int {
+	priorities := make([]Priority, len(torrent.PieceHashes))
+	wanted := make([]int, 0, len(torrent.PieceHashes))
+	for index := range torrent.PieceHashes {
+		priorities[index] = torrent.piecePriority(index)
+		if priorities[index] != PrioritySkip {
+			wanted = append(wanted, index)
+		}
+	}
+
+	slices.SortStableFunc(wanted, func(a, b int) int {
+		return cmp.Compare(priorities[b], priorities[a])
+	})
+
+	return wanted
+}
+
+// wantedLength returns total size of given pieces in bytes
+func (torrent *Torrent) wantedLength(pieces []int) int {
+	length := 0
+	for _, index := range pieces {
+		length += torrent.pieceSize(index)
+	}
+
+	return length
+}
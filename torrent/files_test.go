@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/sauromates/leech/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectFiles(t *testing.T) {
+	type testCase struct {
+		selectors  []string
+		output     []Priority
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"index": {
+			selectors: []string{"1"},
+			output:    []Priority{PrioritySkip, PriorityNormal, PrioritySkip},
+		},
+		"pattern by name": {
+			selectors: []string{"*.srt"},
+			output:    []Priority{PrioritySkip, PriorityNormal, PriorityNormal},
+		},
+		"pattern by path": {
+			selectors: []string{"movie/*.mkv", "2"},
+			output:    []Priority{PriorityNormal, PrioritySkip, PriorityNormal},
+		},
+		"index out of range":  {selectors: []string{"3"}, shouldFail: true},
+		"unmatched pattern":   {selectors: []string{"*.txt"}, shouldFail: true},
+		"malformed pattern":   {selectors: []string{"[a"}, shouldFail: true},
+		"negative file index": {selectors: []string{"-1"}, shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		torrent := fakeTorrent(20, 60, []utils.PathInfo{
+			{Path: filepath.Join("movie", "movie.mkv"), Offset: 0, Length: 40},
+			{Path: filepath.Join("movie", "en.srt"), Offset: 40, Length: 50},
+			{Path: filepath.Join("subs", "de.srt"), Offset: 50, Length: 60},
+		})
+
+		err := torrent.SelectFiles(tc.selectors...)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		require.Nil(t, err, name)
+		for index, priority := range tc.output {
+			assert.Equal(t, priority, torrent.Priority(index), name)
+		}
+	}
+}
+
+func TestWantedPieces(t *testing.T) {
+	type testCase struct {
+		priorities []Priority
+		output     []int
+	}
+
+	tt := map[string]testCase{
+		"all files": {
+			priorities: []Priority{PriorityNormal, PriorityNormal, PriorityNormal},
+			output:     []int{0, 1, 2, 3},
+		},
+		"boundary pieces of skipped files": {
+			priorities: []Priority{PrioritySkip, PriorityNormal, PrioritySkip},
+			output:     []int{1, 2},
+		},
+		"high priority first": {
+			priorities: []Priority{PriorityLow, PriorityNormal, PriorityHigh},
+			output:     []int{2, 3, 1, 0},
+		},
+		"nothing wanted": {
+			priorities: []Priority{PrioritySkip, PrioritySkip, PrioritySkip},
+			output:     []int{},
+		},
+	}
+
+	for name, tc := range tt {
+		// Pieces: 0 is in a, 1 is shared by a and b, 2 by b and c, 3 is in c
+		torrent := fakeTorrent(10, 40, []utils.PathInfo{
+			{Path: "a", Offset: 0, Length: 15},
+			{Path: "b", Offset: 15, Length: 25},
+			{Path: "c", Offset: 25, Length: 40},
+		})
+		torrent.PieceHashes = make([]utils.BTString, 4)
+
+		for index, priority := range tc.priorities {
+			require.Nil(t, torrent.SetPriority(index, priority), name)
+		}
+
+		assert.Equal(t, tc.output, torrent.wantedPieces(), name)
+	}
+
+	torrent := fakeTorrent(10, 10, []utils.PathInfo{{Path: "a", Offset: 0, Length: 10}})
+	assert.NotNil(t, torrent.SetPriority(1, PriorityHigh))
+	assert.NotNil(t, torrent.SetPriority(0, PriorityHigh+1))
+}
+
+func TestWriteSkippedFiles(t *testing.T) {
+	type testCase struct {
+		existing bool
+		written  int
+		sizes    map[string]int64
+	}
+
+	tt := map[string]testCase{
+		"missing skipped file is not created": {
+			written: 15,
+			sizes:   map[string]int64{"a": 10, "c": 5},
+		},
+		"existing skipped file is written": {
+			existing: true,
+			written:  20,
+			sizes:    map[string]int64{"a": 10, "b": 5, "c": 5},
+		},
+	}
+
+	for name, tc := range tt {
+		// The piece spans three files, the one in the middle is skipped
+		torrent := fakeTorrent(20, 40, []utils.PathInfo{
+			{Path: "a", Offset: 0, Length: 10},
+			{Path: "b", Offset: 10, Length: 15},
+			{Path: "c", Offset: 15, Length: 40},
+		})
+		torrent.DownloadDir = t.TempDir()
+		require.Nil(t, torrent.SetPriority(1, PrioritySkip), name)
+
+		if tc.existing {
+			require.Nil(t, os.WriteFile(filepath.Join(torrent.DownloadDir, "b"), nil, 0644), name)
+		}
+
+		content := make([]byte, 20)
+		rand.Read(content)
+
+		n, err := torrent.write(&worker.PieceContent{Index: 0, Content: content}, nil)
+		require.Nil(t, err, name)
+		assert.Equal(t, tc.written, n, name)
+
+		for _, path := range []string{"a", "b", "c"} {
+			info, err := os.Stat(filepath.Join(torrent.DownloadDir, path))
+			size, ok := tc.sizes[path]
+			if !ok {
+				assert.NotNil(t, err, name)
+				continue
+			}
+
+			require.Nil(t, err, name)
+			assert.Equal(t, size, info.Size(), name)
+		}
+
+		c, err := os.ReadFile(filepath.Join(torrent.DownloadDir, "c"))
+		require.Nil(t, err, name)
+		assert.Equal(t, content[15:], c, name)
+	}
+}
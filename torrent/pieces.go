@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sauromates/leech/internal/bitfield"
+)
+
+// pieceSet tracks pieces the client has. It's shared by the download loop
+// and upload sessions.
+type pieceSet struct {
+	mu       sync.RWMutex
+	bitField bitfield.BitField
+}
+
+// newPieceSet creates an empty set for given number of pieces
+func newPieceSet(count int) *pieceSet {
+	return &pieceSet{bitField: make(bitfield.BitField, (count+7)/8)}
+}
+
+// add marks the piece as available
+func (s *pieceSet) add(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bitField.SetPiece(index)
+}
+
+// has tells whether the piece is available
+func (s *pieceSet) has(index int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.bitField.HasPiece(index)
+}
+
+// snapshot returns a copy of the bitfield
+func (s *pieceSet) snapshot() bitfield.BitField {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append(bitfield.BitField{}, s.bitField...)
+}
+
+// storage implements [worker.Storage] with pieces of the torrent written
+// to disk
+type storage struct {
+	torrent *Torrent
+}
+
+// Pieces implements [worker.Storage]
+func (s storage) Pieces() bitfield.BitField {
+	return s.torrent.pieces.snapshot()
+}
+
+// ReadBlock implements [worker.Storage]
+func (s storage) ReadBlock(index, begin, length int) ([]byte, error) {
+	if err := s.torrent.validateRequest(index, begin, length); err != nil {
+		return nil, err
+	}
+
+	return s.torrent.readBlock(index, begin, length)
+}
+
+// Uploaded implements [worker.Storage]
+func (s storage) Uploaded(n int) {
+	atomic.AddInt64(&s.torrent.uploaded, int64(n))
+}
+
+// validateRequest checks that requested block lies within a piece the
+// client has
+func (torrent *Torrent) validateRequest(index, begin, length int) error {
+	if index < 0 || index >= len(torrent.PieceHashes) || !torrent.pieces.has(index) {
+		return fmt.Errorf("requested missing piece %d", index)
+	}
+
+	if length <= 0 || length > maxBlockLength || begin < 0 || begin+length > torrent.pieceSize(index) {
+		return fmt.Errorf("requested invalid block %d:%d of length %d", index, begin, length)
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/sauromates/leech/internal/peers"
+)
+
+// resumeSuffix is appended to download directory path to get the path of
+// fast-resume file, so that it's kept next to the download
+const resumeSuffix string = ".resume"
+
+// bencodeResume is the content of fast-resume file
+type bencodeResume struct {
+	InfoHash   string       `bencode:"info-hash"`
+	Pieces     string       `bencode:"pieces"`
+	Files      []resumeFile `bencode:"files"`
+	Peers      string       `bencode:"peers"`
+	Peers6     string       `bencode:"peers6"`
+	Uploaded   int64        `bencode:"uploaded"`
+	Downloaded int64        `bencode:"downloaded"`
+}
+
+// resumeFile is the size and modification time of a downloaded file. Data
+// of changed files can't be trusted without hashing.
+type resumeFile struct {
+	Path  string `bencode:"path"`
+	Size  int64  `bencode:"size"`
+	MTime int64  `bencode:"mtime"`
+}
+
+// resume keeps fast-resume state of a download up to date
+type resume struct {
+	path  string
+	files map[string]resumeFile
+	peers map[string]peers.Peer
+}
+
+// newResume collects current state of torrent's files and peers
+func (torrent *Torrent) newResume() *resume {
+	r := resume{
+		path:  torrent.DownloadDir + resumeSuffix,
+		files: make(map[string]resumeFile, len(torrent.Files)),
+		peers: make(map[string]peers.Peer),
+	}
+
+	for _, file := range torrent.Files {
+		r.files[file.Path] = torrent.statFile(file.Path)
+	}
+
+	for _, peer := range torrent.Peers {
+		r.addPeer(peer)
+	}
+
+	return &r
+}
+
+// addPeer remembers a peer to connect to after restart
+func (r *resume) addPeer(peer peers.Peer) {
+	r.peers[peer.String()] = peer
+}
+
+// update refreshes state of the files the piece was written to
+func (r *resume) update(torrent *Torrent, index int) {
+	begin, end := torrent.pieceBounds(index)
+	for _, file := range torrent.Files {
+		if begin < file.Length && file.Offset < end {
+			r.files[file.Path] = torrent.statFile(file.Path)
+		}
+	}
+}
+
+// save writes fast-resume file
+func (r *resume) save(torrent *Torrent) error {
+	saved := bencodeResume{
+		InfoHash:   string(torrent.InfoHash[:]),
+		Pieces:     string(torrent.pieces.snapshot()),
+		Files:      make([]resumeFile, 0, len(torrent.Files)),
+		Uploaded:   atomic.LoadInt64(&torrent.uploaded),
+		Downloaded: atomic.LoadInt64(&torrent.downloaded),
+	}
+
+	for _, file := range torrent.Files {
+		saved.Files = append(saved.Files, r.files[file.Path])
+	}
+
+	for _, peer := range r.peers {
+		if peer.IP.To4() != nil {
+			saved.Peers += string(peer.Marshal())
+		} else {
+			saved.Peers6 += string(peer.Marshal())
+		}
+	}
+
+	data, err := bencode.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Write into a temporary file first so that a crash doesn't leave
+	// truncated state behind
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.path)
+}
+
+// loadResume restores completed pieces, transfer totals and known peers
+// from fast-resume file. Nil pieces are returned when the file is missing
+// or files on disk changed since it was saved, so they have to be hashed.
+func (torrent *Torrent) loadResume() (map[int]bool, error) {
+	path := torrent.DownloadDir + resumeSuffix
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	saved := bencodeResume{}
+	if err := bencode.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+
+	if saved.InfoHash != string(torrent.InfoHash[:]) {
+		return nil, fmt.Errorf("%s belongs to another torrent", path)
+	}
+
+	if len(saved.Pieces) != (len(torrent.PieceHashes)+7)/8 {
+		return nil, fmt.Errorf("invalid pieces bitfield in %s", path)
+	}
+
+	if len(saved.Files) != len(torrent.Files) {
+		return nil, nil
+	}
+
+	for i, file := range torrent.Files {
+		if saved.Files[i] != torrent.statFile(file.Path) {
+			log.Printf("[INFO] %s changed since resume data was saved", file.Path)
+			return nil, nil
+		}
+	}
+
+	known, err := peers.Unmarshal([]byte(saved.Peers))
+	if err != nil {
+		return nil, err
+	}
+
+	known6, err := peers.Unmarshal6([]byte(saved.Peers6))
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.Peers = mergePeers(torrent.Peers, append(known, known6...))
+	atomic.StoreInt64(&torrent.uploaded, saved.Uploaded)
+	atomic.StoreInt64(&torrent.downloaded, saved.Downloaded)
+
+	done := make(map[int]bool)
+	have := bitfield.BitField(saved.Pieces)
+	for index := range torrent.PieceHashes {
+		if have.HasPiece(index) {
+			done[index] = true
+		}
+	}
+
+	return done, nil
+}
+
+// statFile returns current size and modification time of a file. Missing
+// files have negative size.
+func (torrent *Torrent) statFile(path string) resumeFile {
+	info, err := os.Stat(filepath.Join(torrent.DownloadDir, path))
+	if err != nil {
+		return resumeFile{Path: path, Size: -1}
+	}
+
+	return resumeFile{Path: path, Size: info.Size(), MTime: info.ModTime().UnixNano()}
+}
+
+// mergePeers appends peers which aren't in the list yet
+func mergePeers(list []peers.Peer, extra []peers.Peer) []peers.Peer {
+	known := make(map[string]bool, len(list))
+	for _, peer := range list {
+		known[peer.String()] = true
+	}
+
+	for _, peer := range extra {
+		if !known[peer.String()] {
+			known[peer.String()] = true
+			list = append(list, peer)
+		}
+	}
+
+	return list
+}
+
+// checkPieces hashes pieces already present in download directory and
+// returns indexes of the ones matching torrent's piece hashes. Missing or
+// truncated files simply make their pieces invalid.
+func (torrent *Torrent) checkPieces() map[int]bool {
+	valid := make(map[int]bool)
+
+	var mu sync.Mutex
+	torrent.forEachPiece(func(index int) {
+		if !torrent.verifyPiece(index) {
+			return
+		}
+
+		mu.Lock()
+		valid[index] = true
+		mu.Unlock()
+	})
+
+	return valid
+}
+
+// forEachPiece calls given function for every piece index using all CPUs
+// since hashing is the bottleneck
+func (torrent *Torrent) forEachPiece(fn func(index int)) {
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				fn(index)
+			}
+		}()
+	}
+
+	for index := range torrent.PieceHashes {
+		indexes <- index
+	}
+
+	close(indexes)
+	wg.Wait()
+}
+
+// verifyPiece reads the piece from disk and compares its hash sum
+func (torrent *Torrent) verifyPiece(index int) bool {
+	content, err := torrent.readBlock(index, 0, torrent.pieceSize(index))
+	if err != nil {
+		return false
+	}
+
+	hash := sha1.Sum(content)
+
+	return bytes.Equal(hash[:], torrent.PieceHashes[index][:])
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPieces(t *testing.T) {
+	type testCase struct {
+		prepare func(torrent *Torrent)
+		valid   map[int]bool
+	}
+
+	tt := map[string]testCase{
+		"complete files": {
+			prepare: func(torrent *Torrent) {},
+			valid:   map[int]bool{0: true, 1: true, 2: true},
+		},
+		"corrupt piece": {
+			prepare: func(torrent *Torrent) { torrent.PieceHashes[1] = utils.BTString{} },
+			valid:   map[int]bool{0: true, 2: true},
+		},
+		"missing file": {
+			prepare: func(torrent *Torrent) { os.Remove(filepath.Join(torrent.DownloadDir, "b")) },
+			valid:   map[int]bool{0: true},
+		},
+		"truncated file": {
+			prepare: func(torrent *Torrent) { os.Truncate(filepath.Join(torrent.DownloadDir, "b"), 15) },
+			valid:   map[int]bool{0: true, 1: true},
+		},
+	}
+
+	for name, tc := range tt {
+		torrent, content := seededTorrent(t)
+		for index := range torrent.PieceHashes {
+			begin, end := torrent.pieceBounds(index)
+			torrent.PieceHashes[index] = sha1.Sum(content[begin:end])
+		}
+
+		tc.prepare(torrent)
+
+		assert.Equal(t, tc.valid, torrent.checkPieces(), name)
+	}
+}
+
+func TestLoadResume(t *testing.T) {
+	type testCase struct {
+		prepare    func(torrent *Torrent)
+		valid      map[int]bool
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"unchanged files": {
+			prepare: func(torrent *Torrent) {},
+			valid:   map[int]bool{0: true, 2: true},
+		},
+		"missing resume file": {
+			prepare: func(torrent *Torrent) { os.Remove(torrent.DownloadDir + resumeSuffix) },
+			valid:   nil,
+		},
+		"modified file": {
+			prepare: func(torrent *Torrent) {
+				path := filepath.Join(torrent.DownloadDir, "b")
+				os.Chtimes(path, time.Time{}, time.Now().Add(time.Hour))
+			},
+			valid: nil,
+		},
+		"another torrent": {
+			prepare:    func(torrent *Torrent) { torrent.InfoHash = utils.BTString{} },
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		torrent, _ := seededTorrent(t)
+		torrent.Peers = []peers.Peer{{IP: net.IP{10, 0, 0, 1}, Port: 6881}}
+		torrent.pieces.add(0)
+		torrent.pieces.add(2)
+		torrent.uploaded = 10
+		torrent.downloaded = 30
+
+		r := torrent.newResume()
+		r.addPeer(peers.Peer{IP: net.IPv6loopback, Port: 6882})
+		require.Nil(t, r.save(torrent), name)
+
+		// Restored state is loaded into a fresh torrent
+		reloaded := fakeTorrent(torrent.PieceLength, torrent.Length, torrent.Files)
+		reloaded.InfoHash = torrent.InfoHash
+		reloaded.PieceHashes = torrent.PieceHashes
+		reloaded.DownloadDir = torrent.DownloadDir
+		tc.prepare(&reloaded)
+
+		valid, err := reloaded.loadResume()
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+			continue
+		}
+
+		require.Nil(t, err, name)
+		assert.Equal(t, tc.valid, valid, name)
+		if valid != nil {
+			assert.ElementsMatch(t, []peers.Peer{
+				{IP: net.IP{10, 0, 0, 1}, Port: 6881},
+				{IP: net.IPv6loopback, Port: 6882},
+			}, reloaded.Peers, name)
+			assert.Equal(t, int64(10), reloaded.uploaded, name)
+			assert.Equal(t, int64(30), reloaded.downloaded, name)
+		}
+	}
+}
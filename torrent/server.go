@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/handshake"
+	"github.com/sauromates/leech/internal/mse"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+// maxInbound limits the number of simultaneous inbound connections
+const maxInbound int = 50
+
+// Server accepts connections from peers and lets them download pieces of
+// registered torrents
+type Server struct {
+	listener net.Listener
+	// encryption is the policy of incoming connections
+	encryption mse.Policy
+	mu         sync.Mutex
+	torrents   map[utils.BTString]*Torrent
+	conns      map[net.Conn]bool
+	wg         sync.WaitGroup
+}
+
+// Listen starts accepting peer connections on given TCP port. Zero port
+// picks a random one. Connections are encrypted according to given policy.
+func Listen(port uint16, encryption mse.Policy) (*Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	server := Server{
+		listener:   listener,
+		encryption: encryption,
+		torrents:   make(map[utils.BTString]*Torrent),
+		conns:      make(map[net.Conn]bool),
+	}
+
+	server.wg.Add(1)
+	go server.accept()
+
+	return &server, nil
+}
+
+// Port returns the TCP port the server listens on
+func (s *Server) Port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Add makes pieces of the torrent available to peers
+func (s *Server) Add(torrent *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.torrents[torrent.InfoHash] = torrent
+}
+
+// Remove stops accepting new peers of the torrent
+func (s *Server) Remove(torrent *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, torrent.InfoHash)
+}
+
+// Close stops accepting connections and closes established ones
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
+
+// accept handles incoming connections until the listener is closed
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Printf("[ERROR] Failed to accept connection: %s", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if len(s.conns) >= maxInbound {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// infoHashes returns infohashes of registered torrents
+func (s *Server) infoHashes() []utils.BTString {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infoHashes := make([]utils.BTString, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+// serve completes handshake with a peer and uploads requested blocks of
+// the torrent the peer asked for
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Deadline set above covers encryption handshake too
+	encrypted, err := mse.Receive(conn, s.infoHashes(), s.encryption)
+	if err != nil {
+		log.Printf("[INFO] Encryption handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	request, err := handshake.ReadAny(encrypted)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	torrent := s.torrents[request.InfoHash]
+	s.mu.Unlock()
+
+	if torrent == nil {
+		log.Printf("[INFO] Peer %s asked for unknown torrent %x", conn.RemoteAddr(), request.InfoHash)
+		return
+	}
+
+	have := torrent.pieces.snapshot()
+	c, err := client.Accept(encrypted, request, torrent.PeerID, torrent.extensions, have)
+	if err != nil {
+		log.Printf("[ERROR] Handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Printf("[INFO] Accepted peer %s for %s", conn.RemoteAddr(), torrent.Name)
+
+	if err := newUpload(torrent, c, have).run(); err != nil {
+		log.Printf("[INFO] Upload to %s stopped: %s", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,336 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/mse"
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/pex"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/sauromates/leech/worker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerUploadsBlocks(t *testing.T) {
+	torrent, content := seededTorrent(t)
+	torrent.pieces.add(0)
+	torrent.pieces.add(1)
+
+	server, err := Listen(0, mse.Prefer)
+	require.Nil(t, err)
+	defer server.Close()
+
+	server.Add(torrent)
+
+	var peerID utils.BTString
+	rand.Read(peerID[:])
+
+	// Blocks are uploaded over encrypted connection
+	local := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: server.Port()}
+	c, err := client.Create(local, torrent.InfoHash, peerID, nil, mse.Require)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+
+	c.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Bitfield lists only pieces the client has
+	assert.True(t, c.BitField.HasPiece(0))
+	assert.True(t, c.BitField.HasPiece(1))
+	assert.False(t, c.BitField.HasPiece(2))
+
+	// Requests of choked peer are rejected with fast extension
+	require.True(t, c.Fast)
+	require.Nil(t, c.RequestPiece(0, 0, 10))
+	msg, err := message.Read(c.Conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreateReject(0, 0, 10), msg)
+
+	require.Nil(t, c.AnnounceInterest())
+	msg, err = message.Read(c.Conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.Unchoke, msg.ID)
+
+	// Block overlapping both files
+	require.Nil(t, c.RequestPiece(1, 5, 10))
+	msg, err = message.Read(c.Conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreatePiece(1, 5, content[25:35]), msg)
+
+	// Peer learns about new pieces before they are served
+	torrent.pieces.add(2)
+	require.Nil(t, c.RequestPiece(2, 0, 10))
+	msg, err = message.Read(c.Conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreateHave(2), msg)
+
+	msg, err = message.Read(c.Conn)
+	require.Nil(t, err)
+	assert.Equal(t, message.CreatePiece(2, 0, content[40:50]), msg)
+	assert.Equal(t, int64(20), atomic.LoadInt64(&torrent.uploaded))
+
+	// Invalid requests close the connection
+	require.Nil(t, c.RequestPiece(3, 0, 10))
+	_, err = message.Read(c.Conn)
+	assert.NotNil(t, err)
+}
+
+func TestServerAdvertisesInboundPeers(t *testing.T) {
+	torrent, _ := seededTorrent(t)
+
+	server, err := Listen(0, mse.Disable)
+	require.Nil(t, err)
+	defer server.Close()
+
+	server.Add(torrent)
+
+	var peerID utils.BTString
+	rand.Read(peerID[:])
+
+	// Inbound peer telling its listen port is advertised by it
+	local := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: server.Port()}
+	listening, err := client.Create(local, torrent.InfoHash, peerID, client.NewRegistry("test", 51413), mse.Disable)
+	require.Nil(t, err)
+	defer listening.Conn.Close()
+
+	expected := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 51413}
+
+	var found []peers.Peer
+	for range 50 {
+		if found = advertisedPeers(t, local, torrent.InfoHash, 100*time.Millisecond); len(found) > 0 {
+			break
+		}
+	}
+
+	require.Len(t, found, 1)
+	assert.True(t, expected.IP.Equal(found[0].IP))
+	assert.Equal(t, expected.Port, found[0].Port)
+
+	// Inbound peer without listen port isn't advertised. It's known to
+	// be registered once it learns about the first peer
+	exchange := pex.New()
+	silent, err := client.Create(local, torrent.InfoHash, peerID, client.NewRegistry("test", 0, exchange), mse.Disable)
+	require.Nil(t, err)
+	defer silent.Conn.Close()
+
+	silent.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for len(exchange.Found()) == 0 {
+		msg, err := message.Read(silent.Conn)
+		require.Nil(t, err)
+
+		if msg != nil && msg.ID == message.Extended {
+			require.Nil(t, silent.HandleExtended(msg))
+		}
+	}
+
+	found = advertisedPeers(t, local, torrent.InfoHash, 5*time.Second)
+	require.Len(t, found, 1)
+	assert.Equal(t, expected.Port, found[0].Port)
+}
+
+// advertisedPeers connects to the server as a new peer and returns peers
+// it advertises via PEX within timeout
+func advertisedPeers(t *testing.T, server peers.Peer, infoHash utils.BTString, timeout time.Duration) []peers.Peer {
+	t.Helper()
+
+	var peerID utils.BTString
+	rand.Read(peerID[:])
+
+	exchange := pex.New()
+	c, err := client.Create(server, infoHash, peerID, client.NewRegistry("test", 0, exchange), mse.Disable)
+	require.Nil(t, err)
+	defer c.Conn.Close()
+
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+	for {
+		select {
+		case found := <-exchange.Found():
+			return found
+		default:
+		}
+
+		msg, err := message.Read(c.Conn)
+		if err != nil {
+			return nil
+		}
+
+		if msg != nil && msg.ID == message.Extended {
+			require.Nil(t, c.HandleExtended(msg))
+		}
+	}
+}
+
+func TestServerRejectsUnknownTorrent(t *testing.T) {
+	server, err := Listen(0, mse.Prefer)
+	require.Nil(t, err)
+	defer server.Close()
+
+	var infoHash, peerID utils.BTString
+	rand.Read(infoHash[:])
+	rand.Read(peerID[:])
+
+	local := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: server.Port()}
+	_, err = client.Create(local, infoHash, peerID, nil, mse.Prefer)
+	assert.NotNil(t, err)
+}
+
+func TestServerEncryption(t *testing.T) {
+	type testCase struct {
+		server     mse.Policy
+		client     mse.Policy
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"encrypted":                    {server: mse.Prefer, client: mse.Require},
+		"plaintext":                    {server: mse.Prefer, client: mse.Disable},
+		"fallback to plaintext":        {server: mse.Disable, client: mse.Prefer},
+		"plaintext rejected":           {server: mse.Require, client: mse.Disable, shouldFail: true},
+		"required encryption rejected": {server: mse.Disable, client: mse.Require, shouldFail: true},
+	}
+
+	torrent, _ := seededTorrent(t)
+	for name, tc := range tt {
+		server, err := Listen(0, tc.server)
+		require.Nil(t, err, name)
+
+		server.Add(torrent)
+
+		var peerID utils.BTString
+		rand.Read(peerID[:])
+
+		local := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: server.Port()}
+		c, err := client.Create(local, torrent.InfoHash, peerID, nil, tc.client)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			require.Nil(t, err, name)
+			c.Conn.Close()
+		}
+
+		server.Close()
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	torrent, content := seededTorrent(t)
+
+	type testCase struct {
+		index      int
+		begin      int
+		length     int
+		shouldFail bool
+	}
+
+	tt := map[string]testCase{
+		"block within a file":     {index: 0, begin: 5, length: 10},
+		"block overlapping files": {index: 1, begin: 0, length: 20},
+		"last piece":              {index: 2, begin: 0, length: 10},
+		"block beyond the end":    {index: 2, begin: 5, length: 10, shouldFail: true},
+	}
+
+	for name, tc := range tt {
+		block, err := torrent.readBlock(tc.index, tc.begin, tc.length)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			offset := tc.index*torrent.PieceLength + tc.begin
+
+			require.Nil(t, err, name)
+			assert.Equal(t, content[offset:offset+tc.length], block, name)
+		}
+	}
+}
+
+// seededTorrent creates a torrent of 3 pieces stored in 2 files within a
+// temporary download directory
+func seededTorrent(t *testing.T) (*Torrent, []byte) {
+	content := make([]byte, 50)
+	rand.Read(content)
+
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "a"), content[:30], 0644))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "b"), content[30:], 0644))
+
+	torrent := fakeTorrent(20, 50, []utils.PathInfo{
+		{Path: "a", Offset: 0, Length: 30},
+		{Path: "b", Offset: 30, Length: 50},
+	})
+	torrent.PieceHashes = make([]utils.BTString, 3)
+	torrent.DownloadDir = dir
+	torrent.pieces = newPieceSet(3)
+	torrent.choker = newChoker(func() bool { return true })
+	torrent.exchange = pex.New()
+	torrent.extensions = client.NewRegistry(appName, 0, torrent.exchange)
+
+	return &torrent, content
+}
+
+func TestWorkerDownloadsFromServer(t *testing.T) {
+	seeder, content := seededTorrent(t)
+	for index := range seeder.PieceHashes {
+		begin, end := seeder.pieceBounds(index)
+		seeder.PieceHashes[index] = sha1.Sum(content[begin:end])
+		seeder.pieces.add(index)
+	}
+
+	server, err := Listen(0, mse.Prefer)
+	require.Nil(t, err)
+	defer server.Close()
+
+	server.Add(seeder)
+
+	var peerID utils.BTString
+	rand.Read(peerID[:])
+
+	local := peers.Peer{IP: net.IPv4(127, 0, 0, 1), Port: server.Port()}
+	w := worker.Create(local, seeder.InfoHash, peerID, nil, mse.Prefer, nil)
+	require.Nil(t, w.Connect())
+
+	picker := worker.NewPicker(len(seeder.PieceHashes))
+	for index, hash := range seeder.PieceHashes {
+		picker.Add(&worker.Piece{Index: index, Hash: hash, Length: seeder.pieceSize(index)}, 0)
+	}
+
+	results := make(chan *worker.PieceContent)
+	errs := make(chan error, 1)
+	go func() { errs <- w.Run(picker, results) }()
+
+	downloaded := make([]byte, len(content))
+	for range seeder.PieceHashes {
+		select {
+		case piece := <-results:
+			begin, _ := seeder.pieceBounds(piece.Index)
+			copy(downloaded[begin:], piece.Content)
+		case err := <-errs:
+			t.Fatalf("worker stopped: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download timed out")
+		}
+	}
+
+	assert.Equal(t, content, downloaded)
+
+	stats := w.Stats()
+	assert.Equal(t, local, stats.Peer)
+	assert.Equal(t, int64(len(content)), stats.Downloaded)
+	assert.Positive(t, stats.RTT)
+
+	// Worker exits once the picker is closed
+	picker.Close()
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker didn't stop")
+	}
+}
@@ -5,20 +5,32 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
+	"os"
 	"path/filepath"
-	"runtime"
+	"sync/atomic"
 	"time"
 
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/metadata"
+	"github.com/sauromates/leech/internal/mse"
 	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/pex"
 	"github.com/sauromates/leech/internal/utils"
 	"github.com/sauromates/leech/torrentfile"
 	"github.com/sauromates/leech/worker"
 	"github.com/schollz/progressbar/v3"
 )
 
+// DefaultPort is the TCP port for incoming connections used unless
+// configured otherwise
+const DefaultPort uint16 = 49160
+
 const (
 	appName        string = "leech"
 	maxConnections int    = 10
+	// numWant is the number of peers requested from trackers
+	numWant int = 50
 )
 
 type Torrent struct {
@@ -31,55 +43,197 @@ type Torrent struct {
 	Length      int
 	Files       []utils.PathInfo
 	DownloadDir string
+	// Private torrents don't use DHT and PEX (BEP 27)
+	Private bool
+	// Encryption is the policy of connections to peers
+	Encryption mse.Policy
+
+	// port accepts incoming connections and is announced to trackers
+	port      uint16
+	announcer *announcer
+	// pieces are the pieces written to disk and available for upload
+	pieces *pieceSet
+	// workers are the workers connected to peers
+	workers *workerSet
+	// priorities of files by path. Files missing here have normal priority
+	priorities map[string]Priority
+	// choker assigns upload slots to connected peers
+	choker *choker
+	// extensions are extension protocol extensions offered to peers
+	extensions *client.Registry
+	// exchange shares connected peers with other peers via ut_pex
+	exchange *pex.Exchange
+	// announceKey identifies the client to trackers across IP changes
+	announceKey uint32
+	// Transfer totals in bytes reported to trackers. Accessed atomically
+	// since announcer reads them from its own goroutine
+	uploaded   int64
+	downloaded int64
+	left       int64
 }
 
-// CreateFromTorrentFile creates new [*Torrent] from decoded torrent file info
-func CreateFromTorrentFile(tf torrentfile.TorrentFile) (*Torrent, error) {
-	var peerID utils.BTString
-	copy(peerID[:], appName)
-
-	peers, err := tf.RequestPeers(peerID, uint16(49160))
-	if err != nil {
-		return nil, err
+// CreateFromTorrentFile creates new [*Torrent] from decoded torrent file info.
+// Peers are requested from torrent's trackers and given peer sources, which
+// are told that the client accepts connections on given port. Private
+// torrents ignore the sources and don't exchange peers with other peers.
+func CreateFromTorrentFile(tf torrentfile.TorrentFile, port uint16, sources ...PeerSource) (*Torrent, error) {
+	exchange := pex.New()
+	extensions := []client.Extension{exchange}
+	if tf.Private {
+		sources, extensions = nil, nil
 	}
 
 	torrent := Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
+		PeerID:      newPeerID(),
 		InfoHash:    tf.InfoHash,
 		PieceHashes: tf.PieceHashes,
 		PieceLength: tf.PieceLength,
 		Name:        tf.Name,
 		Length:      tf.GetLength(),
 		Files:       tf.GetFiles(),
+		Private:     tf.Private,
+		port:        port,
+		announcer:   newAnnouncer(&tf, sources...),
+		pieces:      newPieceSet(len(tf.PieceHashes)),
+		workers:     newWorkerSet(),
+		extensions:  client.NewRegistry(appName, port, extensions...),
+		exchange:    exchange,
+		announceKey: rand.Uint32(),
+		left:        int64(tf.GetLength()),
+	}
+
+	torrent.choker = newChoker(func() bool { return atomic.LoadInt64(&torrent.left) == 0 })
+	if !tf.Private {
+		torrent.announcer.exchanged = exchange.Found()
 	}
 
+	peers, err := torrent.announcer.announce(torrent.announceRequest(torrentfile.EventStarted))
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.Peers = peers
+
 	return &torrent, nil
 }
 
+// ResolveMagnet fetches torrent metadata for a magnet link from peers
+// received from link's trackers, given peer sources and from peers embedded
+// into the link. Connections to peers are encrypted according to given
+// policy.
+func ResolveMagnet(link *torrentfile.Magnet, port uint16, encryption mse.Policy, sources ...PeerSource) (torrentfile.TorrentFile, error) {
+	peerID := newPeerID()
+	candidates := link.Peers
+
+	for _, source := range sources {
+		found, err := source.Announce(link.InfoHash, port)
+		if err != nil {
+			log.Printf("[ERROR] Failed to get peers for magnet link: %s", err)
+			continue
+		}
+
+		candidates = append(candidates, found...)
+	}
+
+	if len(link.Trackers) > 0 {
+		tf := torrentfile.TorrentFile{InfoHash: link.InfoHash, AnnounceList: [][]string{link.Trackers}}
+		result, err := tf.RequestPeers(torrentfile.AnnounceRequest{
+			PeerID: peerID,
+			Port:   port,
+			// Torrent size is unknown yet, but some trackers treat zero as seeding
+			Left:    metadata.BlockSize,
+			NumWant: numWant,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to get peers for magnet link: %s", err)
+		} else {
+			candidates = append(candidates, result.Peers...)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return torrentfile.TorrentFile{}, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	info, err := metadata.Fetch(candidates, link.InfoHash, peerID, encryption)
+	if err != nil {
+		return torrentfile.TorrentFile{}, err
+	}
+
+	return link.TorrentFile(info)
+}
+
 // Download runs workers asynchronously after preparing necessary infrastructure
 // for them: assembles tasks and results queues, pushes peers into a pool of connections, etc.
 func (torrent *Torrent) Download(dir string) error {
 	torrent.DownloadDir = dir
 
-	queue := make(chan *worker.Piece, len(torrent.PieceHashes))
+	picker := worker.NewPicker(len(torrent.PieceHashes))
 	results := make(chan *worker.PieceContent)
-	pool := make(chan *peers.Peer, len(torrent.Peers))
 
-	for index, hash := range torrent.PieceHashes {
+	// Pieces left from previous runs are only announced to peers. Hashing
+	// them is skipped if files didn't change since resume file was saved
+	done, err := torrent.loadResume()
+	if err != nil {
+		log.Printf("[ERROR] Failed to load resume data: %s", err)
+	}
+
+	if done == nil {
+		done = torrent.checkPieces()
+	}
+
+	for index := range done {
+		torrent.pieces.add(index)
+		atomic.AddInt64(&torrent.left, -int64(torrent.pieceSize(index)))
+	}
+
+	// Only pieces of wanted files are downloaded
+	wanted := torrent.wantedPieces()
+	pool := make(chan *peers.Peer)
+	tracker := progressbar.DefaultBytes(int64(torrent.wantedLength(wanted)), "Downloading")
+	remaining := 0
+	for _, index := range wanted {
 		pieceLength := torrent.pieceSize(index)
-		piece := worker.Piece{Index: index, Hash: hash, Length: pieceLength}
+		if done[index] {
+			tracker.Add(pieceLength)
+			continue
+		}
+
+		piece := worker.Piece{Index: index, Hash: torrent.PieceHashes[index], Length: pieceLength}
 
-		queue <- &piece
+		picker.Add(&piece, int(torrent.piecePriority(index)))
+		remaining++
 	}
 
+	resume := torrent.newResume()
+	if err := resume.save(torrent); err != nil {
+		log.Printf("[ERROR] Failed to save resume data: %s", err)
+	}
+
+	if remaining == 0 {
+		log.Printf("[INFO] All wanted pieces of %s are already downloaded", torrent.Name)
+		return tracker.Finish()
+	}
+
+	if len(done) > 0 {
+		log.Printf("[INFO] Resuming %s with %d of %d pieces", torrent.Name, len(done), len(torrent.PieceHashes))
+	}
+
+	// Peers wait in the queue until there are free connections
+	queue := make([]peers.Peer, 0, len(torrent.Peers))
 	for _, peer := range torrent.Peers {
-		pool <- &peer
+		resume.addPeer(peer)
+		queue = append(queue, peer)
 	}
 
-	done := make(map[int]bool)
-	tracker := progressbar.DefaultBytes(int64(torrent.Length), "Downloading")
-	for len(done) < len(torrent.PieceHashes) {
+	torrent.announcer.start(torrent, pool)
+
+	retry := time.NewTicker(3 * time.Second)
+	defer retry.Stop()
+
+	for remaining > 0 {
+		queue = torrent.connectPeers(queue, picker, results, pool)
+
 		select {
 		case piece := <-results:
 			// Skip if a piece was marked as done. It's very unlikely to
@@ -88,33 +242,67 @@ func (torrent *Torrent) Download(dir string) error {
 				continue
 			}
 
-			if _, err := torrent.write(piece, tracker); err != nil {
+			n, err := torrent.write(piece, tracker)
+			if err != nil {
+				torrent.announcer.close()
+				torrent.stopWorkers(picker, results, pool)
+
 				return err
 			}
 
+			// Pieces partially dropped along with skipped files can't be
+			// uploaded and count as left
+			if n == len(piece.Content) {
+				torrent.pieces.add(piece.Index)
+				atomic.AddInt64(&torrent.left, -int64(n))
+			}
+
+			atomic.AddInt64(&torrent.downloaded, int64(len(piece.Content)))
 			done[piece.Index] = true
-		case peer := <-pool:
-			log.Printf("[INFO] Received peer %s", peer.String())
+			remaining--
 
-			numWorkers := runtime.NumGoroutine() - 1
-			if numWorkers < maxConnections {
-				log.Printf("[INFO] Connecting to %s", peer.String())
-				go torrent.startWorker(*peer, queue, results, pool)
-			} else {
-				log.Printf("[INFO] Too many connections, will retry %s later", peer.String())
-				time.Sleep(time.Second * 3)
-				pool <- peer
+			resume.update(torrent, piece.Index)
+			if err := resume.save(torrent); err != nil {
+				log.Printf("[ERROR] Failed to save resume data: %s", err)
 			}
+		case peer := <-pool:
+			log.Printf("[INFO] Received peer %s", peer.String())
+			resume.addPeer(*peer)
+			queue = append(queue, *peer)
+		case <-retry.C:
+			// Connections of finished workers are reused for queued peers
 		}
 	}
 
-	close(queue)
-	close(results)
-	close(pool)
+	torrent.announcer.close()
+	torrent.stopWorkers(picker, results, pool)
+
+	// Trackers count the client as a seeder only when every piece is
+	// downloaded, skipped files keep it leeching
+	if atomic.LoadInt64(&torrent.left) == 0 {
+		if _, err := torrent.announcer.announce(torrent.announceRequest(torrentfile.EventCompleted)); err != nil {
+			log.Printf("[ERROR] Failed to announce completed download: %s", err)
+		}
+	}
 
 	return tracker.Finish()
 }
 
+// Seed keeps the torrent announced after download so that peers can find
+// the client and download pieces from it via [Server]. Close stops it.
+func (torrent *Torrent) Seed() {
+	torrent.announcer.start(torrent, nil)
+}
+
+// Close stops re-announcing the torrent and tells trackers that the client
+// is leaving the swarm
+func (torrent *Torrent) Close() error {
+	torrent.announcer.close()
+	_, err := torrent.announcer.announce(torrent.announceRequest(torrentfile.EventStopped))
+
+	return err
+}
+
 // String converts torrent info to default string representation
 func (t Torrent) String() string {
 	return fmt.Sprintf("Torrent %s\n---\nTotalSize: %.2f MB\nTotalFiles: %d\n",
@@ -124,6 +312,34 @@ func (t Torrent) String() string {
 	)
 }
 
+// newPeerID returns ID which identifies the client to trackers and peers
+func newPeerID() utils.BTString {
+	var peerID utils.BTString
+	copy(peerID[:], appName)
+
+	return peerID
+}
+
+// announceRequest reports given event and current transfer totals to trackers
+func (torrent *Torrent) announceRequest(event torrentfile.AnnounceEvent) torrentfile.AnnounceRequest {
+	req := torrentfile.AnnounceRequest{
+		PeerID:     torrent.PeerID,
+		Port:       torrent.port,
+		Uploaded:   int(atomic.LoadInt64(&torrent.uploaded)),
+		Downloaded: int(atomic.LoadInt64(&torrent.downloaded)),
+		Left:       int(atomic.LoadInt64(&torrent.left)),
+		Event:      event,
+		NumWant:    numWant,
+		Key:        torrent.announceKey,
+	}
+
+	if event == torrentfile.EventStopped {
+		req.NumWant = 0
+	}
+
+	return req
+}
+
 // pieceBounds calculates where the piece with given index begins
 // and ends within the torrent contents
 func (torrent *Torrent) pieceBounds(index int) (begin int, end int) {
@@ -144,21 +360,34 @@ func (torrent *Torrent) pieceSize(index int) int {
 	return end - begin
 }
 
-// write copies received piece into associated files.
+// write copies received piece into associated files and returns the number
+// of bytes written to disk.
 //
 // Base scenario is writing to a single file, but pieces may overlap files,
 // in which case we will split piece by relative offset and length and write
-// its parts to multiple associated files
+// its parts to multiple associated files. Parts of skipped files are
+// dropped unless the files already exist.
 func (torrent *Torrent) write(piece *worker.PieceContent, tracker io.Writer) (n int, err error) {
 	files, err := torrent.whichFiles(piece.Index)
 	if err != nil {
 		return n, err
 	}
 
-	for _, file := range files {
-		file.Open()
+	dropped := 0
+	for path, file := range files {
+		src := io.NewSectionReader(piece, file.PieceStart, file.PieceEnd-file.PieceStart)
+		if torrent.filePriority(path) == PrioritySkip {
+			if _, err := os.Stat(file.FileName); err != nil {
+				if tracker != nil {
+					io.Copy(tracker, src)
+				}
 
-		src := io.NewSectionReader(piece, file.PieceStart, file.PieceEnd)
+				dropped += int(file.PieceEnd - file.PieceStart)
+				continue
+			}
+		}
+
+		file.Open()
 		var dst io.Writer = file
 		if tracker != nil {
 			dst = io.MultiWriter(dst, tracker)
@@ -175,11 +404,11 @@ func (torrent *Torrent) write(piece *worker.PieceContent, tracker io.Writer) (n
 		n += int(written)
 	}
 
-	if n != len(piece.Content) {
+	if n+dropped != len(piece.Content) {
 		err := fmt.Sprintf(
 			"[ERROR] unexpected download volume: expected %d got %d",
 			len(piece.Content),
-			n,
+			n+dropped,
 		)
 
 		log.Println(err)
@@ -190,6 +419,44 @@ func (torrent *Torrent) write(piece *worker.PieceContent, tracker io.Writer) (n
 	return n, err
 }
 
+// readBlock reads a block of a downloaded piece back from the files the
+// piece belongs to
+func (torrent *Torrent) readBlock(index, begin, length int) ([]byte, error) {
+	files, err := torrent.whichFiles(index)
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([]byte, length)
+	n := 0
+	for _, file := range files {
+		start := max(int64(begin), file.PieceStart)
+		end := min(int64(begin+length), file.PieceEnd)
+		if start >= end {
+			continue
+		}
+
+		f, err := os.Open(file.FileName)
+		if err != nil {
+			return nil, err
+		}
+
+		read, err := f.ReadAt(block[start-int64(begin):end-int64(begin)], file.FileOffset+start-file.PieceStart)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		n += read
+	}
+
+	if n != length {
+		return nil, fmt.Errorf("read %d bytes of block %d:%d instead of %d", n, index, begin, length)
+	}
+
+	return block, nil
+}
+
 // whichFiles determines which files the piece belongs to by an intersection
 // of absolute offsets and lengths.
 func (torrent *Torrent) whichFiles(piece int) (map[string]utils.FileMap, error) {
@@ -220,22 +487,82 @@ func (torrent *Torrent) whichFiles(piece int) (map[string]utils.FileMap, error)
 	return files, nil
 }
 
-// startWorker transforms peer into a listener for a task queue and
-// runs it until the queue is empty or until an error occurs.
+// connectPeers starts workers for queued peers while there are free
+// connections and returns the peers which have to wait
+func (torrent *Torrent) connectPeers(
+	queue []peers.Peer,
+	picker *worker.Picker,
+	results chan *worker.PieceContent,
+	pool chan *peers.Peer,
+) []peers.Peer {
+	for len(queue) > 0 && torrent.workers.count() < maxConnections {
+		peer := queue[0]
+		queue = queue[1:]
+
+		log.Printf("[INFO] Connecting to %s", peer.String())
+
+		// Worker is counted before it connects, so that connections are
+		// limited while workers are starting
+		w := worker.Create(peer, torrent.InfoHash, torrent.PeerID, torrent.extensions, torrent.Encryption, storage{torrent})
+		torrent.workers.add(w)
+		go torrent.startWorker(w, peer, picker, results, pool)
+	}
+
+	return queue
+}
+
+// stopWorkers closes the picker and waits until every worker exits. Pieces
+// and peers workers send meanwhile are discarded, channels are closed once
+// nobody writes to them.
+func (torrent *Torrent) stopWorkers(picker *worker.Picker, results chan *worker.PieceContent, pool chan *peers.Peer) {
+	picker.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		torrent.workers.wait()
+		close(stopped)
+	}()
+
+	for waiting := true; waiting; {
+		select {
+		case <-results:
+		case <-pool:
+		case <-stopped:
+			waiting = false
+		}
+	}
+
+	close(results)
+	close(pool)
+}
+
+// startWorker connects to the peer and downloads pieces handed out by the
+// picker until the download completes or until an error occurs. The peer
+// is advertised to other peers via PEX and may download pieces once the
+// choker unchokes it while connected.
 func (torrent *Torrent) startWorker(
+	w *worker.Worker,
 	peer peers.Peer,
-	queue chan *worker.Piece,
+	picker *worker.Picker,
 	results chan *worker.PieceContent,
 	peers chan *peers.Peer,
 ) {
-	w := worker.Create(peer, torrent.InfoHash, torrent.PeerID)
-
-	if err := w.Run(queue, results); err != nil {
-		// Peer should be put back to the pool only if there was no
-		// connection errors, otherwise it's pointless since workers would
-		// constantly try to reconnect to unresponsive peers
-		if err != worker.ErrConn {
-			peers <- &peer
-		}
+	defer torrent.workers.remove(w)
+
+	// Peer should be put back to the pool only if there was no connection
+	// errors, otherwise it's pointless since workers would constantly try
+	// to reconnect to unresponsive peers
+	if err := w.Connect(); err != nil {
+		return
+	}
+
+	torrent.exchange.Add(peer)
+	defer torrent.exchange.Drop(peer)
+
+	torrent.choker.add(outbound{w})
+	defer torrent.choker.remove(outbound{w})
+
+	if err := w.Run(picker, results); err != nil {
+		peers <- &peer
 	}
 }
@@ -0,0 +1,424 @@
+package torrent
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/peers"
+)
+
+const (
+	// idleTimeout closes connections of silent peers. Peers are expected
+	// to send keep-alive messages every 2 minutes
+	idleTimeout time.Duration = 3 * time.Minute
+	// keepAliveInterval is how often the client reminds idle peers about
+	// itself
+	keepAliveInterval time.Duration = 2 * time.Minute
+	// haveInterval is how often peers are told about new pieces
+	haveInterval time.Duration = 5 * time.Second
+	// maxBlockLength is the largest block peers may request
+	maxBlockLength int = 128 * 1024
+	// maxExtended limits extension messages waiting for writing goroutine
+	maxExtended int = 64
+)
+
+// blockRequest is a block of a piece requested by a peer
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// upload serves blocks requested by a peer. Messages are read and written
+// by separate goroutines, so that requests may be cancelled while queued.
+// Extension messages are handled by the writing goroutine, so that state
+// of extensions is never accessed concurrently.
+type upload struct {
+	torrent *Torrent
+	client  *client.Client
+
+	// mu guards state shared by reading and writing goroutines
+	mu         sync.Mutex
+	interested bool
+	// choked is the state decided by the choker, which the writing
+	// goroutine passes to the peer
+	choked   bool
+	requests []blockRequest
+	// rejected are requests the peer is told won't be served. Used only
+	// with fast extension
+	rejected []blockRequest
+	// extended are extension messages waiting to be handled
+	extended []*message.Message
+	// wake notifies writing goroutine about changes
+	wake chan struct{}
+
+	// announced are pieces the peer was told about
+	announced bitfield.BitField
+	// peerChoked is the choke state the peer was told about
+	peerChoked bool
+	lastWrite  time.Time
+	// sent is the total of bytes uploaded to the peer. Accessed
+	// atomically since the choker reads it from its own goroutine
+	sent int64
+	// advertised is set once the peer is registered for PEX
+	advertised bool
+}
+
+// newUpload creates upload session for a peer which received given bitfield
+func newUpload(torrent *Torrent, c *client.Client, announced bitfield.BitField) *upload {
+	return &upload{
+		torrent:    torrent,
+		client:     c,
+		choked:     true,
+		wake:       make(chan struct{}, 1),
+		announced:  announced,
+		peerChoked: true,
+		lastWrite:  time.Now(),
+	}
+}
+
+// run serves the peer until the connection fails or is closed. The peer
+// is unchoked and choked by torrent's choker and advertised to other peers
+// via PEX while connected if it tells its listen port.
+func (u *upload) run() error {
+	u.torrent.choker.add(u)
+	defer u.torrent.choker.remove(u)
+
+	defer u.torrent.exchange.Drop(u.client.Peer)
+
+	done := make(chan struct{})
+	sent := make(chan error, 1)
+	go func() {
+		err := u.send(done)
+		// Unblock reading goroutine
+		u.client.Conn.Close()
+		sent <- err
+	}()
+
+	err := u.receive()
+	close(done)
+
+	if sendErr := <-sent; sendErr != nil {
+		return sendErr
+	}
+
+	return err
+}
+
+// receive reads peer's messages and updates session state
+func (u *upload) receive() error {
+	for {
+		u.client.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		msg, err := message.Read(u.client.Conn)
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.Interested, message.NotInterested:
+			u.mu.Lock()
+			u.interested = msg.ID == message.Interested
+			u.mu.Unlock()
+
+			u.torrent.choker.interested(u)
+		case message.Request:
+			index, begin, length, err := msg.ParseRequest()
+			if err != nil {
+				return err
+			}
+
+			if err := u.torrent.validateRequest(index, begin, length); err != nil {
+				return err
+			}
+
+			if err := u.queue(blockRequest{index, begin, length}); err != nil {
+				return err
+			}
+		case message.Cancel:
+			index, begin, length, err := msg.ParseRequest()
+			if err != nil {
+				return err
+			}
+
+			u.cancel(blockRequest{index, begin, length})
+		case message.Extended:
+			u.mu.Lock()
+			full := len(u.extended) >= maxExtended
+			if !full {
+				u.extended = append(u.extended, msg)
+			}
+			u.mu.Unlock()
+
+			if full {
+				return fmt.Errorf("too many extension messages")
+			}
+		}
+
+		u.notify()
+	}
+}
+
+// send writes state changes and requested blocks to the peer until done
+// is closed
+func (u *upload) send(done chan struct{}) error {
+	ticker := time.NewTicker(haveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-u.wake:
+		case <-ticker.C:
+		}
+
+		if err := u.sendHaves(); err != nil {
+			return err
+		}
+
+		if err := u.updateChoke(); err != nil {
+			return err
+		}
+
+		if err := u.sendRejects(); err != nil {
+			return err
+		}
+
+		for {
+			req, ok := u.next()
+			if !ok {
+				break
+			}
+
+			block, err := u.torrent.readBlock(req.index, req.begin, req.length)
+			if err != nil {
+				return err
+			}
+
+			if err := u.write(message.CreatePiece(req.index, req.begin, block)); err != nil {
+				return err
+			}
+
+			atomic.AddInt64(&u.torrent.uploaded, int64(len(block)))
+			atomic.AddInt64(&u.sent, int64(len(block)))
+		}
+
+		if err := u.handleExtended(); err != nil {
+			return err
+		}
+
+		if err := u.client.TickExtensions(); err != nil {
+			return err
+		}
+
+		if time.Since(u.lastWrite) >= keepAliveInterval {
+			if err := u.write(nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleExtended passes queued extension messages to extensions
+func (u *upload) handleExtended() error {
+	u.mu.Lock()
+	queued := u.extended
+	u.extended = nil
+	u.mu.Unlock()
+
+	for _, msg := range queued {
+		if err := u.client.HandleExtended(msg); err != nil {
+			return err
+		}
+	}
+
+	u.advertise()
+
+	return nil
+}
+
+// advertise registers the peer for PEX once its extended handshake tells
+// which port it listens on. Remote port of incoming connection is the
+// peer's outgoing one, so peers not telling the port aren't advertised.
+func (u *upload) advertise() {
+	if u.advertised || u.client.PeerExtensions == nil {
+		return
+	}
+
+	port := u.client.PeerExtensions.P
+	if port <= 0 || port > math.MaxUint16 {
+		return
+	}
+
+	listen := peers.Peer{IP: u.client.Peer.IP, Port: uint16(port)}
+	u.torrent.exchange.AddIncoming(u.client.Peer, listen)
+	u.advertised = true
+}
+
+// updateChoke tells the peer about changes of choke state
+func (u *upload) updateChoke() error {
+	u.mu.Lock()
+	choked := u.choked
+	u.mu.Unlock()
+
+	if choked == u.peerChoked {
+		return nil
+	}
+
+	u.peerChoked = choked
+	if choked {
+		return u.write(message.CreateEmpty(message.Choke))
+	}
+
+	return u.write(message.CreateEmpty(message.Unchoke))
+}
+
+// isInterested implements [chokable]
+func (u *upload) isInterested() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.interested
+}
+
+// uploaded implements [chokable]
+func (u *upload) uploaded() int64 {
+	return atomic.LoadInt64(&u.sent)
+}
+
+// downloaded implements [chokable]. Nothing is requested from inbound
+// peers, so they earn regular slots only while seeding
+func (u *upload) downloaded() int64 {
+	return 0
+}
+
+// setChoked implements [chokable]. Choking discards queued requests, with
+// fast extension they are rejected explicitly.
+func (u *upload) setChoked(choked bool) {
+	u.mu.Lock()
+	u.choked = choked
+	if choked {
+		if u.client.Fast {
+			u.rejected = append(u.rejected, u.requests...)
+		}
+
+		u.requests = nil
+	}
+	u.mu.Unlock()
+
+	u.notify()
+}
+
+// sendHaves tells the peer about pieces downloaded since it connected
+func (u *upload) sendHaves() error {
+	have := u.torrent.pieces.snapshot()
+	for index := range len(u.torrent.PieceHashes) {
+		if !have.HasPiece(index) || u.announced.HasPiece(index) {
+			continue
+		}
+
+		if err := u.write(message.CreateHave(index)); err != nil {
+			return err
+		}
+
+		u.announced.SetPiece(index)
+	}
+
+	return nil
+}
+
+// queue adds peer's request to the queue. Requests of choked peers and
+// requests over the limit are discarded, with fast extension they are
+// rejected explicitly.
+func (u *upload) queue(req blockRequest) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.choked && len(u.requests) < client.MaxPeerRequests {
+		u.requests = append(u.requests, req)
+		return nil
+	}
+
+	if !u.client.Fast {
+		return nil
+	}
+
+	// Peer keeps requesting without waiting for rejects
+	if len(u.rejected) >= client.MaxPeerRequests {
+		return fmt.Errorf("too many rejected requests")
+	}
+
+	u.rejected = append(u.rejected, req)
+
+	return nil
+}
+
+// sendRejects tells the peer about requests which won't be served
+func (u *upload) sendRejects() error {
+	u.mu.Lock()
+	rejected := u.rejected
+	u.rejected = nil
+	u.mu.Unlock()
+
+	for _, req := range rejected {
+		if err := u.write(message.CreateReject(req.index, req.begin, req.length)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// next pops the oldest queued request
+func (u *upload) next() (blockRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.requests) == 0 {
+		return blockRequest{}, false
+	}
+
+	req := u.requests[0]
+	u.requests = u.requests[1:]
+
+	return req, true
+}
+
+// cancel removes queued request
+func (u *upload) cancel(req blockRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, queued := range u.requests {
+		if queued == req {
+			u.requests = append(u.requests[:i], u.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// notify wakes up writing goroutine
+func (u *upload) notify() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write sends a message to the peer
+func (u *upload) write(msg *message.Message) error {
+	u.lastWrite = time.Now()
+
+	return u.client.Write(msg)
+}
@@ -0,0 +1,137 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/sauromates/leech/torrentfile"
+)
+
+// Report describes how data in a directory matches a torrent
+type Report struct {
+	Files []FileReport
+	// Corrupt are indexes of pieces which don't match their hash sums
+	Corrupt []int
+}
+
+// FileReport describes the state of a single file of a torrent
+type FileReport struct {
+	Path string
+	// Size is the size of the file according to the torrent
+	Size int64
+	// ActualSize is the size of the file on disk, -1 if it's missing
+	ActualSize int64
+	// Pieces is the number of pieces overlapping the file
+	Pieces int
+	// Valid is the number of pieces overlapping the file which match their
+	// hash sums
+	Valid int
+}
+
+// Verify checks files of a torrent in given directory against its piece
+// hashes without downloading anything
+func Verify(tf torrentfile.TorrentFile, dir string) *Report {
+	torrent := Torrent{
+		InfoHash:    tf.InfoHash,
+		PieceHashes: tf.PieceHashes,
+		PieceLength: tf.PieceLength,
+		Name:        tf.Name,
+		Length:      tf.GetLength(),
+		Files:       tf.GetFiles(),
+		DownloadDir: dir,
+	}
+
+	return torrent.verify()
+}
+
+// OK tells whether all files are present and complete
+func (r *Report) OK() bool {
+	for _, file := range r.Files {
+		if !file.Complete() {
+			return false
+		}
+	}
+
+	return len(r.Corrupt) == 0
+}
+
+// Missing tells whether the file doesn't exist
+func (f FileReport) Missing() bool {
+	return f.ActualSize < 0
+}
+
+// WrongSize tells whether existing file has unexpected size
+func (f FileReport) WrongSize() bool {
+	return !f.Missing() && f.ActualSize != f.Size
+}
+
+// Complete tells whether the file has expected size and all of its pieces
+// are valid
+func (f FileReport) Complete() bool {
+	return !f.Missing() && !f.WrongSize() && f.Valid == f.Pieces
+}
+
+// Completion returns the share of valid pieces of the file in percents
+func (f FileReport) Completion() float64 {
+	if f.Pieces == 0 {
+		return 100
+	}
+
+	return float64(f.Valid) / float64(f.Pieces) * 100
+}
+
+// verify hashes every piece and attributes results to the files the pieces
+// belong to
+func (torrent *Torrent) verify() *Report {
+	report := Report{Files: make([]FileReport, len(torrent.Files))}
+	byPath := make(map[string]*FileReport, len(torrent.Files))
+	for i, file := range torrent.Files {
+		report.Files[i] = FileReport{
+			Path:       file.Path,
+			Size:       int64(file.Length - file.Offset),
+			ActualSize: -1,
+		}
+
+		if info, err := os.Stat(filepath.Join(torrent.DownloadDir, file.Path)); err == nil {
+			report.Files[i].ActualSize = info.Size()
+		}
+
+		byPath[file.Path] = &report.Files[i]
+	}
+
+	var mu sync.Mutex
+	torrent.forEachPiece(func(index int) {
+		files, err := torrent.whichFiles(index)
+		if err != nil {
+			return
+		}
+
+		// Unreadable pieces belong to missing or truncated files, which
+		// are reported on their own
+		content, err := torrent.readBlock(index, 0, torrent.pieceSize(index))
+		hash := sha1.Sum(content)
+		valid := err == nil && bytes.Equal(hash[:], torrent.PieceHashes[index][:])
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err == nil && !valid {
+			report.Corrupt = append(report.Corrupt, index)
+		}
+
+		for path := range files {
+			byPath[path].Pieces++
+			if valid {
+				byPath[path].Valid++
+			}
+		}
+	})
+
+	slices.Sort(report.Corrupt)
+
+	return &report
+}
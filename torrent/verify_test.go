@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	type testCase struct {
+		prepare func(dir string)
+		files   []FileReport
+		corrupt []int
+		ok      bool
+	}
+
+	tt := map[string]testCase{
+		"complete files": {
+			prepare: func(dir string) {},
+			files: []FileReport{
+				{Path: "a", Size: 30, ActualSize: 30, Pieces: 2, Valid: 2},
+				{Path: "b", Size: 20, ActualSize: 20, Pieces: 2, Valid: 2},
+			},
+			ok: true,
+		},
+		"corrupt piece": {
+			prepare: func(dir string) {
+				file, _ := os.OpenFile(filepath.Join(dir, "a"), os.O_WRONLY, 0644)
+				defer file.Close()
+
+				file.WriteAt([]byte{0xff, 0xff, 0xff}, 25)
+			},
+			files: []FileReport{
+				{Path: "a", Size: 30, ActualSize: 30, Pieces: 2, Valid: 1},
+				{Path: "b", Size: 20, ActualSize: 20, Pieces: 2, Valid: 1},
+			},
+			corrupt: []int{1},
+		},
+		"missing file": {
+			prepare: func(dir string) { os.Remove(filepath.Join(dir, "b")) },
+			files: []FileReport{
+				{Path: "a", Size: 30, ActualSize: 30, Pieces: 2, Valid: 1},
+				{Path: "b", Size: 20, ActualSize: -1, Pieces: 2, Valid: 0},
+			},
+		},
+		"wrong size": {
+			prepare: func(dir string) { os.Truncate(filepath.Join(dir, "b"), 60) },
+			files: []FileReport{
+				{Path: "a", Size: 30, ActualSize: 30, Pieces: 2, Valid: 2},
+				{Path: "b", Size: 20, ActualSize: 60, Pieces: 2, Valid: 2},
+			},
+		},
+	}
+
+	for name, tc := range tt {
+		torrent, content := seededTorrent(t)
+		for index := range torrent.PieceHashes {
+			begin, end := torrent.pieceBounds(index)
+			torrent.PieceHashes[index] = sha1.Sum(content[begin:end])
+		}
+
+		tc.prepare(torrent.DownloadDir)
+
+		report := torrent.verify()
+		assert.Equal(t, tc.files, report.Files, name)
+		assert.Equal(t, tc.corrupt, report.Corrupt, name)
+		assert.Equal(t, tc.ok, report.OK(), name)
+	}
+}
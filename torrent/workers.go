@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"sync"
+
+	"github.com/sauromates/leech/worker"
+)
+
+// workerSet tracks running workers, so that their statistics can be read
+// while they download and the number of connections is limited
+type workerSet struct {
+	mu      sync.Mutex
+	workers map[*worker.Worker]bool
+	// running counts workers which weren't removed yet
+	running sync.WaitGroup
+}
+
+// newWorkerSet creates an empty set
+func newWorkerSet() *workerSet {
+	return &workerSet{workers: make(map[*worker.Worker]bool)}
+}
+
+// add starts tracking the worker
+func (s *workerSet) add(w *worker.Worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.workers[w] = true
+	s.running.Add(1)
+}
+
+// remove stops tracking the worker
+func (s *workerSet) remove(w *worker.Worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.workers[w] {
+		delete(s.workers, w)
+		s.running.Done()
+	}
+}
+
+// count returns the number of tracked workers
+func (s *workerSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.workers)
+}
+
+// wait blocks until every tracked worker is removed
+func (s *workerSet) wait() {
+	s.running.Wait()
+}
+
+// stats returns statistics of every tracked worker
+func (s *workerSet) stats() []worker.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make([]worker.Stats, 0, len(s.workers))
+	for w := range s.workers {
+		stats = append(stats, w.Stats())
+	}
+
+	return stats
+}
+
+// PeerStats returns download statistics of every peer workers run for
+func (torrent *Torrent) PeerStats() []worker.Stats {
+	return torrent.workers.stats()
+}
+
+// outbound implements [chokable] for a worker, so that peers the client
+// downloads from are unchoked by tit-for-tat as well as inbound ones
+type outbound struct {
+	*worker.Worker
+}
+
+// isInterested implements [chokable]
+func (o outbound) isInterested() bool {
+	return o.PeerInterested()
+}
+
+// uploaded implements [chokable]
+func (o outbound) uploaded() int64 {
+	return o.Uploaded()
+}
+
+// downloaded implements [chokable]. Blocks of a piece may come from
+// several peers, so every peer is credited with blocks it sent
+func (o outbound) downloaded() int64 {
+	return o.Stats().Downloaded
+}
+
+// setChoked implements [chokable]
+func (o outbound) setChoked(choked bool) {
+	o.SetChoked(choked)
+}
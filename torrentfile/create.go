@@ -0,0 +1,281 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/bencode"
+)
+
+const (
+	// minPieceLength and maxPieceLength bound automatically picked piece
+	// length
+	minPieceLength int = 32 * 1024
+	maxPieceLength int = 16 * 1024 * 1024
+	// targetPieces is the number of pieces piece length is picked for.
+	// Fewer pieces make smaller torrent files while more pieces let peers
+	// share data sooner
+	targetPieces int = 1500
+)
+
+// CreateOptions holds optional metadata of a created torrent
+type CreateOptions struct {
+	// AnnounceList holds tiers of tracker URLs. The first URL is used as
+	// announce URL
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate is omitted if it's zero
+	CreationDate time.Time
+	// Private torrents are announced to their trackers only (BEP 27)
+	Private bool
+	// WebSeeds are HTTP URLs serving torrent's files (BEP 19)
+	WebSeeds []string
+	// PieceLength is picked by total size of files if it's zero
+	PieceLength int
+}
+
+// sourceFile is a file included into created torrent
+type sourceFile struct {
+	path   string
+	parts  []string
+	length int
+}
+
+// Create hashes a file or all files of a directory and writes a bencoded
+// torrent of them to w. Returned torrent is the one [Open] would read from
+// the written data.
+func Create(path string, w io.Writer, opts CreateOptions) (TorrentFile, error) {
+	files, err := collectFiles(path)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	total := 0
+	for _, file := range files {
+		total += file.length
+	}
+
+	if total == 0 {
+		return TorrentFile{}, fmt.Errorf("%s has no data to share", path)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength <= 0 {
+		pieceLength = choosePieceLength(total)
+	}
+
+	pieces, err := hashFiles(files, total, pieceLength)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	torrent := bencodeTorrent{
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		Info: bencodeInfo{
+			Pieces:      pieces,
+			PieceLength: pieceLength,
+			Name:        filepath.Base(filepath.Clean(path)),
+		},
+	}
+
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		torrent.Announce = opts.AnnounceList[0][0]
+	}
+
+	if opts.Private {
+		torrent.Info.Private = 1
+	}
+
+	// Paths of files inside a directory make a multi-file torrent
+	if len(files) == 1 && files[0].parts == nil {
+		torrent.Info.Length = files[0].length
+	} else {
+		for _, file := range files {
+			torrent.Info.Files = append(torrent.Info.Files, bencodeFile{Length: file.length, Path: file.parts})
+		}
+	}
+
+	if err := bencode.NewEncoder(w).Encode(torrent.encode(opts)); err != nil {
+		return TorrentFile{}, err
+	}
+
+	return torrent.createTorrentFile()
+}
+
+// encode builds torrent dictionary with only non-empty optional keys
+func (torrent *bencodeTorrent) encode(opts CreateOptions) map[string]interface{} {
+	dict := map[string]interface{}{"info": torrent.Info}
+
+	if torrent.Announce != "" {
+		dict["announce"] = torrent.Announce
+	}
+
+	if len(torrent.AnnounceList) > 1 || len(torrent.AnnounceList) == 1 && len(torrent.AnnounceList[0]) > 1 {
+		dict["announce-list"] = torrent.AnnounceList
+	}
+
+	if torrent.Comment != "" {
+		dict["comment"] = torrent.Comment
+	}
+
+	if opts.CreatedBy != "" {
+		dict["created by"] = opts.CreatedBy
+	}
+
+	if !opts.CreationDate.IsZero() {
+		dict["creation date"] = opts.CreationDate.Unix()
+	}
+
+	if len(opts.WebSeeds) > 0 {
+		dict["url-list"] = opts.WebSeeds
+	}
+
+	return dict
+}
+
+// collectFiles returns the file at given path or regular files inside the
+// directory in lexical order
+func collectFiles(root string) ([]sourceFile, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []sourceFile{{path: root, length: int(info.Size())}}, nil
+	}
+
+	var files []sourceFile
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, sourceFile{
+			path:   path,
+			parts:  strings.Split(filepath.ToSlash(relative), "/"),
+			length: int(info.Size()),
+		})
+
+		return nil
+	})
+
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("%s has no files", root)
+	}
+
+	return files, err
+}
+
+// choosePieceLength picks the smallest power of two piece length making
+// no more than targetPieces pieces
+func choosePieceLength(total int) int {
+	length := minPieceLength
+	for length < maxPieceLength && total/length > targetPieces {
+		length *= 2
+	}
+
+	return length
+}
+
+// hashFiles reads files sequentially as a single stream of pieces and
+// hashes the pieces in parallel. Pieces hashes are concatenated in order
+func hashFiles(files []sourceFile, total, pieceLength int) (string, error) {
+	count := (total + pieceLength - 1) / pieceLength
+	hashes := make([]byte, count*sha1.Size)
+
+	type piece struct {
+		index int
+		data  []byte
+	}
+
+	pieces := make(chan piece)
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for p := range pieces {
+				hash := sha1.Sum(p.data)
+				copy(hashes[p.index*sha1.Size:], hash[:])
+			}
+		}()
+	}
+
+	read := 0
+	err := readPieces(files, pieceLength, func(index int, data []byte) {
+		read += len(data)
+		pieces <- piece{index, data}
+	})
+
+	close(pieces)
+	wg.Wait()
+
+	if err == nil && read != total {
+		err = errors.New("files were changed while hashing")
+	}
+
+	return string(hashes), err
+}
+
+// readPieces splits concatenated contents of the files into pieces. Files
+// are opened one by one, so directories may have any number of them
+func readPieces(files []sourceFile, pieceLength int, fn func(index int, data []byte)) error {
+	index, data := 0, make([]byte, 0, pieceLength)
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+
+		// Files growing while hashing must not shift pieces
+		r := io.LimitReader(f, int64(file.length))
+		for {
+			n, err := io.ReadFull(r, data[len(data):cap(data)])
+			data = data[:len(data)+n]
+			if len(data) == cap(data) {
+				fn(index, data)
+				index, data = index+1, make([]byte, 0, pieceLength)
+			}
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		f.Close()
+	}
+
+	if len(data) > 0 {
+		fn(index, data)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	type testCase struct {
+		files   map[string]int
+		input   string
+		content []string
+		paths   []utils.PathInfo
+	}
+
+	tt := map[string]testCase{
+		"single file": {
+			files:   map[string]int{"file.bin": 80000},
+			input:   "file.bin",
+			content: []string{"file.bin"},
+			paths:   []utils.PathInfo{},
+		},
+		"directory": {
+			files:   map[string]int{"dir/a.bin": 40000, "dir/sub/b.bin": 30000, "dir/sub/empty": 0},
+			input:   "dir",
+			content: []string{"dir/a.bin", "dir/sub/b.bin", "dir/sub/empty"},
+			paths: []utils.PathInfo{
+				{Path: "a.bin", Offset: 0, Length: 40000},
+				{Path: filepath.Join("sub", "b.bin"), Offset: 40000, Length: 70000},
+				{Path: filepath.Join("sub", "empty"), Offset: 70000, Length: 70000},
+			},
+		},
+	}
+
+	opts := CreateOptions{
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:6969"}},
+		Comment:      "build artifacts",
+		CreatedBy:    "leech",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		WebSeeds:     []string{"http://example.com/files/"},
+		PieceLength:  32 * 1024,
+	}
+
+	for name, tc := range tt {
+		dir := t.TempDir()
+		var content []byte
+		for path, size := range tc.files {
+			data := make([]byte, size)
+			rand.Read(data)
+
+			require.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755), name)
+			require.Nil(t, os.WriteFile(filepath.Join(dir, path), data, 0644), name)
+		}
+
+		for _, path := range tc.content {
+			data, err := os.ReadFile(filepath.Join(dir, path))
+			require.Nil(t, err, name)
+			content = append(content, data...)
+		}
+
+		var buf bytes.Buffer
+		created, err := Create(filepath.Join(dir, tc.input), &buf, opts)
+		require.Nil(t, err, name)
+
+		// Reloaded torrent has the same infohash
+		decoded, err := DecodeTorrentFile(bytes.NewReader(buf.Bytes()))
+		require.Nil(t, err, name)
+		reloaded, err := decoded.createTorrentFile()
+		require.Nil(t, err, name)
+		assert.Equal(t, created.InfoHash, reloaded.InfoHash, name)
+		assert.Equal(t, tc.input, reloaded.Name, name)
+		assert.Equal(t, tc.paths, reloaded.Paths, name)
+		assert.Equal(t, "http://a/announce", reloaded.Announce, name)
+		assert.Equal(t, "build artifacts", decoded.Comment, name)
+		assert.Equal(t, 1, decoded.Info.Private, name)
+		assert.True(t, reloaded.Private, name)
+
+		var pieces []utils.BTString
+		for begin := 0; begin < len(content); begin += opts.PieceLength {
+			pieces = append(pieces, sha1.Sum(content[begin:min(begin+opts.PieceLength, len(content))]))
+		}
+
+		assert.Equal(t, pieces, reloaded.PieceHashes, name)
+
+		// Created torrents are canonical
+		var dict map[string]interface{}
+		require.Nil(t, bencode.UnmarshalStrict(buf.Bytes(), &dict), name)
+
+		assert.Equal(t, "leech", dict["created by"], name)
+		assert.Equal(t, int64(1700000000), dict["creation date"], name)
+		assert.Equal(t, []interface{}{"http://example.com/files/"}, dict["url-list"], name)
+	}
+}
+
+func TestCreateEmpty(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "empty"), nil, 0644))
+
+	_, err := Create(dir, &bytes.Buffer{}, CreateOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	tt := map[string]struct {
+		total  int
+		output int
+	}{
+		"small file":     {total: 1024, output: minPieceLength},
+		"medium file":    {total: 1024 * 1024 * 1024, output: 1024 * 1024},
+		"very large one": {total: 1 << 40, output: maxPieceLength},
+	}
+
+	for name, tc := range tt {
+		assert.Equal(t, tc.output, choosePieceLength(tc.total), name)
+	}
+}
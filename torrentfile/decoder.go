@@ -1,13 +1,13 @@
 package torrentfile
 
 import (
-	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"path/filepath"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/sauromates/leech/internal/bencode"
 	"github.com/sauromates/leech/internal/utils"
 )
 
@@ -16,70 +16,63 @@ type bencodeFile struct {
 	Path   []string `bencode:"path"`
 }
 
+// bencodeInfo is info dictionary of either single- or multi-file torrent.
+// Keys of the other kind are left empty and omitted when encoded.
 type bencodeInfo struct {
 	Pieces      string        `bencode:"pieces"`
 	PieceLength int           `bencode:"piece length"`
-	Length      int           `bencode:"length"`
+	Length      int           `bencode:"length,omitempty"`
 	Name        string        `bencode:"name"`
-	Files       []bencodeFile `bencode:"files"`
-}
-
-type singleFileBencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-}
-
-type multiFileBencodeInfo struct {
-	Pieces      string        `bencode:"pieces"`
-	PieceLength int           `bencode:"piece length"`
-	Name        string        `bencode:"name"`
-	Files       []bencodeFile `bencode:"files"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Private     int           `bencode:"private,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Comment  string      `bencode:"comment"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Comment      string      `bencode:"comment"`
+	Info         bencodeInfo `bencode:"-"`
+	// RawInfo holds exact bytes of info dictionary if they are known
+	RawInfo bencode.RawMessage `bencode:"info"`
 }
 
-// Decodes torrent file contents via `bencode` module
+// Decodes torrent file contents via `bencode` module keeping exact bytes
+// of info dictionary for infohash
 func DecodeTorrentFile(reader io.Reader) (*bencodeTorrent, error) {
 	torrent := bencodeTorrent{}
-	if err := bencode.Unmarshal(reader, &torrent); err != nil {
+	if err := bencode.NewDecoder(reader).Decode(&torrent); err != nil {
 		return nil, err
 	}
 
+	// Missing info dictionary leaves infohash to be computed from empty info
+	if torrent.RawInfo != nil {
+		if err := bencode.Unmarshal(torrent.RawInfo, &torrent.Info); err != nil {
+			return nil, err
+		}
+	}
+
 	return &torrent, nil
 }
 
-// Hashes whole torrent info via sha1.
-func (info *bencodeInfo) hash() (utils.BTString, error) {
-	var buffer bytes.Buffer
-	var hashableInfo interface{}
-
-	if len(info.Files) == 0 {
-		hashableInfo = singleFileBencodeInfo{
-			Pieces:      info.Pieces,
-			PieceLength: info.PieceLength,
-			Length:      info.Length,
-			Name:        info.Name,
-		}
-	} else {
-		hashableInfo = multiFileBencodeInfo{
-			Pieces:      info.Pieces,
-			PieceLength: info.PieceLength,
-			Name:        info.Name,
-			Files:       info.Files,
-		}
+// infoHash hashes exact bytes of info dictionary. Info of torrents built
+// in memory is encoded first
+func (torrent *bencodeTorrent) infoHash() (utils.BTString, error) {
+	if torrent.RawInfo != nil {
+		return sha1.Sum(torrent.RawInfo), nil
 	}
 
-	if err := bencode.Marshal(&buffer, hashableInfo); err != nil {
+	return torrent.Info.hash()
+}
+
+// Hashes torrent info encoded with known keys only via sha1. It matches
+// infohash only if info dictionary has no other keys.
+func (info *bencodeInfo) hash() (utils.BTString, error) {
+	data, err := bencode.Marshal(info)
+	if err != nil {
 		return utils.BTString{}, err
 	}
 
-	return sha1.Sum(buffer.Bytes()), nil
+	return sha1.Sum(data), nil
 }
 
 // Creates a hash for each parsed piece and wraps them all in a slice
@@ -104,6 +97,31 @@ func (info *bencodeInfo) hashPieces() ([]utils.BTString, error) {
 	return hashes, nil
 }
 
+// trackerTiers returns tiers of tracker URLs from `announce-list` (BEP 12)
+// with trackers shuffled within each tier. If there is no list, a single
+// tier with the `announce` URL is returned.
+func (torrent *bencodeTorrent) trackerTiers() [][]string {
+	tiers := make([][]string, 0, len(torrent.AnnounceList))
+	for _, tier := range torrent.AnnounceList {
+		if len(tier) == 0 {
+			continue
+		}
+
+		shuffled := make([]string, len(tier))
+		for i, j := range rand.Perm(len(tier)) {
+			shuffled[i] = tier[j]
+		}
+
+		tiers = append(tiers, shuffled)
+	}
+
+	if len(tiers) == 0 && torrent.Announce != "" {
+		tiers = append(tiers, []string{torrent.Announce})
+	}
+
+	return tiers
+}
+
 // fileBounds calculates the offset and length of each file in the torrent
 func (info *bencodeInfo) fileBounds() []utils.PathInfo {
 	files := make([]utils.PathInfo, len(info.Files))
@@ -123,7 +141,7 @@ func (info *bencodeInfo) fileBounds() []utils.PathInfo {
 }
 
 func (torrent *bencodeTorrent) createTorrentFile() (TorrentFile, error) {
-	infoHash, err := torrent.Info.hash()
+	infoHash, err := torrent.infoHash()
 	if err != nil {
 		return TorrentFile{}, err
 	}
@@ -134,13 +152,15 @@ func (torrent *bencodeTorrent) createTorrentFile() (TorrentFile, error) {
 	}
 
 	file := TorrentFile{
-		Announce:    torrent.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: torrent.Info.PieceLength,
-		Length:      &torrent.Info.Length,
-		Name:        torrent.Info.Name,
-		Paths:       torrent.Info.fileBounds(),
+		Announce:     torrent.Announce,
+		AnnounceList: torrent.trackerTiers(),
+		InfoHash:     infoHash,
+		PieceHashes:  pieceHashes,
+		PieceLength:  torrent.Info.PieceLength,
+		Length:       &torrent.Info.Length,
+		Name:         torrent.Info.Name,
+		Paths:        torrent.Info.fileBounds(),
+		Private:      torrent.Info.Private == 1,
 	}
 
 	return file, nil
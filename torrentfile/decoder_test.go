@@ -0,0 +1,92 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerTiers(t *testing.T) {
+	type testCase struct {
+		input  string
+		output [][]string
+	}
+
+	tt := map[string]testCase{
+		"announce only": {
+			input:  "d8:announce17:http://a/announcee",
+			output: [][]string{{"http://a/announce"}},
+		},
+		"announce list takes precedence": {
+			input: "d8:announce17:http://a/announce" +
+				"13:announce-listll17:http://b/announceel13:udp://c:6969/ee" +
+				"e",
+			output: [][]string{{"http://b/announce"}, {"udp://c:6969/"}},
+		},
+		"empty tiers are skipped": {
+			input:  "d8:announce17:http://a/announce13:announce-listllelee" + "e",
+			output: [][]string{{"http://a/announce"}},
+		},
+	}
+
+	for name, tc := range tt {
+		torrent, err := DecodeTorrentFile(strings.NewReader(tc.input))
+		require.Nil(t, err, name)
+
+		assert.Equal(t, tc.output, torrent.trackerTiers(), name)
+	}
+}
+
+func TestTrackerTiersShuffle(t *testing.T) {
+	torrent := bencodeTorrent{
+		AnnounceList: [][]string{{"a", "b", "c", "d"}, {"e"}},
+	}
+
+	tiers := torrent.trackerTiers()
+
+	assert.Len(t, tiers, 2)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, tiers[0])
+	assert.Equal(t, []string{"e"}, tiers[1])
+}
+
+func TestInfoHashFromRawInfo(t *testing.T) {
+	type testCase struct {
+		info string
+	}
+
+	pieces := "6:pieces20:" + strings.Repeat("x", 20)
+
+	tt := map[string]testCase{
+		"known keys only": {
+			info: "d6:lengthi10e4:name4:test12:piece lengthi16384e" + pieces + "e",
+		},
+		"private flag and source": {
+			info: "d6:lengthi10e6:md5sum32:" + strings.Repeat("0", 32) + "4:name4:test12:piece lengthi16384e" +
+				pieces + "7:privatei1e6:source3:LCHe",
+		},
+		"file attributes and meta version": {
+			info: "d5:filesld4:attr1:x6:lengthi10e4:pathl1:aeee12:meta versioni1e4:name4:test12:piece lengthi16384e" +
+				pieces + "e",
+		},
+		"unsorted keys": {
+			info: "d4:name4:test6:lengthi10e12:piece lengthi16384e" + pieces + "e",
+		},
+	}
+
+	for name, tc := range tt {
+		input := "d8:announce17:http://a/announce4:info" + tc.info + "e"
+		path := filepath.Join(t.TempDir(), "test.torrent")
+		require.Nil(t, os.WriteFile(path, []byte(input), 0644), name)
+
+		file, err := Open(path)
+		require.Nil(t, err, name)
+		assert.Equal(t, utils.BTString(sha1.Sum([]byte(tc.info))), file.InfoHash, name)
+		assert.Equal(t, "test", file.Name, name)
+	}
+}
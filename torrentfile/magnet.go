@@ -0,0 +1,132 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sauromates/leech/internal/bencode"
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+)
+
+const btihPrefix string = "urn:btih:"
+
+// Magnet holds torrent details parsed from a magnet link (BEP 9). It has
+// no info dictionary, which has to be fetched from peers.
+type Magnet struct {
+	InfoHash utils.BTString
+	// Name is a display name suggested by the link
+	Name     string
+	Trackers []string
+	// Peers are addresses of peers embedded into the link via `x.pe`
+	Peers []peers.Peer
+}
+
+// ParseMagnet parses a `magnet:?xt=urn:btih:` link with an infohash encoded
+// either as 40 hex characters or as 32 base32 characters
+func ParseMagnet(link string) (*Magnet, error) {
+	uri, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri.Scheme != "magnet" {
+		return nil, fmt.Errorf("invalid magnet link scheme %q", uri.Scheme)
+	}
+
+	query := uri.Query()
+	magnet := Magnet{Name: query.Get("dn"), Trackers: query["tr"]}
+
+	found := false
+	for _, topic := range query["xt"] {
+		if !strings.HasPrefix(topic, btihPrefix) {
+			continue
+		}
+
+		magnet.InfoHash, err = decodeInfoHash(strings.TrimPrefix(topic, btihPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return nil, fmt.Errorf("magnet link has no BitTorrent infohash")
+	}
+
+	for _, addr := range query["x.pe"] {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %w", addr, err)
+		}
+
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil {
+			return nil, fmt.Errorf("invalid peer address %q", addr)
+		}
+
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+
+		magnet.Peers = append(magnet.Peers, peers.Peer{IP: ip, Port: uint16(portNum)})
+	}
+
+	return &magnet, nil
+}
+
+// TorrentFile builds a torrent file from info dictionary fetched from peers.
+// Info dictionary must match magnet's infohash.
+func (m *Magnet) TorrentFile(info []byte) (TorrentFile, error) {
+	if sha1.Sum(info) != m.InfoHash {
+		return TorrentFile{}, fmt.Errorf("metadata doesn't match infohash %x", m.InfoHash)
+	}
+
+	torrent := bencodeTorrent{RawInfo: info}
+	if err := bencode.Unmarshal(info, &torrent.Info); err != nil {
+		return TorrentFile{}, err
+	}
+
+	if len(m.Trackers) > 0 {
+		torrent.Announce = m.Trackers[0]
+		torrent.AnnounceList = [][]string{m.Trackers}
+	}
+
+	if torrent.Info.Name == "" {
+		torrent.Info.Name = m.Name
+	}
+
+	return torrent.createTorrentFile()
+}
+
+// decodeInfoHash decodes hex or base32 encoded infohash
+func decodeInfoHash(encoded string) (utils.BTString, error) {
+	var infoHash utils.BTString
+	var decoded []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("infohash %q has invalid length %d", encoded, len(encoded))
+	}
+
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid infohash %q: %w", encoded, err)
+	}
+
+	copy(infoHash[:], decoded)
+
+	return infoHash, nil
+}
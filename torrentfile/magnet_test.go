@@ -0,0 +1,108 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMagnet(t *testing.T) {
+	type testCase struct {
+		input      string
+		output     *Magnet
+		shouldFail bool
+	}
+
+	infoHash := utils.BTString{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182}
+
+	tt := map[string]testCase{
+		"hex infohash with trackers and peers": {
+			input: "magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6" +
+				"&dn=debian-10.2.0-amd64-netinst.iso" +
+				"&tr=http%3A%2F%2Fbttracker.debian.org%3A6969%2Fannounce" +
+				"&tr=udp%3A%2F%2Ftracker.example.com%3A1337" +
+				"&x.pe=127.0.0.1:6881&x.pe=[::1]:6889",
+			output: &Magnet{
+				InfoHash: infoHash,
+				Name:     "debian-10.2.0-amd64-netinst.iso",
+				Trackers: []string{
+					"http://bttracker.debian.org:6969/announce",
+					"udp://tracker.example.com:1337",
+				},
+				Peers: []peers.Peer{
+					{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+					{IP: net.IPv6loopback, Port: 6889},
+				},
+			},
+		},
+		"base32 infohash": {
+			input:  "magnet:?xt=urn:btih:3D3TTTWDFCKWZTC3X4PYNWP5Z7N2RTVW",
+			output: &Magnet{InfoHash: infoHash},
+		},
+		"lowercase base32 infohash": {
+			input:  "magnet:?xt=urn:btih:3d3tttwdfckwztc3x4pynwp5z7n2rtvw",
+			output: &Magnet{InfoHash: infoHash},
+		},
+		"not a magnet link": {
+			input:      "http://example.com/?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6",
+			shouldFail: true,
+		},
+		"missing infohash": {
+			input:      "magnet:?dn=test",
+			shouldFail: true,
+		},
+		"invalid infohash length": {
+			input:      "magnet:?xt=urn:btih:d8f739",
+			shouldFail: true,
+		},
+		"invalid hex infohash": {
+			input:      "magnet:?xt=urn:btih:z8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6",
+			shouldFail: true,
+		},
+		"invalid peer address": {
+			input:      "magnet:?xt=urn:btih:d8f739cec328956ccc5bbf1f86d9fdcfdba8ceb6&x.pe=localhost",
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		magnet, err := ParseMagnet(tc.input)
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+
+		assert.Equal(t, tc.output, magnet, name)
+	}
+}
+
+func TestMagnetTorrentFile(t *testing.T) {
+	info := []byte("d6:lengthi100e4:name4:test12:piece lengthi50e6:pieces40:" +
+		"aaaaaaaaaaaaaaaaaaaabbbbbbbbbbbbbbbbbbbb" + "e")
+	magnet := Magnet{
+		InfoHash: sha1.Sum(info),
+		Name:     "ignored",
+		Trackers: []string{"http://tracker.example.com/announce"},
+	}
+
+	tf, err := magnet.TorrentFile(info)
+
+	require.Nil(t, err)
+	assert.Equal(t, magnet.InfoHash, tf.InfoHash)
+	assert.Equal(t, "test", tf.Name)
+	assert.Equal(t, 100, tf.GetLength())
+	assert.Equal(t, 50, tf.PieceLength)
+	assert.Len(t, tf.PieceHashes, 2)
+	assert.Equal(t, [][]string{{"http://tracker.example.com/announce"}}, tf.AnnounceList)
+
+	magnet.InfoHash = utils.BTString{}
+	_, err = magnet.TorrentFile(info)
+
+	assert.NotNil(t, err)
+}
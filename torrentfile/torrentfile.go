@@ -3,18 +3,25 @@ package torrentfile
 import (
 	"os"
 
-	"github.com/jackpal/bencode-go"
 	"github.com/sauromates/leech/internal/utils"
 )
 
 type TorrentFile struct {
-	Announce    string
-	InfoHash    utils.BTString
-	PieceHashes []utils.BTString
-	PieceLength int
-	Length      *int
-	Name        string
-	Paths       []utils.PathInfo
+	Announce string
+	// AnnounceList holds tiers of tracker URLs. Trackers within a tier are
+	// reordered so that the ones which answered come first (BEP 12)
+	AnnounceList [][]string
+	InfoHash     utils.BTString
+	PieceHashes  []utils.BTString
+	PieceLength  int
+	Length       *int
+	Name         string
+	Paths        []utils.PathInfo
+	// Private torrents get peers from their trackers only (BEP 27)
+	Private bool
+
+	// trackerIDs holds IDs which trackers asked to send back on announces
+	trackerIDs map[string]string
 }
 
 // Open unmarshals bencoded file into a TorrentFile struct
@@ -26,8 +33,8 @@ func Open(path string) (TorrentFile, error) {
 
 	defer file.Close()
 
-	torrent := bencodeTorrent{}
-	if err := bencode.Unmarshal(file, &torrent); err != nil {
+	torrent, err := DecodeTorrentFile(file)
+	if err != nil {
 		return TorrentFile{}, err
 	}
 
@@ -1,13 +1,19 @@
 package torrentfile
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"time"
 
-	"github.com/jackpal/bencode-go"
+	"github.com/sauromates/leech/internal/bencode"
 	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 )
@@ -16,25 +22,92 @@ import (
 type BencodeTrackerResponse struct {
 	// Refresh peers interval in seconds
 	Interval int `bencode:"interval"`
+	// Minimum announce interval in seconds, clients must not reannounce
+	// more frequently than this
+	MinInterval int `bencode:"min interval"`
 	// A blob containing peers' IP addresses and ports
-	Peers   string `bencode:"peers"`
-	Failure string `bencode:"failure reason"`
+	Peers string `bencode:"-"`
+	// RawPeers holds peers value as is until its model is known
+	RawPeers bencode.RawMessage `bencode:"peers"`
+	// A blob of IPv6 peers in compact form (BEP 7)
+	Peers6 string `bencode:"peers6"`
+	// Peers received in dictionary model instead of compact string
+	PeerList []peers.Peer `bencode:"-"`
+	Failure  string       `bencode:"failure reason"`
+	// An ID which should be sent back to the tracker on next announces
+	TrackerID string `bencode:"tracker id"`
 }
 
-func (t *TorrentFile) BuildTrackerURL(peerID utils.BTString, port uint16) (string, error) {
-	baseURL, err := url.Parse(t.Announce)
+// AnnounceEvent notifies trackers about torrent lifecycle changes. Values
+// match event codes of UDP tracker protocol.
+type AnnounceEvent uint32
+
+const (
+	EventNone      AnnounceEvent = 0 // Regular announce
+	EventCompleted AnnounceEvent = 1 // Download has been finished
+	EventStarted   AnnounceEvent = 2 // First announce of the torrent
+	EventStopped   AnnounceEvent = 3 // Client is leaving the swarm
+)
+
+// AnnounceRequest holds client state reported to trackers on every announce
+type AnnounceRequest struct {
+	PeerID     utils.BTString
+	Port       uint16
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      AnnounceEvent
+	// NumWant is the number of peers client would like to receive.
+	// Zero leaves it up to the tracker
+	NumWant int
+	// Key is a random number which helps trackers identify the client
+	// if its IP address changes
+	Key uint32
+}
+
+// tierGrace is how long trackers of a tier may take to answer once another
+// tracker of the tier has answered
+var tierGrace time.Duration = 3 * time.Second
+
+// AnnounceResult is a merged outcome of announce to a tier of trackers
+type AnnounceResult struct {
+	Peers []peers.Peer
+	// Interval is the shortest interval requested by answered trackers
+	Interval time.Duration
+	// MinInterval is the longest minimal interval of answered trackers
+	MinInterval time.Duration
+}
+
+func (t *TorrentFile) BuildTrackerURL(announce string, req AnnounceRequest) (string, error) {
+	baseURL, err := url.Parse(announce)
 	if err != nil {
 		return "", err
 	}
 
 	params := url.Values{
 		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.Itoa(req.Uploaded)},
+		"downloaded": []string{strconv.Itoa(req.Downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.GetLength())},
+		"left":       []string{strconv.Itoa(req.Left)},
+	}
+
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+
+	if req.Key != 0 {
+		params.Set("key", fmt.Sprintf("%08x", req.Key))
+	}
+
+	if trackerID := t.trackerIDs[announce]; trackerID != "" {
+		params.Set("trackerid", trackerID)
 	}
 
 	baseURL.RawQuery = params.Encode()
@@ -42,8 +115,190 @@ func (t *TorrentFile) BuildTrackerURL(peerID utils.BTString, port uint16) (strin
 	return baseURL.String(), nil
 }
 
-func (t *TorrentFile) RequestPeers(peerID utils.BTString, port uint16) ([]peers.Peer, error) {
-	url, err := t.BuildTrackerURL(peerID, port)
+// RequestPeers announces the torrent to its trackers tier by tier and
+// returns merged peers from every tracker of the first tier that yields any.
+// Announces of completed and stopped events don't need any peers, so they
+// stop at the first tier which answered.
+//
+// Trackers within a tier are asked concurrently. Once any of them answers,
+// the rest are given [tierGrace] to answer too, so that unresponsive
+// trackers don't hold up the tier. The ones which answered are moved to the
+// front of their tier so that they are asked first next time.
+func (t *TorrentFile) RequestPeers(req AnnounceRequest) (*AnnounceResult, error) {
+	if len(t.AnnounceList) == 0 {
+		t.AnnounceList = [][]string{{t.Announce}}
+	}
+
+	if t.trackerIDs == nil {
+		t.trackerIDs = make(map[string]string)
+	}
+
+	var errs []error
+	for i, tier := range t.AnnounceList {
+		results := t.requestTier(tier, req)
+
+		merged := AnnounceResult{}
+		working, silent, failing := []string{}, []string{}, []string{}
+		seen := make(map[string]bool)
+		for j, result := range results {
+			if result == nil {
+				silent = append(silent, tier[j])
+				continue
+			}
+
+			if result.err != nil {
+				log.Printf("[ERROR] Tracker %s failed: %s", tier[j], result.err)
+				errs = append(errs, fmt.Errorf("%s: %w", tier[j], result.err))
+				failing = append(failing, tier[j])
+
+				continue
+			}
+
+			working = append(working, tier[j])
+			if result.trackerID != "" {
+				t.trackerIDs[tier[j]] = result.trackerID
+			}
+
+			for _, peer := range result.peers {
+				if !seen[peer.String()] {
+					seen[peer.String()] = true
+					merged.Peers = append(merged.Peers, peer)
+				}
+			}
+
+			if merged.Interval == 0 || result.interval < merged.Interval {
+				merged.Interval = result.interval
+			}
+
+			merged.MinInterval = max(merged.MinInterval, result.minInterval)
+		}
+
+		t.AnnounceList[i] = slices.Concat(working, silent, failing)
+
+		if len(merged.Peers) > 0 || (len(working) > 0 && !req.wantsPeers()) {
+			return &merged, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no peers received from trackers")
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// requestTier concurrently announces the torrent to trackers of a tier and
+// returns their results in tier order. Trackers which didn't finish within
+// [tierGrace] after the first answer have nil results, their announces are
+// left to finish in background.
+func (t *TorrentFile) requestTier(tier []string, req AnnounceRequest) []*trackerResult {
+	type indexed struct {
+		index  int
+		result trackerResult
+	}
+
+	// Background announces work on a copy, so that they don't race with
+	// tracker IDs updated by the caller
+	snapshot := *t
+	snapshot.trackerIDs = maps.Clone(t.trackerIDs)
+
+	finished := make(chan indexed, len(tier))
+	for j, tracker := range tier {
+		go func() {
+			finished <- indexed{j, snapshot.requestTracker(tracker, req)}
+		}()
+	}
+
+	results := make([]*trackerResult, len(tier))
+	var grace <-chan time.Time
+	for range tier {
+		select {
+		case r := <-finished:
+			results[r.index] = &r.result
+			if r.result.err == nil && grace == nil {
+				grace = time.After(tierGrace)
+			}
+		case <-grace:
+			return results
+		}
+	}
+
+	return results
+}
+
+// trackerResult is an outcome of announce to a single tracker
+type trackerResult struct {
+	peers       []peers.Peer
+	interval    time.Duration
+	minInterval time.Duration
+	trackerID   string
+	err         error
+}
+
+// requestTracker announces the torrent to a single tracker and returns
+// the list of peers from the response along with announce intervals
+func (t *TorrentFile) requestTracker(announce string, req AnnounceRequest) trackerResult {
+	tracker, err := t.announce(announce, req)
+	if err != nil {
+		return trackerResult{err: err}
+	}
+
+	if tracker.Failure != "" {
+		return trackerResult{err: fmt.Errorf("request failed: %s", tracker.Failure)}
+	}
+
+	peers, err := tracker.peerList()
+	if err != nil {
+		return trackerResult{err: err}
+	}
+
+	return trackerResult{
+		peers:       peers,
+		interval:    time.Duration(tracker.Interval) * time.Second,
+		minInterval: time.Duration(tracker.MinInterval) * time.Second,
+		trackerID:   tracker.TrackerID,
+	}
+}
+
+// String returns the value of `event` parameter for HTTP trackers
+func (e AnnounceEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// wantsPeers tells whether the announce is made to receive new peers
+func (req AnnounceRequest) wantsPeers() bool {
+	return req.Event != EventCompleted && req.Event != EventStopped
+}
+
+// announce sends announce request via the protocol matching tracker URL
+func (t *TorrentFile) announce(announce string, req AnnounceRequest) (*BencodeTrackerResponse, error) {
+	trackerURL, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return t.announceHTTP(announce, req)
+	case "udp":
+		return t.announceUDP(trackerURL.Host, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", trackerURL.Scheme)
+	}
+}
+
+// announceHTTP requests peers from HTTP tracker
+func (t *TorrentFile) announceHTTP(announce string, req AnnounceRequest) (*BencodeTrackerResponse, error) {
+	url, err := t.BuildTrackerURL(announce, req)
 	if err != nil {
 		return nil, err
 	}
@@ -56,19 +311,78 @@ func (t *TorrentFile) RequestPeers(peerID utils.BTString, port uint16) ([]peers.
 
 	defer response.Body.Close()
 
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTrackerResponse(body)
+}
+
+// decodeTrackerResponse decodes bencoded tracker response. Peers may come
+// either as a compact string or as a list of dictionaries with `ip`, `port`
+// and `peer id` keys. The latter is decoded into
+// [BencodeTrackerResponse.PeerList].
+func decodeTrackerResponse(body []byte) (*BencodeTrackerResponse, error) {
 	tracker := BencodeTrackerResponse{}
-	if err := bencode.Unmarshal(response.Body, &tracker); err != nil {
+	if err := bencode.Unmarshal(body, &tracker); err != nil {
 		return nil, err
 	}
 
-	if tracker.Failure != "" {
-		return nil, fmt.Errorf("request failed: %s", tracker.Failure)
+	if len(tracker.RawPeers) == 0 {
+		return &tracker, nil
+	}
+
+	if tracker.RawPeers[0] != 'l' {
+		if err := bencode.Unmarshal(tracker.RawPeers, &tracker.Peers); err != nil {
+			return nil, err
+		}
+
+		return &tracker, nil
+	}
+
+	var list []struct {
+		IP   string `bencode:"ip"`
+		Port int64  `bencode:"port"`
+		ID   string `bencode:"peer id"`
+	}
+
+	if err := bencode.Unmarshal(tracker.RawPeers, &list); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range list {
+		// Host names are allowed too, but resolving them isn't worth it
+		peer := peers.Peer{IP: net.ParseIP(entry.IP), Port: uint16(entry.Port)}
+		if peer.IP == nil || entry.Port <= 0 || entry.Port > 65535 {
+			log.Printf("[ERROR] Skipping invalid peer %q port %d", entry.IP, entry.Port)
+			continue
+		}
+
+		if v4 := peer.IP.To4(); v4 != nil {
+			peer.IP = v4
+		}
+
+		copy(peer.ID[:], entry.ID)
+		tracker.PeerList = append(tracker.PeerList, peer)
+	}
+
+	return &tracker, nil
+}
+
+// peerList merges IPv4, IPv6 and non-compact peers from the response
+func (r *BencodeTrackerResponse) peerList() ([]peers.Peer, error) {
+	list, err := peers.Unmarshal([]byte(r.Peers))
+	if err != nil {
+		return nil, err
 	}
 
-	peers, err := peers.Unmarshal([]byte(tracker.Peers))
+	list6, err := peers.Unmarshal6([]byte(r.Peers6))
 	if err != nil {
 		return nil, err
 	}
 
-	return peers, nil
+	list = append(list, list6...)
+
+	return append(list, r.PeerList...), nil
 }
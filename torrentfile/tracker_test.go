@@ -5,10 +5,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBuildTrackerURL(t *testing.T) {
@@ -26,7 +28,11 @@ func TestBuildTrackerURL(t *testing.T) {
 	peerID := utils.BTString{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	const port uint16 = 6882
 
-	url, err := torrent.BuildTrackerURL(peerID, port)
+	url, err := torrent.BuildTrackerURL(torrent.Announce, AnnounceRequest{
+		PeerID: peerID,
+		Port:   port,
+		Left:   torrent.GetLength(),
+	})
 	expected := "http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info_hash=%D8%F79%CE%C3%28%95l%CC%5B%BF%1F%86%D9%FD%CF%DB%A8%CE%B6&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6882&uploaded=0"
 
 	if err != nil {
@@ -38,6 +44,26 @@ func TestBuildTrackerURL(t *testing.T) {
 	}
 }
 
+func TestBuildTrackerURLOptionalParams(t *testing.T) {
+	torrent := TorrentFile{
+		Announce:   "http://tracker.example.com/announce",
+		Length:     getPointer(100),
+		trackerIDs: map[string]string{"http://tracker.example.com/announce": "xyz"},
+	}
+
+	url, err := torrent.BuildTrackerURL(torrent.Announce, AnnounceRequest{
+		Port:    6882,
+		Left:    100,
+		Event:   EventStarted,
+		NumWant: 50,
+		Key:     0xbeef,
+	})
+	expected := "http://tracker.example.com/announce?compact=1&downloaded=0&event=started&info_hash=%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&key=0000beef&left=100&numwant=50&peer_id=%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00%00&port=6882&trackerid=xyz&uploaded=0"
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, url)
+}
+
 func TestRequestPeers(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		content := []byte(
@@ -73,10 +99,118 @@ func TestRequestPeers(t *testing.T) {
 		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
 	}
 
-	peers, err := tf.RequestPeers(peerID, port)
+	result, err := tf.RequestPeers(AnnounceRequest{PeerID: peerID, Port: port})
 
 	assert.Nil(t, err)
-	assert.Equal(t, expected, peers)
+	assert.Equal(t, expected, result.Peers)
+	assert.Equal(t, 900*time.Second, result.Interval)
+}
+
+func TestRequestPeersTiers(t *testing.T) {
+	failing := createHTTPTracker(t, "d14:failure reason12:unregisterede")
+	first := createHTTPTracker(t, "d8:intervali900e5:peers12:"+string([]byte{
+		192, 0, 2, 123, 0x1A, 0xE1,
+		127, 0, 0, 1, 0x1A, 0xE9,
+	})+"e")
+	second := createHTTPTracker(t, "d8:intervali900e5:peers12:"+string([]byte{
+		127, 0, 0, 1, 0x1A, 0xE9,
+		10, 0, 0, 1, 0x1A, 0xE9,
+	})+"e")
+
+	tf := TorrentFile{
+		AnnounceList: [][]string{
+			{failing},
+			{failing, first, second},
+		},
+		Length: getPointer(100),
+	}
+
+	expected := []peers.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+		{IP: net.IP{10, 0, 0, 1}, Port: 6889},
+	}
+
+	result, err := tf.RequestPeers(AnnounceRequest{Port: 6882})
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, result.Peers)
+	assert.Equal(t, [][]string{{failing}, {first, second, failing}}, tf.AnnounceList)
+}
+
+func TestRequestPeersAllTiersFail(t *testing.T) {
+	failing := createHTTPTracker(t, "d14:failure reason12:unregisterede")
+	tf := TorrentFile{
+		AnnounceList: [][]string{{failing}, {"wss://tracker.example.com"}},
+		Length:       getPointer(100),
+	}
+
+	result, err := tf.RequestPeers(AnnounceRequest{Port: 6882})
+
+	assert.Nil(t, result)
+	assert.ErrorContains(t, err, "unregistered")
+	assert.ErrorContains(t, err, "unsupported tracker protocol")
+}
+
+func TestDecodeTrackerResponse(t *testing.T) {
+	type testCase struct {
+		input      string
+		output     []peers.Peer
+		shouldFail bool
+	}
+
+	peerID := "-LE0001-abcdefghijkl"
+
+	tt := map[string]testCase{
+		"compact IPv4 and IPv6 peers": {
+			input: "d8:intervali900e5:peers6:" + string([]byte{127, 0, 0, 1, 0x1A, 0xE1}) +
+				"6:peers618:" + string([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE9}) + "e",
+			output: []peers.Peer{
+				{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+				{IP: net.IPv6loopback, Port: 6889},
+			},
+		},
+		"dictionary peers": {
+			input: "d8:intervali900e5:peersl" +
+				"d2:ip9:127.0.0.17:peer id20:" + peerID + "4:porti6881ee" +
+				"d2:ip11:2001:db8::14:porti6889ee" +
+				"d2:ip11:example.com4:porti6889ee" +
+				"ee",
+			output: []peers.Peer{
+				{IP: net.IP{127, 0, 0, 1}, Port: 6881, ID: utils.BTString([]byte(peerID))},
+				{IP: net.ParseIP("2001:db8::1"), Port: 6889},
+			},
+		},
+		"malformed IPv6 peers": {
+			input:      "d8:intervali900e6:peers64:" + string([]byte{127, 0, 0, 1}) + "e",
+			shouldFail: true,
+		},
+	}
+
+	for name, tc := range tt {
+		response, err := decodeTrackerResponse([]byte(tc.input))
+		require.Nil(t, err, name)
+
+		peers, err := response.peerList()
+		if tc.shouldFail {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, tc.output, peers, name)
+		}
+	}
+}
+
+// createHTTPTracker starts HTTP tracker stand-in which always replies with
+// given bencoded content
+func createHTTPTracker(t *testing.T, content string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(content))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL
 }
 
 func getPointer(val int) *int {
@@ -0,0 +1,227 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// udpProtocolID is a magic constant which identifies connect requests
+	udpProtocolID uint64 = 0x41727101980
+	// udpConnectionTTL is how long a connection ID may be reused after
+	// it was issued by a tracker
+	udpConnectionTTL time.Duration = time.Minute
+	// udpMaxRetries is the largest power of two the base timeout is
+	// multiplied by before giving up on a request. BEP 15 allows up to 8
+	// (3840 seconds), but with multiple trackers it's much faster to fall
+	// back to another one
+	udpMaxRetries int = 2
+)
+
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionError    uint32 = 3
+)
+
+// udpTimeout is a base timeout for UDP tracker requests which is doubled
+// on each retransmission
+var udpTimeout time.Duration = 15 * time.Second
+
+// Returned when tracker didn't answer after all retransmissions
+var ErrUDPTimeout error = errors.New("udp tracker did not respond")
+
+// udpConnection is a connection ID issued by a tracker with its expiry time
+type udpConnection struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpConnections caches connection IDs by tracker address so that
+// consecutive announces don't have to connect every time
+var udpConnections = struct {
+	sync.Mutex
+	ids map[string]udpConnection
+}{ids: make(map[string]udpConnection)}
+
+// udpTracker holds a socket to a tracker speaking UDP tracker protocol (BEP 15)
+type udpTracker struct {
+	conn net.Conn
+	host string
+}
+
+// announceUDP requests peers from UDP tracker. The response is converted to
+// [BencodeTrackerResponse] so that both protocols are handled the same way.
+func (t *TorrentFile) announceUDP(host string, req AnnounceRequest) (*BencodeTrackerResponse, error) {
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	// Connection ID is obtained once, so that connect retransmissions
+	// don't multiply announce ones
+	udp := udpTracker{conn, host}
+	var response []byte
+	connID, err := udp.connectionID()
+	if err == nil {
+		response, err = udp.send(udpActionAnnounce, func(txID uint32) []byte {
+			return t.buildUDPAnnounce(connID, txID, req)
+		})
+	}
+
+	if err != nil {
+		var trackerErr udpError
+		if errors.As(err, &trackerErr) {
+			return &BencodeTrackerResponse{Failure: string(trackerErr)}, nil
+		}
+
+		return nil, err
+	}
+
+	// interval (4), leechers (4), seeders (4) followed by compact peers
+	if len(response) < 12 {
+		return nil, fmt.Errorf("announce response is too short (%d bytes)", len(response))
+	}
+
+	tracker := BencodeTrackerResponse{
+		Interval: int(binary.BigEndian.Uint32(response[0:4])),
+	}
+
+	// Trackers reply with 18 byte IPv6 peers to announces sent over IPv6
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		tracker.Peers6 = string(response[12:])
+	} else {
+		tracker.Peers = string(response[12:])
+	}
+
+	return &tracker, nil
+}
+
+// buildUDPAnnounce serializes announce request
+func (t *TorrentFile) buildUDPAnnounce(connID uint64, txID uint32, req AnnounceRequest) []byte {
+	numWant := ^uint32(0) // -1 leaves it up to the tracker
+	if req.NumWant > 0 {
+		numWant = uint32(req.NumWant)
+	}
+
+	buf := make([]byte, 98)
+
+	binary.BigEndian.PutUint64(buf[0:8], connID)
+	binary.BigEndian.PutUint32(buf[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(buf[12:16], txID)
+	copy(buf[16:36], t.InfoHash[:])
+	copy(buf[36:56], req.PeerID[:])
+	binary.BigEndian.PutUint64(buf[56:64], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(buf[64:72], uint64(req.Left))
+	binary.BigEndian.PutUint64(buf[72:80], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(buf[80:84], uint32(req.Event))
+	binary.BigEndian.PutUint32(buf[84:88], 0) // IP address (default)
+	binary.BigEndian.PutUint32(buf[88:92], req.Key)
+	binary.BigEndian.PutUint32(buf[92:96], numWant)
+	binary.BigEndian.PutUint16(buf[96:98], req.Port)
+
+	return buf
+}
+
+// connectionID returns cached connection ID for the tracker or obtains
+// a new one if there is none or if it has expired
+func (tr *udpTracker) connectionID() (uint64, error) {
+	udpConnections.Lock()
+	conn, ok := udpConnections.ids[tr.host]
+	udpConnections.Unlock()
+
+	if ok && time.Now().Before(conn.expires) {
+		return conn.id, nil
+	}
+
+	response, err := tr.send(udpActionConnect, func(txID uint32) []byte {
+		buf := make([]byte, 16)
+		binary.BigEndian.PutUint64(buf[0:8], udpProtocolID)
+		binary.BigEndian.PutUint32(buf[8:12], udpActionConnect)
+		binary.BigEndian.PutUint32(buf[12:16], txID)
+
+		return buf
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 8 {
+		return 0, fmt.Errorf("connect response is too short (%d bytes)", len(response))
+	}
+
+	conn = udpConnection{
+		id:      binary.BigEndian.Uint64(response[0:8]),
+		expires: time.Now().Add(udpConnectionTTL),
+	}
+
+	udpConnections.Lock()
+	udpConnections.ids[tr.host] = conn
+	udpConnections.Unlock()
+
+	return conn.id, nil
+}
+
+// send writes a request built for a fresh transaction ID and waits for
+// matching response, retransmitting the request with exponential back-off.
+// Returns response payload without action and transaction ID.
+func (tr *udpTracker) send(action uint32, build func(txID uint32) []byte) ([]byte, error) {
+	for n := 0; n <= udpMaxRetries; n++ {
+		txID := rand.Uint32()
+		if _, err := tr.conn.Write(build(txID)); err != nil {
+			return nil, err
+		}
+
+		response, err := tr.receive(action, txID, udpTimeout<<n)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+
+		return response, err
+	}
+
+	return nil, ErrUDPTimeout
+}
+
+// receive reads datagrams until the one with expected transaction ID
+// arrives or until timeout expires. Stray datagrams are discarded.
+func (tr *udpTracker) receive(action, txID uint32, timeout time.Duration) ([]byte, error) {
+	tr.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer tr.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65536) // max UDP payload
+	for {
+		n, err := tr.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+			continue
+		}
+
+		switch respAction := binary.BigEndian.Uint32(buf[0:4]); respAction {
+		case action:
+			return buf[8:n], nil
+		case udpActionError:
+			return nil, udpError(buf[8:n])
+		default:
+			return nil, fmt.Errorf("unexpected action %d in tracker response", respAction)
+		}
+	}
+}
+
+// udpError is an error message sent by a tracker
+type udpError string
+
+func (e udpError) Error() string {
+	return fmt.Sprintf("tracker error: %s", string(e))
+}
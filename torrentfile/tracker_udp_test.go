@@ -0,0 +1,148 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+	"github.com/sauromates/leech/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestPeersUDP(t *testing.T) {
+	udpTimeout = 50 * time.Millisecond
+	defer func() { udpTimeout = 15 * time.Second }()
+
+	const connID uint64 = 0xC0FFEE
+	server := createUDPTracker(t, func(request []byte, attempt int) []byte {
+		action := binary.BigEndian.Uint32(request[8:12])
+		txID := request[12:16]
+
+		switch action {
+		case udpActionConnect:
+			assert.Equal(t, udpProtocolID, binary.BigEndian.Uint64(request[0:8]))
+
+			response := make([]byte, 16)
+			copy(response[4:8], txID)
+			binary.BigEndian.PutUint64(response[8:16], connID)
+
+			return response
+		case udpActionAnnounce:
+			// Drop the first announce to make client retransmit it
+			if attempt == 0 {
+				return nil
+			}
+
+			assert.Equal(t, connID, binary.BigEndian.Uint64(request[0:8]))
+			assert.Len(t, request, 98)
+			assert.Equal(t, uint16(6882), binary.BigEndian.Uint16(request[96:98]))
+
+			response := make([]byte, 20)
+			binary.BigEndian.PutUint32(response[0:4], udpActionAnnounce)
+			copy(response[4:8], txID)
+			binary.BigEndian.PutUint32(response[8:12], 900)
+			response = append(response,
+				192, 0, 2, 123, 0x1A, 0xE1, // 0x1AE1 = 6881
+				127, 0, 0, 1, 0x1A, 0xE9, // 0x1AE9 = 6889
+			)
+
+			return response
+		}
+
+		return nil
+	})
+
+	tf := TorrentFile{
+		Announce:    "udp://" + server,
+		InfoHash:    utils.BTString{216, 247, 57, 206, 195, 40, 149, 108, 204, 91, 191, 31, 134, 217, 253, 207, 219, 168, 206, 182},
+		PieceLength: 262144,
+		Length:      getPointer(351272960),
+		Name:        "debian-10.2.0-amd64-netinst.iso",
+	}
+
+	peerID := utils.BTString{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	expected := []peers.Peer{
+		{IP: net.IP{192, 0, 2, 123}, Port: 6881},
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+	}
+
+	result, err := tf.RequestPeers(AnnounceRequest{PeerID: peerID, Port: 6882})
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, result.Peers)
+	assert.Equal(t, 900*time.Second, result.Interval)
+}
+
+func TestRequestPeersUDPError(t *testing.T) {
+	server := createUDPTracker(t, func(request []byte, attempt int) []byte {
+		response := make([]byte, 8)
+		binary.BigEndian.PutUint32(response[0:4], udpActionError)
+		copy(response[4:8], request[12:16])
+
+		return append(response, "torrent not registered"...)
+	})
+
+	tf := TorrentFile{Announce: "udp://" + server, Length: getPointer(100)}
+
+	result, err := tf.RequestPeers(AnnounceRequest{Port: 6882})
+
+	assert.Nil(t, result)
+	assert.ErrorContains(t, err, "torrent not registered")
+}
+
+func TestRequestPeersUnresponsiveTracker(t *testing.T) {
+	tierGrace = 50 * time.Millisecond
+	defer func() { tierGrace = 3 * time.Second }()
+
+	silent := "udp://" + createUDPTracker(t, func(request []byte, attempt int) []byte {
+		return nil
+	})
+	working := createHTTPTracker(t, "d8:intervali900e5:peers6:"+string([]byte{
+		192, 0, 2, 123, 0x1A, 0xE1,
+	})+"e")
+
+	tf := TorrentFile{AnnounceList: [][]string{{silent, working}}, Length: getPointer(100)}
+
+	start := time.Now()
+	result, err := tf.RequestPeers(AnnounceRequest{Port: 6882})
+
+	require.Nil(t, err)
+	assert.Less(t, time.Since(start), udpTimeout)
+	assert.Equal(t, []peers.Peer{{IP: net.IP{192, 0, 2, 123}, Port: 6881}}, result.Peers)
+	assert.Equal(t, [][]string{{working, silent}}, tf.AnnounceList)
+}
+
+// createUDPTracker starts UDP tracker stand-in on localhost which replies to
+// every request with the result of a handler. Empty replies are dropped.
+// Handler receives the number of times the same action was requested.
+func createUDPTracker(t *testing.T, handler func(request []byte, attempt int) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		attempts := make(map[uint32]int)
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			action := binary.BigEndian.Uint32(buf[8:12])
+			response := handler(buf[:n], attempts[action])
+			attempts[action]++
+
+			if len(response) > 0 {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/peers"
+)
+
+const (
+	// minBacklog is the number of requests a pipeline starts with and
+	// never goes below
+	minBacklog int = 5
+	// backlogWindow is how often backlog is resized from throughput
+	// measured since the previous resize
+	backlogWindow time.Duration = time.Second
+)
+
+// Stats describes download from a connected peer
+type Stats struct {
+	Peer peers.Peer
+	// Backlog is the number of requests kept outstanding
+	Backlog int
+	// Throughput is the download rate in bytes per second
+	Throughput float64
+	// RTT is the shortest time the peer took to fulfil a request
+	RTT time.Duration
+	// Downloaded is the number of bytes of blocks received from the peer
+	Downloaded int64
+}
+
+// backlog sizes a pipeline to the bandwidth-delay product of the
+// connection, so that the peer always has enough requests to keep the
+// link busy. Requests which wait in peer's queue longer than a round trip
+// only delay re-requesting blocks elsewhere, so there are half as many
+// extra requests as the link carries per round trip.
+type backlog struct {
+	mu         sync.Mutex
+	size       int
+	throughput float64
+	// rtt is the shortest observed time between a request and its block.
+	// Longer times include waiting in peer's queue rather than the link
+	rtt        time.Duration
+	downloaded int64
+	// Blocks received since the window started
+	windowStart time.Time
+	windowBytes int
+}
+
+// newBacklog creates a backlog of minimal size
+func newBacklog() *backlog {
+	return &backlog{size: minBacklog}
+}
+
+// received records a block of given length which arrived at given time
+// after given latency. Backlog is resized within the limit once the
+// window is over.
+func (b *backlog) received(length int, latency time.Duration, now time.Time, limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.downloaded += int64(length)
+	if latency > 0 && (b.rtt == 0 || latency < b.rtt) {
+		b.rtt = latency
+	}
+
+	// The first block only starts the window since it's unknown how long
+	// it was transferred
+	if b.windowStart.IsZero() {
+		b.windowStart = now
+		return
+	}
+
+	b.windowBytes += length
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < backlogWindow {
+		return
+	}
+
+	rate := float64(b.windowBytes) / elapsed.Seconds()
+	if b.throughput == 0 {
+		b.throughput = rate
+	} else {
+		b.throughput = (b.throughput + rate) / 2
+	}
+
+	b.windowStart, b.windowBytes = now, 0
+
+	bdp := b.throughput * b.rtt.Seconds() / float64(MaxBlockSize)
+	b.size = max(minBacklog, min(limit, int(math.Ceil(bdp*1.5))+1))
+}
+
+// idle discards the current window when the pipeline runs dry, so that
+// time without requests doesn't count against throughput
+func (b *backlog) idle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.windowStart, b.windowBytes = time.Time{}, 0
+}
+
+// capacity returns backlog size within the limit
+func (b *backlog) capacity(limit int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return min(b.size, limit)
+}
+
+// stats returns current measurements
+func (b *backlog) stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return Stats{
+		Backlog:    b.size,
+		Throughput: b.throughput,
+		RTT:        b.rtt,
+		Downloaded: b.downloaded,
+	}
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBacklogResize(t *testing.T) {
+	type testCase struct {
+		// blocks is the number of blocks received per second
+		blocks  int
+		latency time.Duration
+		limit   int
+		output  int
+	}
+
+	tt := map[string]testCase{
+		"slow peer keeps minimal backlog": {
+			blocks:  2,
+			latency: 100 * time.Millisecond,
+			limit:   MaxBacklog,
+			output:  minBacklog,
+		},
+		"fast peer with high latency": {
+			// 100 blocks per second with 200 ms round trip is 20 blocks
+			// in flight and 10 extra requests
+			blocks:  100,
+			latency: 200 * time.Millisecond,
+			limit:   MaxBacklog,
+			output:  31,
+		},
+		"bounded by peer's limit": {
+			blocks:  1000,
+			latency: 500 * time.Millisecond,
+			limit:   50,
+			output:  50,
+		},
+	}
+
+	for name, tc := range tt {
+		b := newBacklog()
+		now := time.Now()
+		interval := time.Second / time.Duration(tc.blocks)
+		for range 3 * tc.blocks {
+			now = now.Add(interval)
+			b.received(MaxBlockSize, tc.latency, now, tc.limit)
+		}
+
+		stats := b.stats()
+		assert.Equal(t, tc.output, stats.Backlog, name)
+		assert.Equal(t, tc.output, b.capacity(tc.limit), name)
+		assert.Equal(t, tc.latency, stats.RTT, name)
+		assert.Equal(t, int64(3*tc.blocks*MaxBlockSize), stats.Downloaded, name)
+	}
+
+	// Peer's limit applies to minimal backlog too
+	assert.Equal(t, 2, newBacklog().capacity(2))
+}
@@ -0,0 +1,409 @@
+package worker
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sauromates/leech/internal/bitfield"
+)
+
+// blockTimeout is how long a requested block is reserved for the peer it
+// was requested from. Blocks late for longer are requested from others.
+const blockTimeout time.Duration = 15 * time.Second
+
+// blockRef identifies a block by index of its piece, offset within the
+// piece and length
+type blockRef struct {
+	index  int
+	begin  int
+	length int
+}
+
+// Picker schedules blocks of pieces between workers. It counts how many
+// connected peers have every piece and starts the rarest pieces first, so
+// that pieces few peers have are replicated before those peers leave.
+// Pieces of higher priority are started before any others.
+//
+// Blocks of the same piece may be downloaded from different peers. Pieces
+// in progress are finished before new ones are started and keep received
+// blocks when their workers leave. Once every remaining block is requested
+// the picker enters endgame and lets workers request blocks which are
+// already requested from other peers, so that the last pieces don't wait
+// for the slowest peers.
+type Picker struct {
+	mu sync.Mutex
+	// pending are the pieces which aren't started yet by index
+	pending map[int]*Piece
+	// active are the pieces being downloaded by index
+	active     map[int]*download
+	priorities map[int]int
+	// availability is the number of connected peers having each piece
+	availability []int
+	endgame      bool
+	closed       bool
+}
+
+// download is a piece being downloaded
+type download struct {
+	piece   *Piece
+	content []byte
+	blocks  []blockState
+	// left is the number of blocks which aren't received yet
+	left int
+}
+
+// blockState is a block of a piece in progress shared by all workers
+type blockState struct {
+	received bool
+	// owners are the pipelines the block is requested from. There are
+	// several of them in endgame or after the first request timed out
+	owners []*Pipeline
+	// requested is when the block was requested the last time
+	requested time.Time
+}
+
+// NewPicker creates a picker for a torrent with given number of pieces
+func NewPicker(count int) *Picker {
+	return &Picker{
+		pending:      make(map[int]*Piece),
+		active:       make(map[int]*download),
+		priorities:   make(map[int]int),
+		availability: make([]int, count),
+	}
+}
+
+// Add queues a piece for download with given priority
+func (p *Picker) Add(piece *Piece, priority int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[piece.Index] = piece
+	p.priorities[piece.Index] = priority
+}
+
+// Return puts back a piece which failed integrity check
+func (p *Picker) Return(piece *Piece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.active, piece.Index)
+	p.pending[piece.Index] = piece
+}
+
+// AddPeer counts pieces of a connected peer
+func (p *Picker) AddPeer(bf bitfield.BitField) {
+	p.count(bf, 1)
+}
+
+// RemovePeer stops counting pieces of a disconnected peer. The bitfield
+// must include pieces the peer announced with Have messages.
+func (p *Picker) RemovePeer(bf bitfield.BitField) {
+	p.count(bf, -1)
+}
+
+// Have counts a piece a connected peer announced it has
+func (p *Picker) Have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Close stops handing out blocks once the download is complete
+func (p *Picker) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+}
+
+// isClosed tells whether the download is complete
+func (p *Picker) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
+
+// pieces returns the number of pieces in the torrent
+func (p *Picker) pieces() int {
+	return len(p.availability)
+}
+
+// interesting tells whether the peer has any piece which isn't downloaded
+// yet
+func (p *Picker) interesting(has bitfield.BitField) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index := range p.pending {
+		if has.HasPiece(index) {
+			return true
+		}
+	}
+
+	for index := range p.active {
+		if has.HasPiece(index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// request reserves up to n blocks the peer has for the pipeline. Free
+// blocks of pieces in progress go first, then blocks of new pieces. In
+// endgame blocks requested from other peers are handed out too.
+func (p *Picker) request(owner *Pipeline, has bitfield.BitField, n int) []blockRef {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || n <= 0 {
+		return nil
+	}
+
+	refs := p.reserve(owner, has, n, false)
+	for len(refs) < n {
+		dl := p.start(has)
+		if dl == nil {
+			break
+		}
+
+		refs = append(refs, dl.reserve(owner, n-len(refs), false)...)
+	}
+
+	if len(refs) > 0 || len(p.pending) > 0 || len(p.active) == 0 {
+		return refs
+	}
+
+	if !p.endgame {
+		p.endgame = true
+		log.Printf("[INFO] Endgame: requesting last %d pieces from multiple peers", len(p.active))
+	}
+
+	return p.reserve(owner, has, n, true)
+}
+
+// reserve takes blocks of pieces in progress the peer has. Pieces closest
+// to completion go first, so that they are verified and shared sooner.
+func (p *Picker) reserve(owner *Pipeline, has bitfield.BitField, n int, duplicate bool) []blockRef {
+	downloads := make([]*download, 0, len(p.active))
+	for index, dl := range p.active {
+		if has.HasPiece(index) {
+			downloads = append(downloads, dl)
+		}
+	}
+
+	slices.SortFunc(downloads, func(a, b *download) int {
+		return cmp.Or(cmp.Compare(a.left, b.left), cmp.Compare(a.piece.Index, b.piece.Index))
+	})
+
+	var refs []blockRef
+	for _, dl := range downloads {
+		if len(refs) >= n {
+			break
+		}
+
+		refs = append(refs, dl.reserve(owner, n-len(refs), duplicate)...)
+	}
+
+	return refs
+}
+
+// start takes the rarest pending piece of the highest priority the peer
+// has. Ties are broken randomly so that peers don't start the same pieces.
+func (p *Picker) start(has bitfield.BitField) *download {
+	var picked *Piece
+	ties := 0
+	for index, piece := range p.pending {
+		if !has.HasPiece(index) {
+			continue
+		}
+
+		order := -1
+		if picked != nil {
+			order = p.compare(index, picked.Index)
+		}
+
+		switch order {
+		case 1:
+			continue
+		case 0:
+			// Reservoir sampling picks each of equal pieces evenly
+			ties++
+			if rand.IntN(ties) != 0 {
+				continue
+			}
+		default:
+			ties = 1
+		}
+
+		picked = piece
+	}
+
+	if picked == nil {
+		return nil
+	}
+
+	delete(p.pending, picked.Index)
+
+	dl := newDownload(picked)
+	p.active[picked.Index] = dl
+
+	return dl
+}
+
+// deliver stores a received block. The piece and its content are returned
+// when the block completes the piece. Duplicate blocks and blocks of
+// pieces which aren't in progress are ignored.
+func (p *Picker) deliver(owner *Pipeline, ref blockRef, data []byte) (*Piece, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dl, ok := p.active[ref.index]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	i := ref.begin / MaxBlockSize
+	if ref.begin%MaxBlockSize != 0 || i >= len(dl.blocks) || len(data) != dl.blockLength(i) {
+		return nil, nil, fmt.Errorf("unexpected block %d:%d of length %d", ref.index, ref.begin, len(data))
+	}
+
+	block := &dl.blocks[i]
+	block.owners = slices.DeleteFunc(block.owners, func(o *Pipeline) bool { return o == owner })
+	if block.received {
+		return nil, nil, nil
+	}
+
+	copy(dl.content[ref.begin:], data)
+	block.received = true
+	dl.left--
+
+	if dl.left > 0 {
+		return nil, nil, nil
+	}
+
+	delete(p.active, ref.index)
+
+	return dl.piece, dl.content, nil
+}
+
+// cancel frees blocks the pipeline won't receive, so that other workers
+// can request them. Received blocks are kept.
+func (p *Picker) cancel(owner *Pipeline, refs ...blockRef) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ref := range refs {
+		dl, ok := p.active[ref.index]
+		if !ok {
+			continue
+		}
+
+		block := &dl.blocks[ref.begin/MaxBlockSize]
+		block.owners = slices.DeleteFunc(block.owners, func(o *Pipeline) bool { return o == owner })
+	}
+}
+
+// isStale tells whether the block was received from another peer or
+// isn't needed anymore
+func (p *Picker) isStale(ref blockRef) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dl, ok := p.active[ref.index]
+
+	return !ok || dl.blocks[ref.begin/MaxBlockSize].received
+}
+
+// compare orders pieces by priority first and by availability second.
+// Negative result means piece a should be picked before piece b.
+func (p *Picker) compare(a, b int) int {
+	switch {
+	case p.priorities[a] != p.priorities[b]:
+		if p.priorities[a] > p.priorities[b] {
+			return -1
+		}
+
+		return 1
+	case p.availability[a] < p.availability[b]:
+		return -1
+	case p.availability[a] > p.availability[b]:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// count adds delta to availability of pieces in the bitfield
+func (p *Picker) count(bf bitfield.BitField, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for index := range p.availability {
+		if bf.HasPiece(index) {
+			p.availability[index] += delta
+		}
+	}
+}
+
+// newDownload prepares a buffer for blocks of the piece
+func newDownload(piece *Piece) *download {
+	count := (piece.Length + MaxBlockSize - 1) / MaxBlockSize
+
+	return &download{
+		piece:   piece,
+		content: make([]byte, piece.Length),
+		blocks:  make([]blockState, count),
+		left:    count,
+	}
+}
+
+// reserve takes up to n blocks of the piece which aren't received and
+// aren't requested by the owner yet. Blocks requested from other peers
+// are taken only once their requests time out or in endgame.
+func (dl *download) reserve(owner *Pipeline, n int, duplicate bool) []blockRef {
+	var refs []blockRef
+	now := time.Now()
+	for i := range dl.blocks {
+		if len(refs) >= n {
+			break
+		}
+
+		ref := blockRef{dl.piece.Index, i * MaxBlockSize, dl.blockLength(i)}
+		block := &dl.blocks[i]
+		if block.received || slices.Contains(block.owners, owner) {
+			continue
+		}
+
+		// Peers which failed to send a block get another chance in endgame
+		if owner.failed[ref] && !duplicate {
+			continue
+		}
+
+		free := len(block.owners) == 0 || now.Sub(block.requested) > blockTimeout
+		if !free && !duplicate {
+			continue
+		}
+
+		block.owners = append(block.owners, owner)
+		block.requested = now
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+// blockLength returns length of the block with given number, which is
+// smaller than [MaxBlockSize] for the last block only
+func (dl *download) blockLength(i int) int {
+	return min(MaxBlockSize, dl.piece.Length-i*MaxBlockSize)
+}
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPick(t *testing.T) {
+	type testCase struct {
+		priorities []int
+		peers      []bitfield.BitField
+		has        bitfield.BitField
+		output     int
+	}
+
+	// Every peer bitfield covers 4 pieces
+	tt := map[string]testCase{
+		"rarest piece": {
+			priorities: []int{0, 0, 0, 0},
+			peers:      []bitfield.BitField{{0b11110000}, {0b11010000}, {0b10010000}},
+			has:        bitfield.BitField{0b11110000},
+			output:     2,
+		},
+		"rarest piece the peer has": {
+			priorities: []int{0, 0, 0, 0},
+			peers:      []bitfield.BitField{{0b11110000}, {0b11010000}, {0b10010000}},
+			has:        bitfield.BitField{0b11010000},
+			output:     1,
+		},
+		"priority before rarity": {
+			priorities: []int{1, 0, 0, 0},
+			peers:      []bitfield.BitField{{0b11110000}, {0b10010000}},
+			has:        bitfield.BitField{0b11110000},
+			output:     0,
+		},
+		"nothing to pick": {
+			priorities: []int{0, 0, 0, 0},
+			peers:      []bitfield.BitField{{0b11110000}},
+			has:        bitfield.BitField{0b00000000},
+			output:     -1,
+		},
+	}
+
+	for name, tc := range tt {
+		picker := NewPicker(4)
+		for index, priority := range tc.priorities {
+			picker.Add(&Piece{Index: index, Length: 10}, priority)
+		}
+
+		for _, bf := range tc.peers {
+			picker.AddPeer(bf)
+		}
+
+		refs := picker.request(newPipeline(nil, picker), tc.has, 1)
+		if tc.output < 0 {
+			assert.Empty(t, refs, name)
+		} else {
+			require.Len(t, refs, 1, name)
+			assert.Equal(t, tc.output, refs[0].index, name)
+		}
+	}
+}
+
+func TestPickAvailabilityChanges(t *testing.T) {
+	picker := NewPicker(2)
+	picker.Add(&Piece{Index: 0, Length: 10}, 0)
+	picker.Add(&Piece{Index: 1, Length: 10}, 0)
+
+	leaving := bitfield.BitField{0b10000000}
+	picker.AddPeer(leaving)
+	picker.AddPeer(bitfield.BitField{0b11000000})
+
+	// Piece 1 is the rarest until another peer announces it and the only
+	// other owner of piece 0 leaves
+	picker.Have(1)
+	picker.RemovePeer(leaving)
+
+	first := newPipeline(nil, picker)
+	refs := picker.request(first, bitfield.BitField{0b11000000}, 1)
+	require.Len(t, refs, 1)
+	assert.Equal(t, 0, refs[0].index)
+
+	// Requested blocks aren't handed out twice while other pieces are pending
+	second := newPipeline(nil, picker)
+	assert.Empty(t, picker.request(second, bitfield.BitField{0b10000000}, 1))
+
+	picker.Return(&Piece{Index: 0, Length: 10})
+	refs = picker.request(second, bitfield.BitField{0b10000000}, 1)
+	require.Len(t, refs, 1)
+	assert.Equal(t, 0, refs[0].index)
+
+	picker.Close()
+	assert.True(t, picker.isClosed())
+	assert.Empty(t, picker.request(first, bitfield.BitField{0b11000000}, 1))
+}
+
+func TestPickRandomTies(t *testing.T) {
+	picked := make(map[int]bool)
+	for range 100 {
+		picker := NewPicker(4)
+		for index := range 4 {
+			picker.Add(&Piece{Index: index, Length: 10}, 0)
+		}
+
+		refs := picker.request(newPipeline(nil, picker), bitfield.BitField{0b11110000}, 1)
+		picked[refs[0].index] = true
+	}
+
+	assert.Len(t, picked, 4)
+}
+
+func TestRequestBlocks(t *testing.T) {
+	picker := NewPicker(1)
+	picker.Add(&Piece{Index: 0, Length: 2*MaxBlockSize + 10}, 0)
+
+	has := bitfield.BitField{0b10000000}
+	first, second := newPipeline(nil, picker), newPipeline(nil, picker)
+
+	// Peers fill different blocks of the same piece
+	assert.Equal(t, []blockRef{{0, 0, MaxBlockSize}, {0, MaxBlockSize, MaxBlockSize}}, picker.request(first, has, 2))
+	assert.Equal(t, []blockRef{{0, 2 * MaxBlockSize, 10}}, picker.request(second, has, 2))
+
+	// Received blocks survive the worker leaving, the rest is handed out
+	// to other peers
+	piece, _, err := picker.deliver(first, blockRef{0, 0, MaxBlockSize}, make([]byte, MaxBlockSize))
+	require.Nil(t, err)
+	assert.Nil(t, piece)
+
+	picker.cancel(first, blockRef{0, MaxBlockSize, MaxBlockSize})
+	assert.Equal(t, []blockRef{{0, MaxBlockSize, MaxBlockSize}}, picker.request(second, has, 2))
+
+	// Malformed blocks are rejected
+	_, _, err = picker.deliver(second, blockRef{0, MaxBlockSize, 5}, make([]byte, 5))
+	assert.NotNil(t, err)
+
+	content := make([]byte, 2*MaxBlockSize+10)
+	rand.Read(content)
+
+	_, _, err = picker.deliver(second, blockRef{0, MaxBlockSize, MaxBlockSize}, content[MaxBlockSize:2*MaxBlockSize])
+	require.Nil(t, err)
+
+	piece, received, err := picker.deliver(second, blockRef{0, 2 * MaxBlockSize, 10}, content[2*MaxBlockSize:])
+	require.Nil(t, err)
+	require.NotNil(t, piece)
+	assert.Equal(t, 0, piece.Index)
+	assert.Equal(t, content[MaxBlockSize:], received[MaxBlockSize:])
+	assert.True(t, picker.isStale(blockRef{0, 0, MaxBlockSize}))
+}
+
+func TestRequestTimedOutBlocks(t *testing.T) {
+	picker := NewPicker(2)
+	picker.Add(&Piece{Index: 0, Length: MaxBlockSize}, 1)
+	picker.Add(&Piece{Index: 1, Length: MaxBlockSize}, 0)
+
+	has := bitfield.BitField{0b11000000}
+	slow, fast := newPipeline(nil, picker), newPipeline(nil, picker)
+
+	ref := blockRef{0, 0, MaxBlockSize}
+	assert.Equal(t, []blockRef{ref}, picker.request(slow, has, 1))
+
+	// Late blocks are requested from other peers
+	picker.active[0].blocks[0].requested = time.Now().Add(-2 * blockTimeout)
+	assert.Equal(t, []blockRef{ref}, picker.request(fast, has, 1))
+
+	// The slow peer doesn't get the block back until endgame
+	picker.cancel(slow, ref)
+	slow.failed[ref] = true
+	picker.active[0].blocks[0].requested = time.Now().Add(-2 * blockTimeout)
+	assert.Equal(t, []blockRef{{1, 0, MaxBlockSize}}, picker.request(slow, has, 1))
+	assert.Equal(t, []blockRef{ref}, picker.request(slow, has, 1))
+}
+
+func TestEndgame(t *testing.T) {
+	picker := NewPicker(2)
+	picker.Add(&Piece{Index: 0, Length: MaxBlockSize + 10}, 0)
+	picker.Add(&Piece{Index: 1, Length: 10}, 0)
+
+	first, second := newPipeline(nil, picker), newPipeline(nil, picker)
+	require.Len(t, picker.request(first, bitfield.BitField{0b10000000}, 5), 2)
+	assert.Equal(t, []blockRef{{1, 0, 10}}, picker.request(second, bitfield.BitField{0b01000000}, 5))
+
+	// Every block is requested, so blocks are requested from several peers
+	shared := picker.request(second, bitfield.BitField{0b11000000}, 5)
+	assert.Equal(t, []blockRef{{0, 0, MaxBlockSize}, {0, MaxBlockSize, 10}}, shared)
+	assert.True(t, picker.endgame)
+
+	// Blocks received from one peer become stale for the others and
+	// duplicates are ignored
+	_, _, err := picker.deliver(first, shared[0], make([]byte, MaxBlockSize))
+	require.Nil(t, err)
+	assert.True(t, picker.isStale(shared[0]))
+	assert.False(t, picker.isStale(shared[1]))
+
+	piece, _, err := picker.deliver(second, shared[0], make([]byte, MaxBlockSize))
+	assert.Nil(t, err)
+	assert.Nil(t, piece)
+
+	piece, _, err = picker.deliver(second, shared[1], make([]byte, 10))
+	require.Nil(t, err)
+	require.NotNil(t, piece)
+	assert.Equal(t, 0, piece.Index)
+
+	// Pieces failing integrity check start over
+	picker.Return(piece)
+	assert.Len(t, picker.request(first, bitfield.BitField{0b10000000}, 5), 2)
+}
@@ -5,9 +5,13 @@ import (
 	"crypto/sha1"
 	"fmt"
 	_ "io"
+	"sync/atomic"
+	"time"
 
 	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/bitfield"
 	"github.com/sauromates/leech/internal/message"
+	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 )
 
@@ -15,9 +19,12 @@ const (
 	// MaxBlockSize is the largest number of bytes a request can ask for
 	// (default is 2048 Kb (16384 bytes))
 	MaxBlockSize int = 16384
-	// MaxBacklog is the number of unfulfilled requests a client can have
-	// in its pipeline
-	MaxBacklog int = 5
+	// MaxBacklog is the largest number of unfulfilled requests a client
+	// can have in its pipeline unless the peer advertises smaller `reqq`
+	MaxBacklog int = 250
+	// snubTimeout is how long a peer may keep requests unfulfilled before
+	// the connection is dropped
+	snubTimeout time.Duration = 30 * time.Second
 )
 
 // Piece represents downloadable piece
@@ -34,17 +41,54 @@ type Piece struct {
 type PieceContent struct {
 	Index   int
 	Content []byte
+	// Peer is the peer the piece was downloaded from
+	Peer peers.Peer
 }
 
-// Pipeline keeps track of piece download process while keeping backlog
-// of pending requests and current download state
+// Pipeline keeps track of blocks requested from a peer while keeping
+// backlog of pending requests and pieces completed by received blocks
 type Pipeline struct {
-	Index      int
-	Client     *client.Client
-	Content    []byte
-	Downloaded int
-	Requested  int
-	Backlog    int
+	Client *client.Client
+	// Picker counts pieces the peer announces and collects blocks
+	Picker *Picker
+	// requested are blocks requested from the peer with time of request
+	requested map[blockRef]time.Time
+	// failed are blocks the peer rejected or didn't send in time, they
+	// are requested from other peers
+	failed map[blockRef]bool
+	// allowed are pieces the peer allows requesting while choked (BEP 6)
+	allowed map[int]bool
+	// Piece and Content are set once a received block completes a piece
+	Piece   *Piece
+	Content []byte
+	// Backlog is the number of outstanding requests
+	Backlog int
+	// backlog sizes the pipeline from throughput and round trip time
+	backlog *backlog
+	// delivered is when the peer sent the last requested block
+	delivered time.Time
+	// storage serves peer's requests, they are discarded if it's nil
+	storage Storage
+	// announced are pieces the peer was told about and announcedAt is
+	// when pieces were checked last time
+	announced   bitfield.BitField
+	announcedAt time.Time
+	// uploaded is the total of bytes sent to the peer
+	uploaded *atomic.Int64
+}
+
+// newPipeline creates an empty pipeline for the connected peer
+func newPipeline(c *client.Client, picker *Picker) *Pipeline {
+	return &Pipeline{
+		Client:    c,
+		Picker:    picker,
+		requested: make(map[blockRef]time.Time),
+		failed:    make(map[blockRef]bool),
+		allowed:   make(map[int]bool),
+		backlog:   newBacklog(),
+		announced: make(bitfield.BitField, (picker.pieces()+7)/8),
+		uploaded:  new(atomic.Int64),
+	}
 }
 
 // ReadMessage processes responses from the connected peer
@@ -60,44 +104,204 @@ func (p *Pipeline) ReadMessage() error {
 
 	switch msg.ID {
 	case message.Unchoke:
-		p.Client.IsChoked = false
+		p.Client.PeerChoking = false
 	case message.Choke:
-		p.Client.IsChoked = true
+		// Peers discard pending requests when they choke unless fast
+		// extension is enabled, then they reject the requests explicitly
+		p.Client.PeerChoking = true
+		if !p.Client.Fast {
+			p.release()
+		}
+	case message.Interested, message.NotInterested:
+		p.Client.PeerInterested = msg.ID == message.Interested
 	case message.Have:
 		index, err := msg.ParseHave()
 		if err != nil {
 			return err
 		}
 
-		p.Client.BitField.SetPiece(index)
+		p.have(index)
+	case message.HaveAll:
+		for index := range p.Picker.pieces() {
+			p.have(index)
+		}
+	case message.BitField:
+		// Lazy peers split their bitfield into several messages and Have
+		// messages, so pieces are merged with the known ones
+		bf := bitfield.BitField(msg.Payload)
+		for index := range p.Picker.pieces() {
+			if bf.HasPiece(index) {
+				p.have(index)
+			}
+		}
 	case message.Piece:
-		downloaded, err := msg.ParsePiece(p.Index, p.Content)
+		index, begin, block, err := msg.ParseBlock()
+		if err != nil {
+			return err
+		}
+
+		// Blocks may still arrive after their requests were cancelled
+		ref := blockRef{index, begin, len(block)}
+		requested, ok := p.requested[ref]
+		if !ok {
+			return nil
+		}
+
+		delete(p.requested, ref)
+		p.Backlog--
+		p.delivered = time.Now()
+		p.backlog.received(len(block), p.delivered.Sub(requested), p.delivered, p.limit())
+
+		piece, content, err := p.Picker.deliver(p, ref, block)
+		if err != nil {
+			return err
+		}
+
+		p.Piece, p.Content = piece, content
+	case message.RejectRequest:
+		index, begin, length, err := msg.ParseRequest()
 		if err != nil {
 			return err
 		}
 
-		p.Downloaded += downloaded
+		// Rejected blocks are requested from other peers right away
+		ref := blockRef{index, begin, length}
+		if _, ok := p.requested[ref]; ok {
+			delete(p.requested, ref)
+			p.Backlog--
+			p.Picker.cancel(p, ref)
+			p.failed[ref] = true
+		}
+	case message.AllowedFast:
+		index, err := msg.ParseHave()
+		if err != nil {
+			return err
+		}
+
+		if index >= 0 && index < p.Picker.pieces() {
+			p.allowed[index] = true
+		}
+	case message.Request:
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return err
+		}
+
+		return p.serve(index, begin, length)
+	case message.Extended:
+		return p.Client.HandleExtended(msg)
+	}
+
+	// Suggested pieces are ignored in favor of rarest first order, messages
+	// of unknown extensions are ignored as well
+	return nil
+}
+
+// have records a piece the peer announced
+func (p *Pipeline) have(index int) {
+	if index < 0 || index >= p.Picker.pieces() || p.Client.BitField.HasPiece(index) {
+		return
+	}
+
+	p.Client.BitField.SetPiece(index)
+	p.Picker.Have(index)
+}
+
+// updateInterest tells the peer whether it has pieces the client wants
+func (p *Pipeline) updateInterest() error {
+	return p.Client.SetInterested(p.Picker.interesting(p.Client.BitField))
+}
+
+// requestBlocks fills the backlog with requests of blocks handed out by
+// the picker. Choked peers are asked only for pieces they allow requesting
+// while choked.
+func (p *Pipeline) requestBlocks() error {
+	has := p.Client.BitField
+	if p.Client.PeerChoking {
+		if !p.Client.Fast || len(p.allowed) == 0 {
+			return nil
+		}
+
+		has = make(bitfield.BitField, len(p.Client.BitField))
+		for index := range p.allowed {
+			if p.Client.BitField.HasPiece(index) {
+				has.SetPiece(index)
+			}
+		}
+	}
+
+	refs := p.Picker.request(p, has, p.backlog.capacity(p.limit())-p.Backlog)
+	if len(refs) > 0 && p.Backlog == 0 {
+		p.delivered = time.Now()
+		p.backlog.idle()
+	}
+
+	// Blocks are recorded first, so that all of them are released if
+	// the connection fails
+	now := time.Now()
+	for _, ref := range refs {
+		p.requested[ref] = now
+		p.Backlog++
+	}
+
+	for _, ref := range refs {
+		if err := p.Client.RequestPiece(ref.index, ref.begin, ref.length); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cancelStale cancels requests of blocks received from other peers and
+// requests the peer didn't fulfil in time
+func (p *Pipeline) cancelStale() error {
+	now := time.Now()
+	for ref, at := range p.requested {
+		timedOut := now.Sub(at) > blockTimeout
+		if !timedOut && !p.Picker.isStale(ref) {
+			continue
+		}
+
+		if err := p.Client.Write(message.CreateCancel(ref.index, ref.begin, ref.length)); err != nil {
+			return err
+		}
+
+		delete(p.requested, ref)
 		p.Backlog--
+		p.Picker.cancel(p, ref)
+
+		if timedOut {
+			p.failed[ref] = true
+		}
 	}
 
 	return nil
 }
 
-// hasBacklogSpace determines whether the worker can accumulate more requests
-// for given task
-func (p *Pipeline) hasBacklogSpace(pieceLength int) bool {
-	return p.Backlog < MaxBacklog && p.Requested < pieceLength
+// limit returns the largest backlog the peer accepts
+func (p *Pipeline) limit() int {
+	if hs := p.Client.PeerExtensions; hs != nil && hs.Reqq > 0 {
+		return min(hs.Reqq, MaxBacklog)
+	}
+
+	return MaxBacklog
+}
+
+// isSnubbed tells whether the peer stopped sending requested blocks
+func (p *Pipeline) isSnubbed() bool {
+	return p.Backlog > 0 && time.Since(p.delivered) > snubTimeout
 }
 
-// blockSize returns either a constant size of a block to request or (in case
-// of the last block) the calculated last block size
-func (p *Pipeline) blockSize(pieceLength int) int {
-	blockSize := pieceLength - p.Requested
-	if blockSize < MaxBlockSize {
-		return blockSize
+// release gives requested blocks back to the picker, blocks received so
+// far stay with their pieces
+func (p *Pipeline) release() {
+	for ref := range p.requested {
+		p.Picker.cancel(p, ref)
+		delete(p.requested, ref)
 	}
 
-	return MaxBlockSize
+	p.Backlog = 0
 }
 
 // verifyHashSum compares sha1 hash sums of a piece and downloaded content
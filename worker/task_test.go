@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/sauromates/leech/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadMessageState(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	picker := NewPicker(10)
+	picker.Add(&Piece{Index: 9, Length: 10}, 0)
+
+	c := &client.Client{Conn: local, AmChoking: true, PeerChoking: true, BitField: make(bitfield.BitField, 2)}
+	pipeline := newPipeline(c, picker)
+
+	messages := []*message.Message{
+		message.CreateEmpty(message.Unchoke),
+		message.CreateEmpty(message.Interested),
+		message.CreateHave(1),
+		// Lazy bitfield sent after Have
+		message.CreateBitField(bitfield.BitField{0b01100000, 0b01000000}),
+		message.CreateRequest(1, 0, 10),
+		{ID: 99, Payload: []byte{1, 2, 3}},
+		message.CreateHave(42),
+		message.CreateEmpty(message.NotInterested),
+		message.CreateEmpty(message.Choke),
+	}
+
+	go func() {
+		for _, msg := range messages {
+			remote.Write(msg.Serialize())
+		}
+	}()
+
+	sent := make(chan *message.Message, 1)
+	go func() {
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				close(sent)
+				return
+			}
+
+			sent <- msg
+		}
+	}()
+
+	for range messages {
+		require.Nil(t, pipeline.ReadMessage())
+		require.Nil(t, pipeline.updateInterest())
+	}
+
+	// The client becomes interested once the peer announces the missing
+	// piece and stays interested
+	assert.Equal(t, message.Interested, (<-sent).ID)
+	assert.True(t, c.AmInterested)
+
+	assert.True(t, c.PeerChoking)
+	assert.False(t, c.PeerInterested)
+	assert.True(t, c.AmChoking)
+	assert.Equal(t, bitfield.BitField{0b01100000, 0b01000000}, c.BitField)
+	assert.Equal(t, []int{0, 1, 1, 0, 0, 0, 0, 0, 0, 1}, picker.availability)
+}
+
+func TestFastExtension(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	picker := NewPicker(4)
+	for index := range 4 {
+		picker.Add(&Piece{Index: index, Length: 10}, 0)
+	}
+
+	c := &client.Client{Conn: local, AmChoking: true, PeerChoking: true, Fast: true, BitField: make(bitfield.BitField, 1)}
+	pipeline := newPipeline(c, picker)
+
+	sent := make(chan *message.Message, 10)
+	go func() {
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				close(sent)
+				return
+			}
+
+			sent <- msg
+		}
+	}()
+
+	received := func(msg *message.Message) {
+		go remote.Write(msg.Serialize())
+		require.Nil(t, pipeline.ReadMessage())
+	}
+
+	received(message.CreateEmpty(message.HaveAll))
+	assert.Equal(t, bitfield.BitField{0xf0}, c.BitField)
+
+	// Nothing is requested while choked until the peer allows some pieces
+	require.Nil(t, pipeline.requestBlocks())
+	assert.Zero(t, pipeline.Backlog)
+
+	received(message.CreateAllowedFast(2))
+	require.Nil(t, pipeline.requestBlocks())
+	assert.Equal(t, message.CreateRequest(2, 0, 10), <-sent)
+
+	// Choke doesn't discard requests, rejected ones are given back at once
+	received(message.CreateEmpty(message.Choke))
+	assert.Equal(t, 1, pipeline.Backlog)
+
+	received(message.CreateReject(2, 0, 10))
+	assert.Zero(t, pipeline.Backlog)
+	assert.True(t, pipeline.failed[blockRef{2, 0, 10}])
+	assert.Equal(t, []blockRef{{2, 0, 10}}, picker.request(newPipeline(nil, picker), bitfield.BitField{0x20}, 1))
+
+	// Requests of the peer are rejected since the client keeps choking it
+	received(message.CreateRequest(1, 0, 10))
+	assert.Equal(t, message.CreateReject(1, 0, 10), <-sent)
+}
+
+func TestServeRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	storage := &fakeStorage{have: bitfield.BitField{0b01000000}, block: []byte("block")}
+	c := &client.Client{Conn: local, AmChoking: true, PeerChoking: true, BitField: make(bitfield.BitField, 1)}
+	pipeline := newPipeline(c, NewPicker(4))
+	pipeline.storage = storage
+
+	sent := make(chan *message.Message, 4)
+	go func() {
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				close(sent)
+				return
+			}
+
+			sent <- msg
+		}
+	}()
+
+	// Peer learns about pieces the client has
+	require.Nil(t, pipeline.announce())
+	assert.Equal(t, message.CreateHave(1), <-sent)
+
+	// Requests of choked peer are discarded
+	go remote.Write(message.CreateRequest(1, 0, 5).Serialize())
+	require.Nil(t, pipeline.ReadMessage())
+	assert.Zero(t, storage.uploaded)
+
+	require.Nil(t, c.SetChoking(false))
+	assert.Equal(t, message.Unchoke, (<-sent).ID)
+
+	go remote.Write(message.CreateRequest(1, 0, 5).Serialize())
+	require.Nil(t, pipeline.ReadMessage())
+	assert.Equal(t, message.CreatePiece(1, 0, []byte("block")), <-sent)
+	assert.Equal(t, 5, storage.uploaded)
+	assert.Equal(t, int64(5), pipeline.uploaded.Load())
+}
+
+// fakeStorage has given pieces and returns the same block for every request
+type fakeStorage struct {
+	have     bitfield.BitField
+	block    []byte
+	uploaded int
+}
+
+func (s *fakeStorage) Pieces() bitfield.BitField {
+	return append(bitfield.BitField{}, s.have...)
+}
+
+func (s *fakeStorage) ReadBlock(index, begin, length int) ([]byte, error) {
+	return s.block, nil
+}
+
+func (s *fakeStorage) Uploaded(n int) {
+	s.uploaded += n
+}
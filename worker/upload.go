@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"time"
+
+	"github.com/sauromates/leech/internal/bitfield"
+	"github.com/sauromates/leech/internal/message"
+)
+
+// haveInterval is how often peers are told about pieces the client got
+const haveInterval time.Duration = 5 * time.Second
+
+// Storage gives workers access to pieces the client has, so that they can
+// upload them to peers they download from
+type Storage interface {
+	// Pieces returns a copy of the bitfield of pieces the client has
+	Pieces() bitfield.BitField
+	// ReadBlock reads a block of a piece the client has. Blocks outside
+	// of the piece or of missing pieces are errors
+	ReadBlock(index, begin, length int) ([]byte, error)
+	// Uploaded counts bytes sent to peers
+	Uploaded(n int)
+}
+
+// announce tells the peer about pieces the client got since the previous
+// announce. Pieces are checked at most once per [haveInterval].
+func (p *Pipeline) announce() error {
+	if p.storage == nil || time.Since(p.announcedAt) < haveInterval {
+		return nil
+	}
+
+	p.announcedAt = time.Now()
+
+	have := p.storage.Pieces()
+	for index := range p.Picker.pieces() {
+		if !have.HasPiece(index) || p.announced.HasPiece(index) {
+			continue
+		}
+
+		if err := p.Client.ConfirmHavePiece(index); err != nil {
+			return err
+		}
+
+		p.announced.SetPiece(index)
+	}
+
+	return nil
+}
+
+// serve uploads a block the peer requested. Requests of choked peers are
+// discarded, with fast extension they are rejected explicitly.
+func (p *Pipeline) serve(index, begin, length int) error {
+	if p.storage == nil || p.Client.AmChoking {
+		if p.Client.Fast {
+			return p.Client.Write(message.CreateReject(index, begin, length))
+		}
+
+		return nil
+	}
+
+	block, err := p.storage.ReadBlock(index, begin, length)
+	if err != nil {
+		return err
+	}
+
+	if err := p.Client.Write(message.CreatePiece(index, begin, block)); err != nil {
+		return err
+	}
+
+	p.storage.Uploaded(len(block))
+	p.uploaded.Add(int64(len(block)))
+
+	return nil
+}
@@ -3,9 +3,11 @@ package worker
 import (
 	"errors"
 	"log"
-	"time"
+	"net"
+	"sync/atomic"
 
 	"github.com/sauromates/leech/client"
+	"github.com/sauromates/leech/internal/mse"
 	"github.com/sauromates/leech/internal/peers"
 	"github.com/sauromates/leech/internal/utils"
 )
@@ -13,22 +15,50 @@ import (
 // Returned upon rejected or timed out connection with a peer
 var ErrConn error = errors.New("failed to connect to a peer")
 
+// Returned when a peer stops sending requested blocks
+var ErrSnubbed error = errors.New("peer stopped sending blocks")
+
 // Worker holds info needed for connections with peers and downloading pieces
 type Worker struct {
-	peer     peers.Peer
-	client   *client.Client
-	infoHash utils.BTString
-	clientID utils.BTString
+	peer       peers.Peer
+	client     *client.Client
+	infoHash   utils.BTString
+	clientID   utils.BTString
+	extensions *client.Registry
+	encryption mse.Policy
+	backlog    *backlog
+	// storage serves requests of the peer, nil storage disables uploads
+	storage Storage
+	// choked is the choke state decided by the caller, which is passed to
+	// the peer by the worker. Accessed atomically along with interested
+	// and uploaded since they are read while the worker is running
+	choked     atomic.Bool
+	interested atomic.Bool
+	uploaded   atomic.Int64
 }
 
-// Create creates new connection for a peer and puts it into new worker instance
-func Create(peer peers.Peer, infoHash, peerID utils.BTString) *Worker {
-	return &Worker{peer, nil, infoHash, peerID}
+// Create creates new connection for a peer and puts it into new worker
+// instance. Pieces from given storage are uploaded to the peer once it's
+// unchoked.
+func Create(peer peers.Peer, infoHash, peerID utils.BTString, extensions *client.Registry, encryption mse.Policy, storage Storage) *Worker {
+	w := Worker{
+		peer:       peer,
+		infoHash:   infoHash,
+		clientID:   peerID,
+		extensions: extensions,
+		encryption: encryption,
+		backlog:    newBacklog(),
+		storage:    storage,
+	}
+
+	w.choked.Store(true)
+
+	return &w
 }
 
 // Connect opens new TCP connection with a peer
 func (w *Worker) Connect() error {
-	client, err := client.Create(w.peer, w.infoHash, w.clientID)
+	client, err := client.Create(w.peer, w.infoHash, w.clientID, w.extensions, w.encryption)
 	if err != nil {
 		return ErrConn
 	}
@@ -40,77 +70,133 @@ func (w *Worker) Connect() error {
 	return nil
 }
 
-// Run starts listening to a task queue until it's empty or until a download error occurs
-func (w *Worker) Run(queue chan *Piece, results chan *PieceContent) error {
-	if err := w.Connect(); err != nil {
-		return err
-	}
+// Stats returns download statistics of the connection. It's safe to call
+// while the worker is running.
+func (w *Worker) Stats() Stats {
+	stats := w.backlog.stats()
+	stats.Peer = w.peer
+
+	return stats
+}
+
+// Peer returns the peer the worker connects to
+func (w *Worker) Peer() peers.Peer {
+	return w.peer
+}
+
+// SetChoked chokes or unchokes the peer. The peer is told about it by the
+// running worker.
+func (w *Worker) SetChoked(choked bool) {
+	w.choked.Store(choked)
+}
 
+// PeerInterested tells whether the peer wants to download from the client
+func (w *Worker) PeerInterested() bool {
+	return w.interested.Load()
+}
+
+// Uploaded returns the total of bytes sent to the peer
+func (w *Worker) Uploaded() int64 {
+	return w.uploaded.Load()
+}
+
+// Run downloads blocks handed out by the picker until it's closed or
+// until a download error occurs. The worker must be connected first.
+func (w *Worker) Run(picker *Picker, results chan *PieceContent) error {
 	defer w.client.Conn.Close()
 
-	w.client.Unchoke()
-	w.client.AnnounceInterest()
+	w.client.FitBitField(picker.pieces())
 
-	for piece := range queue {
-		if !w.client.BitField.HasPiece(piece.Index) {
-			queue <- piece
-			continue
+	// Pieces announced with Have messages are counted as they arrive, so
+	// the final bitfield matches everything counted for the peer
+	picker.AddPeer(w.client.BitField)
+	defer func() { picker.RemovePeer(w.client.BitField) }()
+
+	pipeline := newPipeline(w.client, picker)
+	pipeline.backlog = w.backlog
+	pipeline.storage = w.storage
+	pipeline.uploaded = &w.uploaded
+	defer pipeline.release()
+
+	for !picker.isClosed() {
+		if err := w.client.SetChoking(w.choked.Load()); err != nil {
+			log.Printf("[ERROR] Choke update failed: %s", err)
+			return err
 		}
 
-		content, err := w.downloadPiece(piece)
-		if err != nil {
-			log.Printf("[ERROR] Download failed: %s", err)
-			queue <- piece
+		if err := pipeline.announce(); err != nil {
+			log.Printf("[ERROR] Announce of pieces failed: %s", err)
+			return err
+		}
 
+		if err := w.client.TickExtensions(); err != nil {
+			log.Printf("[ERROR] Extension failed: %s", err)
 			return err
 		}
 
+		if err := w.exchange(pipeline); err != nil {
+			log.Printf("[ERROR] Download failed: %s", err)
+			return err
+		}
+
+		w.interested.Store(w.client.PeerInterested)
+
+		if pipeline.Piece == nil {
+			continue
+		}
+
+		piece, content := pipeline.Piece, pipeline.Content
+		pipeline.Piece, pipeline.Content = nil, nil
+
 		if err := piece.verifyHashSum(content); err != nil {
 			log.Printf("[ERROR] Invalid piece: %s", err)
-			queue <- piece
+			picker.Return(piece)
 
 			continue
 		}
 
-		w.client.ConfirmHavePiece(piece.Index)
-		results <- &PieceContent{piece.Index, content}
+		// Peers learn about pieces from storage once they are written,
+		// otherwise they are told right away
+		if w.storage == nil {
+			w.client.ConfirmHavePiece(piece.Index)
+		}
+
+		results <- &PieceContent{piece.Index, content, w.peer}
 	}
 
 	return nil
 }
 
-// downloadPiece attempts to process given task by requesting pieces in a
-// sequential pipeline
-func (w *Worker) downloadPiece(piece *Piece) ([]byte, error) {
-	pipeline := Pipeline{
-		Index:   piece.Index,
-		Client:  w.client,
-		Content: make([]byte, piece.Length),
+// exchange cancels stale requests, fills the backlog and
+// reads a message from the peer. Read timeout isn't an error since an
+// idle peer has nothing to say until it gets new pieces, but peers which
+// keep requests unfulfilled for too long are dropped.
+func (w *Worker) exchange(pipeline *Pipeline) error {
+	if err := pipeline.cancelStale(); err != nil {
+		return err
 	}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	w.client.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer w.client.Conn.SetDeadline(time.Time{})
+	if err := pipeline.requestBlocks(); err != nil {
+		return err
+	}
 
-	for pipeline.Downloaded < piece.Length {
-		if !pipeline.Client.IsChoked {
-			for pipeline.hasBacklogSpace(piece.Length) {
-				blockSize := pipeline.blockSize(piece.Length)
+	// Interest is reconsidered once nothing is requested from the peer
+	if pipeline.Backlog == 0 {
+		if err := pipeline.updateInterest(); err != nil {
+			return err
+		}
+	}
 
-				if err := w.client.RequestPiece(piece.Index, pipeline.Requested, blockSize); err != nil {
-					return nil, err
-				}
+	err := pipeline.ReadMessage()
 
-				pipeline.Backlog++
-				pipeline.Requested += blockSize
-			}
-		}
+	var netErr net.Error
+	if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+		return err
+	}
 
-		if err := pipeline.ReadMessage(); err != nil {
-			return nil, err
-		}
+	if pipeline.isSnubbed() {
+		return ErrSnubbed
 	}
 
-	return pipeline.Content, nil
+	return nil
 }